@@ -17,6 +17,7 @@ package client
 
 import (
 	"net"
+	"strings"
 )
 
 type Sender interface {
@@ -28,7 +29,16 @@ type NetworkSender struct {
 	connection net.Conn
 }
 
+// Creates a sender connected to addr using the proto network type. An addr
+// w/ a "unix:" or "unixgram:" prefix connects to that kind of unix socket at
+// the given path instead, regardless of proto.
 func NewNetworkSender(proto, addr string) (self *NetworkSender, err error) {
+	for _, network := range []string{"unix", "unixgram"} {
+		if strings.HasPrefix(addr, network+":") {
+			proto, addr = network, addr[len(network)+1:]
+			break
+		}
+	}
 	conn, err := net.Dial(proto, addr)
 	if err == nil {
 		self = &(NetworkSender{conn})
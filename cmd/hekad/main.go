@@ -46,6 +46,7 @@ func main() {
 	memProfName := flag.String("memprof", "", "Go memory profiler output file")
 	version := flag.Bool("version", false, "Output version and exit")
 	maxMsgLoops := flag.Uint("max_message_loops", 4, "Maximum number of times a message can pass thru the system")
+	baseDir := flag.String("base_dir", "/var/cache/hekad", "Base directory for persistent plugin data")
 	flag.Parse()
 
 	if *version {
@@ -81,6 +82,7 @@ func main() {
 	globals.DecoderPoolSize = *decoderPoolSize
 	globals.PluginChanSize = *chanSize
 	globals.MaxMsgLoops = *maxMsgLoops
+	globals.BaseDir = *baseDir
 	if globals.MaxMsgLoops == 0 {
 		globals.MaxMsgLoops = 1
 	}
@@ -0,0 +1,232 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+/*
+
+Message matcher test tool. Reads messages from protobufstream or JSON files
+(as written by FileOutput) and shows which of the provided message_matcher
+specs each message matches, w/ the captures and a clause by clause
+explanation.
+
+*/
+package main
+
+import (
+	"bufio"
+	"code.google.com/p/goprotobuf/proto"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// Flag value that collects every occurrence of a repeated flag.
+type specList []string
+
+func (self *specList) String() string {
+	return strings.Join(*self, ", ")
+}
+
+func (self *specList) Set(value string) error {
+	*self = append(*self, value)
+	return nil
+}
+
+func main() {
+	var specs specList
+	flag.Var(&specs, "match", "message_matcher spec to test (may be repeated)")
+	format := flag.String("format", "protobufstream",
+		"Input format: protobufstream or json")
+	explain := flag.Bool("explain", true,
+		"Show why each message did or didn't match")
+	matchesOnly := flag.Bool("matches_only", false,
+		"Only show messages that match at least one spec")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -match <spec> [options] [file ...]\n",
+			os.Args[0])
+		fmt.Fprintln(os.Stderr, "Reads from stdin if no files are given.")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if len(specs) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *format != "protobufstream" && *format != "json" {
+		log.Fatalf("Invalid format: %s", *format)
+	}
+
+	matchers := make([]*message.MatcherSpecification, len(specs))
+	for i, spec := range specs {
+		var err error
+		if matchers[i], err = message.CreateMatcherSpecification(spec); err != nil {
+			log.Fatalf("Invalid message_matcher:\n%s", err)
+		}
+	}
+
+	files := flag.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	var count, matched int
+	for _, path := range files {
+		var file *os.File
+		if path == "-" {
+			file = os.Stdin
+		} else {
+			var err error
+			if file, err = os.Open(path); err != nil {
+				log.Fatalf("Error opening input: %s", err)
+			}
+		}
+
+		var next func() (*message.Message, error)
+		if *format == "json" {
+			next = jsonReader(file)
+		} else {
+			next = protobufReader(file)
+		}
+		for {
+			msg, err := next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Fatalf("Error reading '%s': %s", path, err)
+			}
+			count++
+			if report(count, msg, specs, matchers, *explain, *matchesOnly) {
+				matched++
+			}
+		}
+		file.Close()
+	}
+	fmt.Printf("%d of %d messages matched\n", matched, count)
+}
+
+// Tests the message against each matcher, printing the results. Returns true
+// if any of the matchers matched.
+func report(n int, msg *message.Message, specs []string,
+	matchers []*message.MatcherSpecification, explain, matchesOnly bool) bool {
+
+	var any bool
+	matches := make([]bool, len(matchers))
+	captures := make([]map[string]string, len(matchers))
+	for i, matcher := range matchers {
+		matches[i], captures[i] = matcher.Match(msg)
+		any = any || matches[i]
+	}
+	if matchesOnly && !any {
+		return false
+	}
+
+	fmt.Printf("message %d: Uuid=%s Type=%q Logger=%q Severity=%d\n", n,
+		msg.GetUuidString(), msg.GetType(), msg.GetLogger(), msg.GetSeverity())
+	for i, matcher := range matchers {
+		result := "no match"
+		if matches[i] {
+			result = "MATCH"
+		}
+		fmt.Printf("  [%s] %s\n", result, specs[i])
+		if len(captures[i]) > 0 {
+			fmt.Printf("    captures: %v\n", captures[i])
+		}
+		if explain {
+			for _, line := range strings.Split(matcher.Explain(msg).String(), "\n") {
+				if line != "" {
+					fmt.Printf("    %s\n", line)
+				}
+			}
+		}
+	}
+	return any
+}
+
+// Returns a function that reads the next message from a file containing one
+// JSON encoded message per line.
+func jsonReader(file io.Reader) func() (*message.Message, error) {
+	reader := bufio.NewReader(file)
+	return func() (msg *message.Message, err error) {
+		var line []byte
+		for len(strings.TrimSpace(string(line))) == 0 {
+			if line, err = reader.ReadBytes('\n'); err != nil {
+				if err != io.EOF || len(strings.TrimSpace(string(line))) == 0 {
+					return
+				}
+			}
+		}
+		msg = new(message.Message)
+		if err = json.Unmarshal(line, msg); err != nil {
+			err = fmt.Errorf("invalid JSON message: %s", err)
+		}
+		return
+	}
+}
+
+// Returns a function that reads the next message from a Heka protocol stream,
+// i.e. a record separator, header length byte, protobuf encoded header, unit
+// separator, and protobuf encoded message for each message.
+func protobufReader(file io.Reader) func() (*message.Message, error) {
+	reader := bufio.NewReader(file)
+	return func() (msg *message.Message, err error) {
+		var b byte
+		for b != message.RECORD_SEPARATOR {
+			if b, err = reader.ReadByte(); err != nil {
+				return
+			}
+		}
+		var headerLength byte
+		if headerLength, err = reader.ReadByte(); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		headerBytes := make([]byte, int(headerLength)+1)
+		if _, err = io.ReadFull(reader, headerBytes); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if headerBytes[headerLength] != message.UNIT_SEPARATOR {
+			return nil, errors.New("missing unit separator")
+		}
+		header := new(message.Header)
+		if err = proto.Unmarshal(headerBytes[:headerLength], header); err != nil {
+			return nil, fmt.Errorf("invalid header: %s", err)
+		}
+		if header.GetMessageLength() > message.MAX_MESSAGE_SIZE {
+			return nil, fmt.Errorf("message exceeds the maximum length: %d",
+				header.GetMessageLength())
+		}
+		msgBytes := make([]byte, header.GetMessageLength())
+		if _, err = io.ReadFull(reader, msgBytes); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		msg = new(message.Message)
+		if err = proto.Unmarshal(msgBytes, msg); err != nil {
+			err = fmt.Errorf("invalid message: %s", err)
+		}
+		return
+	}
+}
+
+// A stream that ends in the middle of a record is truncated, not finished.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -94,6 +94,24 @@ func (h *Header) SetHmac(v []byte) {
 	}
 }
 
+func (h *Header) SetBatchSequence(v uint64) {
+	if h != nil {
+		if h.BatchSequence == nil {
+			h.BatchSequence = new(uint64)
+		}
+		*h.BatchSequence = v
+	}
+}
+
+func (h *Header) SetBatchSize(v uint32) {
+	if h != nil {
+		if h.BatchSize == nil {
+			h.BatchSize = new(uint32)
+		}
+		*h.BatchSize = v
+	}
+}
+
 func (m *Message) SetUuid(v []byte) {
 	if m != nil {
 		if cap(m.Uuid) != UUID_SIZE {
@@ -212,6 +212,8 @@ type Header struct {
 	HmacSigner       *string                  `protobuf:"bytes,4,opt,name=hmac_signer" json:"hmac_signer,omitempty"`
 	HmacKeyVersion   *uint32                  `protobuf:"varint,5,opt,name=hmac_key_version" json:"hmac_key_version,omitempty"`
 	Hmac             []byte                   `protobuf:"bytes,6,opt,name=hmac" json:"hmac,omitempty"`
+	BatchSequence    *uint64                  `protobuf:"varint,7,opt,name=batch_sequence" json:"batch_sequence,omitempty"`
+	BatchSize        *uint32                  `protobuf:"varint,8,opt,name=batch_size" json:"batch_size,omitempty"`
 	XXX_unrecognized []byte                   `json:"-"`
 }
 
@@ -264,6 +266,20 @@ func (this *Header) GetHmac() []byte {
 	return nil
 }
 
+func (this *Header) GetBatchSequence() uint64 {
+	if this != nil && this.BatchSequence != nil {
+		return *this.BatchSequence
+	}
+	return 0
+}
+
+func (this *Header) GetBatchSize() uint32 {
+	if this != nil && this.BatchSize != nil {
+		return *this.BatchSize
+	}
+	return 0
+}
+
 type Field struct {
 	Name             *string            `protobuf:"bytes,1,req,name=name" json:"name,omitempty"`
 	ValueType        *Field_ValueType   `protobuf:"varint,2,opt,name=value_type,enum=message.Field_ValueType,def=0" json:"value_type,omitempty"`
@@ -14,7 +14,16 @@
 
 package message
 
-import "fmt"
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
 
 // MatcherSpecification used by the message router to distribute messages
 type MatcherSpecification struct {
@@ -28,13 +37,65 @@ type MatcherSpecification struct {
 func CreateMatcherSpecification(spec string) (*MatcherSpecification, error) {
 	ms := new(MatcherSpecification)
 	ms.spec = spec
-	err := parseMatcherSpecification(ms)
-	if err != nil {
-		return nil, err
+	if diag := parseMatcherSpecification(ms); diag != nil {
+		return nil, diag
 	}
 	return ms, nil
 }
 
+// Diagnostic describes a problem found in a matcher spec
+type Diagnostic struct {
+	// Byte offset into the spec where the problem was found.
+	Pos int
+	// Description of the problem.
+	Message string
+	// Tokens that would have been valid at Pos, if known.
+	Expected []string
+	// The line of the spec containing Pos followed by a line w/ a caret
+	// marking Pos.
+	Snippet string
+}
+
+func newDiagnostic(spec string, pos int, msg string, expected []string) *Diagnostic {
+	if pos > len(spec) {
+		pos = len(spec)
+	}
+	if pos < 0 {
+		pos = 0
+	}
+	start := strings.LastIndex(spec[:pos], "\n") + 1
+	end := len(spec)
+	if i := strings.Index(spec[pos:], "\n"); i != -1 {
+		end = pos + i
+	}
+	line := spec[start:end]
+	caret := strings.Repeat(" ", utf8.RuneCountInString(spec[start:pos])) + "^"
+	return &Diagnostic{
+		Pos:      pos,
+		Message:  msg,
+		Expected: expected,
+		Snippet:  line + "\n" + caret,
+	}
+}
+
+func (d *Diagnostic) Error() string {
+	msg := fmt.Sprintf("%s at position %d", d.Message, d.Pos)
+	if len(d.Expected) > 0 {
+		msg += fmt.Sprintf(", expecting %s", strings.Join(d.Expected, " or "))
+	}
+	return msg + "\n" + d.Snippet
+}
+
+// ValidateMatcher checks the spec without creating a matcher, returning the
+// problems found or nil if it's valid
+func ValidateMatcher(spec string) []Diagnostic {
+	ms := &MatcherSpecification{spec: spec}
+	if diag := parseMatcherSpecification(ms); diag != nil {
+		return []Diagnostic{*diag}
+	}
+	return nil
+}
+
 // Match compares the message against the matcher spec and return the match
 // result and captures if applicable
 func (m *MatcherSpecification) Match(message *Message) (match bool,
@@ -54,6 +115,197 @@ func (m *MatcherSpecification) String() string {
 	return m.spec
 }
 
+// MatchExplanation describes how a clause of a matcher spec, and any
+// clauses nested within it, evaluated against a message
+type MatchExplanation struct {
+	// The clause, i.e. "Type == 'TEST'", or the logical operator joining the
+	// nested clauses.
+	Clause   string
+	Match    bool
+	Children []*MatchExplanation
+}
+
+// Explain evaluates every clause of the spec against the message, without
+// short circuiting, for debugging
+func (m *MatcherSpecification) Explain(msg *Message) *MatchExplanation {
+	return explainTree(m.vm, msg)
+}
+
+func explainTree(t *tree, msg *Message) *MatchExplanation {
+	if t == nil {
+		return &MatchExplanation{}
+	}
+	if t.left == nil {
+		captures := make(map[string]string) // discarded, Match returns them
+		return &MatchExplanation{
+			Clause: t.stmt.String(),
+			Match:  testExpr(msg, t.stmt, captures),
+		}
+	}
+	e := &MatchExplanation{Clause: t.stmt.op.token}
+	e.Children = append(e.Children, explainTree(t.left, msg))
+	if t.right != nil {
+		e.Children = append(e.Children, explainTree(t.right, msg))
+	}
+	switch t.stmt.op.tokenId {
+	case OP_AND:
+		e.Match = e.Children[0].Match && e.Children[1].Match
+	case OP_OR:
+		e.Match = e.Children[0].Match || e.Children[1].Match
+	case OP_NOT:
+		e.Match = !e.Children[0].Match
+	}
+	return e
+}
+
+// String outputs the explanation as an indented tree w/ one clause per line
+func (e *MatchExplanation) String() string {
+	var buf bytes.Buffer
+	e.write(&buf, "")
+	return buf.String()
+}
+
+func (e *MatchExplanation) write(buf *bytes.Buffer, indent string) {
+	fmt.Fprintf(buf, "%s%-5t %s\n", indent, e.Match, e.Clause)
+	for _, child := range e.Children {
+		child.write(buf, indent+"  ")
+	}
+}
+
+// String outputs the statement in matcher spec syntax
+func (s *Statement) String() string {
+	if s.op.tokenId == TRUE || s.op.tokenId == FALSE {
+		return s.op.token
+	}
+	field := s.field.token
+	if s.field.tokenId == VAR_FIELDS {
+		field = fmt.Sprintf("Fields[%s][%s][%s]", field,
+			indexString(s.field.fieldIndex), indexString(s.field.arrayIndex))
+	}
+	op := s.op.token
+	if s.op.tokenId == CIDR {
+		op = "IN CIDR"
+	}
+
+	var value string
+	switch {
+	case s.value.tokenId == NOW:
+		value = "NOW"
+		if s.value.duration > 0 {
+			value += " + " + s.value.duration.String()
+		} else if s.value.duration < 0 {
+			value += " - " + (-s.value.duration).String()
+		}
+	case s.value.tokenId == REGEXP_VALUE:
+		value = "/" + strings.Replace(s.value.token, "/", "\\/", -1) + "/"
+	case s.op.tokenId == OP_IN || s.op.tokenId == CIDR:
+		var values []string
+		for v := range s.value.stringSet {
+			values = append(values, strconv.Quote(v))
+		}
+		for v := range s.value.numericSet {
+			values = append(values, strconv.FormatFloat(v, 'g', -1, 64))
+		}
+		sort.Strings(values)
+		value = "(" + strings.Join(values, ", ") + ")"
+	case s.value.tokenId == STRING_VALUE:
+		value = strconv.Quote(s.value.token)
+	default:
+		value = s.value.token
+	}
+	return fmt.Sprintf("%s %s %s", field, op, value)
+}
+
+func indexString(i int) string {
+	if i == anyIndex {
+		return "*"
+	}
+	return strconv.Itoa(i)
+}
+
+// IndexKeys returns the values the message Type and Logger headers must
+// equal for a message to match the spec. A nil slice means the spec doesn't
+// limit that header to a set of literal values. This allows the router to skip
+// matchers that can't possibly match a message without evaluating them.
+func (m *MatcherSpecification) IndexKeys() (types, loggers []string) {
+	types, _ = requiredValues(m.vm, VAR_TYPE)
+	loggers, _ = requiredValues(m.vm, VAR_LOGGER)
+	return
+}
+
+// Walks the tree to find the set of literal values that the specified header
+// variable is required to equal for the tree to match. Returns ok == false if
+// there's no such requirement.
+func requiredValues(t *tree, variable int) (values []string, ok bool) {
+	if t == nil {
+		return
+	}
+	if t.left == nil {
+		if t.stmt.field.tokenId != variable {
+			return
+		}
+		switch t.stmt.op.tokenId {
+		case OP_EQ:
+			return []string{t.stmt.value.token}, true
+		case OP_IN:
+			values = make([]string, 0, len(t.stmt.value.stringSet))
+			for value := range t.stmt.value.stringSet {
+				values = append(values, value)
+			}
+			sort.Strings(values)
+			return values, true
+		}
+		return
+	}
+	if t.stmt.op.tokenId == OP_NOT {
+		return // a negation can't require a value
+	}
+
+	left, lok := requiredValues(t.left, variable)
+	right, rok := requiredValues(t.right, variable)
+	switch t.stmt.op.tokenId {
+	case OP_AND:
+		// Either side's requirement applies, so both sides' do.
+		if !lok {
+			return right, rok
+		}
+		if !rok {
+			return left, lok
+		}
+		values = make([]string, 0, len(left))
+		for _, l := range left {
+			for _, r := range right {
+				if l == r {
+					values = append(values, l)
+					break
+				}
+			}
+		}
+		return values, true
+	case OP_OR:
+		// Only a requirement if both alternatives have one.
+		if !lok || !rok {
+			return
+		}
+		values = make([]string, len(left), len(left)+len(right))
+		copy(values, left)
+		for _, r := range right {
+			found := false
+			for _, l := range left {
+				if l == r {
+					found = true
+					break
+				}
+			}
+			if !found {
+				values = append(values, r)
+			}
+		}
+		return values, true
+	}
+	return
+}
+
 func evalMatcherSpecification(t *tree, msg *Message,
 	captures map[string]string) (b bool) {
 	if t == nil {
@@ -65,6 +317,9 @@ func evalMatcherSpecification(t *tree, msg *Message,
 	} else {
 		return testExpr(msg, t.stmt, captures)
 	}
+	if t.stmt.op.tokenId == OP_NOT {
+		return !b
+	}
 	if b == true && t.stmt.op.tokenId == OP_OR {
 		return // short circuit
 	}
@@ -154,24 +409,218 @@ func stringTest(s string, stmt *Statement, captures map[string]string) bool {
 		return regexpTest(s, stmt, captures)
 	case OP_NRE:
 		return !stmt.value.regexp.MatchString(s)
+	case OP_IN:
+		return stmt.value.stringSet[s]
+	case OP_CONTAINS:
+		return strings.Contains(s, stmt.value.token)
+	case OP_STARTSWITH:
+		return strings.HasPrefix(s, stmt.value.token)
+	case OP_ENDSWITH:
+		return strings.HasSuffix(s, stmt.value.token)
+	case CIDR:
+		return cidrTest(net.ParseIP(s), stmt)
+	}
+	return false
+}
+
+func cidrTest(ip net.IP, stmt *Statement) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range stmt.value.networks {
+		if network.Contains(ip) {
+			return true
+		}
 	}
 	return false
 }
 
 func numericTest(f float64, stmt *Statement) bool {
+	value := stmt.value.double
+	if stmt.value.tokenId == NOW {
+		value = float64(time.Now().Add(stmt.value.duration).UnixNano())
+	}
+	switch stmt.op.tokenId {
+	case OP_EQ:
+		return (f == value)
+	case OP_NE:
+		return (f != value)
+	case OP_LT:
+		return (f < value)
+	case OP_LTE:
+		return (f <= value)
+	case OP_GT:
+		return (f > value)
+	case OP_GTE:
+		return (f >= value)
+	case OP_IN:
+		return stmt.value.numericSet[f]
+	}
+	return false
+}
+
+// Field or array index value of a Fields variable that matches any index,
+// i.e. Fields[foo][*][*].
+const anyIndex = -1
+
+func integerTest(i int64, stmt *Statement) bool {
+	if !stmt.value.isInteger || stmt.op.tokenId == OP_IN {
+		return numericTest(float64(i), stmt)
+	}
 	switch stmt.op.tokenId {
 	case OP_EQ:
-		return (f == stmt.value.double)
+		return (i == stmt.value.integer)
 	case OP_NE:
-		return (f != stmt.value.double)
+		return (i != stmt.value.integer)
 	case OP_LT:
-		return (f < stmt.value.double)
+		return (i < stmt.value.integer)
 	case OP_LTE:
-		return (f <= stmt.value.double)
+		return (i <= stmt.value.integer)
 	case OP_GT:
-		return (f > stmt.value.double)
+		return (i > stmt.value.integer)
 	case OP_GTE:
-		return (f >= stmt.value.double)
+		return (i >= stmt.value.integer)
+	}
+	return false
+}
+
+func boolTest(b bool, stmt *Statement) bool {
+	switch stmt.op.tokenId {
+	case OP_EQ:
+		return b == (stmt.value.tokenId == TRUE)
+	case OP_NE:
+		return b != (stmt.value.tokenId == TRUE)
+	}
+	return false
+}
+
+// Tests a time field value against a NOW relative time, converting it to
+// nanoseconds based on the field's format. Fields that aren't UTC_SECONDS or
+// UTC_NANOSECONDS times never match.
+func timeTest(field *Field, f float64, stmt *Statement) bool {
+	switch field.GetValueFormat() {
+	case Field_UTC_SECONDS:
+		f *= 1e9
+	case Field_UTC_NANOSECONDS:
+	default:
+		return false
+	}
+	return numericTest(f, stmt)
+}
+
+// Returns the number of values in the field.
+func fieldValueCount(field *Field) int {
+	switch field.GetValueType() {
+	case Field_STRING:
+		return len(field.ValueString)
+	case Field_BYTES:
+		return len(field.ValueBytes)
+	case Field_INTEGER:
+		return len(field.ValueInteger)
+	case Field_DOUBLE:
+		return len(field.ValueDouble)
+	case Field_BOOL:
+		return len(field.ValueBool)
+	}
+	return 0
+}
+
+// Tests the field's value at the array index. Values are only compared to
+// literals of the same type, i.e. a string field never matches a numeric
+// test.
+func fieldValueTest(field *Field, ai int, stmt *Statement,
+	captures map[string]string) bool {
+
+	switch field.GetValueType() {
+	case Field_STRING:
+		if stmt.value.tokenId != STRING_VALUE && stmt.value.tokenId != REGEXP_VALUE {
+			return false
+		}
+		return stringTest(field.ValueString[ai], stmt, captures)
+	case Field_BYTES:
+		if stmt.value.tokenId != STRING_VALUE && stmt.value.tokenId != REGEXP_VALUE {
+			return false
+		}
+		b := field.ValueBytes[ai]
+		if stmt.op.tokenId == CIDR && net.ParseIP(string(b)) == nil &&
+			(len(b) == net.IPv4len || len(b) == net.IPv6len) {
+			return cidrTest(net.IP(b), stmt) // raw address bytes
+		}
+		return stringTest(string(b), stmt, captures)
+	case Field_INTEGER:
+		if stmt.value.tokenId == NOW {
+			return timeTest(field, float64(field.ValueInteger[ai]), stmt)
+		}
+		if stmt.value.tokenId != NUMERIC_VALUE {
+			return false
+		}
+		return integerTest(field.ValueInteger[ai], stmt)
+	case Field_DOUBLE:
+		if stmt.value.tokenId == NOW {
+			return timeTest(field, field.ValueDouble[ai], stmt)
+		}
+		if stmt.value.tokenId != NUMERIC_VALUE {
+			return false
+		}
+		return numericTest(field.ValueDouble[ai], stmt)
+	case Field_BOOL:
+		if stmt.value.tokenId != TRUE && stmt.value.tokenId != FALSE {
+			return false
+		}
+		return boolTest(field.ValueBool[ai], stmt)
+	}
+	return false
+}
+
+// Tests the value(s) selected by a Fields variable. When the field or array
+// index is `*` the test matches if any of the selected values pass. A NIL
+// test checks whether any value was selected at all.
+func fieldTest(msg *Message, stmt *Statement, captures map[string]string) bool {
+	fi := stmt.field.fieldIndex
+	ai := stmt.field.arrayIndex
+	var fields []*Field
+
+	if fi == 0 {
+		if field := msg.FindFirstField(stmt.field.token); field != nil {
+			fields = []*Field{field}
+		}
+	} else {
+		fields = msg.FindAllFields(stmt.field.token)
+		if fi != anyIndex {
+			if fi >= len(fields) {
+				fields = nil
+			} else {
+				fields = fields[fi : fi+1]
+			}
+		}
+	}
+
+	if stmt.value.tokenId == NIL {
+		exists := false
+		for _, field := range fields {
+			count := fieldValueCount(field)
+			if count > 0 && (ai == anyIndex || ai < count) {
+				exists = true
+				break
+			}
+		}
+		if stmt.op.tokenId == OP_EQ {
+			return !exists
+		}
+		return exists
+	}
+
+	for _, field := range fields {
+		count := fieldValueCount(field)
+		first, last := ai, ai+1
+		if ai == anyIndex {
+			first, last = 0, count
+		}
+		for i := first; i < last && i < count; i++ {
+			if fieldValueTest(field, i, stmt, captures) {
+				return true
+			}
+		}
 	}
 	return false
 }
@@ -190,53 +639,7 @@ func testExpr(msg *Message, stmt *Statement, captures map[string]string) bool {
 		case VAR_TIMESTAMP, VAR_SEVERITY, VAR_PID:
 			return numericTest(getNumericValue(msg, stmt), stmt)
 		case VAR_FIELDS:
-			fi := stmt.field.fieldIndex
-			ai := stmt.field.arrayIndex
-			var field *Field
-
-			if fi != 0 {
-				fields := msg.FindAllFields(stmt.field.token)
-				if fi >= len(fields) {
-					return false
-				}
-				field = fields[fi]
-			} else {
-				if field = msg.FindFirstField(stmt.field.token); field == nil {
-					return false
-				}
-			}
-			switch field.GetValueType() {
-			case Field_STRING:
-				if ai >= len(field.ValueString) {
-					return false
-				}
-				return stringTest(field.ValueString[ai], stmt, captures)
-			case Field_BYTES:
-				if ai >= len(field.ValueBytes) {
-					return false
-				}
-				return stringTest(string(field.ValueBytes[ai]), stmt, captures)
-			case Field_INTEGER:
-				if ai >= len(field.ValueInteger) {
-					return false
-				}
-				return numericTest(float64(field.ValueInteger[ai]), stmt)
-			case Field_DOUBLE:
-				if ai >= len(field.ValueDouble) {
-					return false
-				}
-				return numericTest(field.ValueDouble[ai], stmt)
-			case Field_BOOL:
-				if ai >= len(field.ValueBool) {
-					return false
-				}
-				b := field.ValueBool[ai]
-				if stmt.value.tokenId == TRUE {
-					return (b == true)
-				} else {
-					return (b == false)
-				}
-			}
+			return fieldTest(msg, stmt, captures)
 		}
 	}
 	return false
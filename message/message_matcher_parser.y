@@ -3,10 +3,11 @@ package message
 
 import (
 	"fmt"
-	"log"
+	"net"
 	"regexp"
 	"strconv"
-	"sync"
+	"strings"
+	"time"
 	"unicode/utf8"
 )
 
@@ -22,9 +23,15 @@ var variables = map[string]int{
 	"Pid":        VAR_PID,
 	"Fields":     VAR_FIELDS,
 	"TRUE":       TRUE,
-	"FALSE":      FALSE}
-
-var parseLock sync.Mutex
+	"FALSE":      FALSE,
+	"NIL":        NIL,
+	"CIDR":       CIDR,
+	"NOW":        NOW,
+	"NOT":        OP_NOT,
+	"IN":         OP_IN,
+	"CONTAINS":   OP_CONTAINS,
+	"STARTSWITH": OP_STARTSWITH,
+	"ENDSWITH":   OP_ENDSWITH}
 
 type Statement struct {
 	field, op, value yySymType
@@ -60,7 +67,53 @@ func (s *stack) pop() (node *tree) {
 	return nil
 }
 
-var nodes []*tree
+// Appends a node to the parser's list of nodes in postfix order.
+func addNode(yylex yyLexer, node *tree) {
+	m := yylex.(*MatcherSpecificationParser)
+	m.nodes = append(m.nodes, node)
+}
+
+// Matches %TEMPLATE% regular expression helper references.
+var reToken = regexp.MustCompile("%[A-Z]+%")
+
+// Human readable versions of the token names in syntax error messages.
+var tokenNames = map[string]string{
+	"$end":           "end of spec",
+	"$unk":           "invalid character",
+	"OP_EQ":          "==",
+	"OP_NE":          "!=",
+	"OP_GT":          ">",
+	"OP_GTE":         ">=",
+	"OP_LT":          "<",
+	"OP_LTE":         "<=",
+	"OP_RE":          "=~",
+	"OP_NRE":         "!~",
+	"OP_IN":          "IN",
+	"OP_CONTAINS":    "CONTAINS",
+	"OP_STARTSWITH":  "STARTSWITH",
+	"OP_ENDSWITH":    "ENDSWITH",
+	"OP_OR":          "||",
+	"OP_AND":         "&&",
+	"OP_NOT":         "!",
+	"VAR_UUID":       "Uuid",
+	"VAR_TYPE":       "Type",
+	"VAR_LOGGER":     "Logger",
+	"VAR_PAYLOAD":    "Payload",
+	"VAR_ENVVERSION": "EnvVersion",
+	"VAR_HOSTNAME":   "Hostname",
+	"VAR_TIMESTAMP":  "Timestamp",
+	"VAR_SEVERITY":   "Severity",
+	"VAR_PID":        "Pid",
+	"VAR_FIELDS":     "Fields[...]",
+	"STRING_VALUE":   "quoted string",
+	"NUMERIC_VALUE":  "number",
+	"REGEXP_VALUE":   "regular expression",
+	"DURATION_VALUE": "duration",
+}
+
+func init() {
+	yyErrorVerbose = true // include the expected tokens in syntax errors
+}
 
 %}
 
@@ -70,20 +123,30 @@ var nodes []*tree
    double      float64
    fieldIndex  int
    arrayIndex  int
+   integer     int64
+   isInteger   bool
    regexp      *regexp.Regexp
+   stringSet   map[string]bool
+   numericSet  map[float64]bool
+   networks    []*net.IPNet
+   duration    time.Duration
+   pos         int
 }
 
 %token OP_EQ OP_NE OP_GT OP_GTE OP_LT OP_LTE OP_RE OP_NRE
-%token OP_OR OP_AND
+%token OP_IN OP_CONTAINS OP_STARTSWITH OP_ENDSWITH
+%token OP_OR OP_AND OP_NOT
 %token VAR_UUID VAR_TYPE VAR_LOGGER VAR_PAYLOAD VAR_ENVVERSION VAR_HOSTNAME
 %token VAR_TIMESTAMP VAR_SEVERITY VAR_PID
 %token VAR_FIELDS
-%token STRING_VALUE NUMERIC_VALUE REGEXP_VALUE
-%token TRUE FALSE
+%token STRING_VALUE NUMERIC_VALUE REGEXP_VALUE DURATION_VALUE
+%token TRUE FALSE NIL
+%token CIDR NOW
 
 %start spec
 %left OP_OR
 %left OP_AND
+%right OP_NOT
 
 %%
 
@@ -97,9 +160,36 @@ relational : OP_EQ
    | OP_LT
    | OP_LTE
 ;
+equality : OP_EQ
+   | OP_NE
+;
 regexp : OP_RE
    | OP_NRE
 ;
+substring : OP_CONTAINS
+   | OP_STARTSWITH
+   | OP_ENDSWITH
+;
+string_set : STRING_VALUE
+       {
+       $$.stringSet = map[string]bool{$1.token: true}
+       }
+   |   string_set ',' STRING_VALUE
+       {
+       $1.stringSet[$3.token] = true
+       $$ = $1
+       }
+;
+numeric_set : NUMERIC_VALUE
+       {
+       $$.numericSet = map[float64]bool{$1.double: true}
+       }
+   |   numeric_set ',' NUMERIC_VALUE
+       {
+       $1.numericSet[$3.double] = true
+       $$ = $1
+       }
+;
 string_vars : VAR_UUID
    | VAR_TYPE
    | VAR_LOGGER
@@ -114,39 +204,107 @@ numeric_vars : VAR_TIMESTAMP
 string_test : string_vars relational STRING_VALUE
        {
        //fmt.Println("string_test", $1, $2, $3)
-       nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+       addNode(yylex, &tree{stmt:&Statement{$1, $2, $3}})
        }
    |   string_vars regexp REGEXP_VALUE
        {
        //fmt.Println("string_test regexp", $1, $2, $3)
-       nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+       addNode(yylex, &tree{stmt:&Statement{$1, $2, $3}})
+       }
+   |   string_vars substring STRING_VALUE
+       {
+       //fmt.Println("string_test substring", $1, $2, $3)
+       addNode(yylex, &tree{stmt:&Statement{$1, $2, $3}})
+       }
+   |   string_vars OP_IN '(' string_set ')'
+       {
+       //fmt.Println("string_test in", $1, $2, $4)
+       addNode(yylex, &tree{stmt:&Statement{$1, $2, $4}})
+       }
+   |   string_vars OP_IN CIDR '(' string_set ')'
+       {
+       //fmt.Println("string_test cidr", $1, $3, $5)
+       addNode(yylex, &tree{stmt:&Statement{$1, $3, $5}})
+       }
+;
+time_value : NOW
+       {
+       $$.duration = 0
+       }
+   |   NOW '+' DURATION_VALUE
+       {
+       $$.duration = $3.duration
+       }
+   |   NOW '-' DURATION_VALUE
+       {
+       $$.duration = -$3.duration
        }
 ;
 numeric_test : numeric_vars relational NUMERIC_VALUE
    {
    //fmt.Println("numeric_test", $1, $2, $3)
-   nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+   addNode(yylex, &tree{stmt:&Statement{$1, $2, $3}})
+   }
+   | numeric_vars OP_IN '(' numeric_set ')'
+   {
+   //fmt.Println("numeric_test in", $1, $2, $4)
+   addNode(yylex, &tree{stmt:&Statement{$1, $2, $4}})
+   }
+   | numeric_vars relational time_value
+   {
+   //fmt.Println("numeric_test time", $1, $2, $3)
+   addNode(yylex, &tree{stmt:&Statement{$1, $2, $3}})
    }
 ;
 field_test : VAR_FIELDS relational NUMERIC_VALUE
       {
       //fmt.Println("field_test numeric", $1, $2, $3)
-      nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+      addNode(yylex, &tree{stmt:&Statement{$1, $2, $3}})
       }
    | VAR_FIELDS relational STRING_VALUE
       {
       //fmt.Println("field_test string", $1, $2, $3)
-      nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+      addNode(yylex, &tree{stmt:&Statement{$1, $2, $3}})
       }
-   | VAR_FIELDS OP_EQ boolean
+   | VAR_FIELDS equality boolean
       {
       //fmt.Println("field_test boolean", $1, $2, $3)
-      nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+      addNode(yylex, &tree{stmt:&Statement{$1, $2, $3}})
+      }
+   | VAR_FIELDS equality NIL
+      {
+      //fmt.Println("field_test nil", $1, $2, $3)
+      addNode(yylex, &tree{stmt:&Statement{$1, $2, $3}})
       }
    | VAR_FIELDS regexp REGEXP_VALUE
       {
       //fmt.Println("field_test regexp", $1, $2, $3)
-      nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+      addNode(yylex, &tree{stmt:&Statement{$1, $2, $3}})
+      }
+   | VAR_FIELDS substring STRING_VALUE
+      {
+      //fmt.Println("field_test substring", $1, $2, $3)
+      addNode(yylex, &tree{stmt:&Statement{$1, $2, $3}})
+      }
+   | VAR_FIELDS OP_IN '(' string_set ')'
+      {
+      //fmt.Println("field_test string in", $1, $2, $4)
+      addNode(yylex, &tree{stmt:&Statement{$1, $2, $4}})
+      }
+   | VAR_FIELDS OP_IN '(' numeric_set ')'
+      {
+      //fmt.Println("field_test numeric in", $1, $2, $4)
+      addNode(yylex, &tree{stmt:&Statement{$1, $2, $4}})
+      }
+   | VAR_FIELDS OP_IN CIDR '(' string_set ')'
+      {
+      //fmt.Println("field_test cidr", $1, $3, $5)
+      addNode(yylex, &tree{stmt:&Statement{$1, $3, $5}})
+      }
+   | VAR_FIELDS relational time_value
+      {
+      //fmt.Println("field_test time", $1, $2, $3)
+      addNode(yylex, &tree{stmt:&Statement{$1, $2, $3}})
       }
 ;
 boolean : TRUE | FALSE
@@ -157,12 +315,17 @@ expr : '(' expr ')'
    | expr OP_AND expr
       {
       //fmt.Println("and", $1, $2, $3)
-      nodes = append(nodes, &tree{stmt:&Statement{op:$2}})
+      addNode(yylex, &tree{stmt:&Statement{op:$2}})
       }
    | expr OP_OR expr
       {
       //fmt.Println("or", $1, $2, $3)
-      nodes = append(nodes, &tree{stmt:&Statement{op:$2}})
+      addNode(yylex, &tree{stmt:&Statement{op:$2}})
+      }
+   | OP_NOT expr
+      {
+      //fmt.Println("not", $1, $2)
+      addNode(yylex, &tree{stmt:&Statement{op:$1}})
       }
    | string_test
    | numeric_test
@@ -170,7 +333,7 @@ expr : '(' expr ')'
    | boolean
       {
          //fmt.Println("boolean", $1)
-         nodes = append(nodes, &tree{stmt:&Statement{op:$1}})
+         addNode(yylex, &tree{stmt:&Statement{op:$1}})
       }
 ;
 
@@ -181,25 +344,40 @@ type MatcherSpecificationParser struct {
 	sym      string
 	peekrune rune
 	lexPos   int
-    reToken *regexp.Regexp
+	tokPos   int          // start of the most recently lexed token
+	nodes    []*tree      // parsed nodes in postfix order
+	diag     *Diagnostic // first problem found, if any
 }
 
-func parseMatcherSpecification(ms *MatcherSpecification) error {
-	parseLock.Lock()
-	defer parseLock.Unlock()
-	nodes = nodes[:0] // reset the global
-	var msp MatcherSpecificationParser
-	msp.spec = ms.spec
-	msp.peekrune = ' '
-	msp.reToken, _ = regexp.Compile("%[A-Z]+%")
-	if yyParse(&msp) == 0 {
+// Parses the spec into the matcher's expression tree, returning a Diagnostic
+// describing the first problem found if it isn't valid. Each call uses its
+// own parser state so specs can be parsed concurrently.
+func parseMatcherSpecification(ms *MatcherSpecification) *Diagnostic {
+	msp := &MatcherSpecificationParser{spec: ms.spec, peekrune: ' '}
+	if yyParse(msp) == 0 && msp.diag == nil {
 		s := new(stack)
-		for _, node := range nodes {
-			if node.stmt.op.tokenId != OP_OR &&
+		for _, node := range msp.nodes {
+			if node.stmt.op.tokenId == OP_NOT {
+				node.left = s.pop()
+				s.push(node)
+			} else if node.stmt.op.tokenId != OP_OR &&
 				node.stmt.op.tokenId != OP_AND {
     			if node.stmt.op.tokenId == OP_RE { // no capture for negated regex
                     ms.numCapture += node.stmt.value.regexp.NumSubexp()
                 }
+				if node.stmt.op.tokenId == CIDR {
+					if err := parseNetworks(node.stmt); err != nil {
+						return newDiagnostic(ms.spec, node.stmt.value.pos,
+							err.Error(), nil)
+					}
+				}
+				if node.stmt.value.tokenId == NOW &&
+					node.stmt.field.tokenId != VAR_TIMESTAMP &&
+					node.stmt.field.tokenId != VAR_FIELDS {
+					return newDiagnostic(ms.spec, node.stmt.value.pos,
+						fmt.Sprintf("NOW not allowed in %s test",
+							node.stmt.field.token), nil)
+				}
 				s.push(node)
 			} else {
 				node.right = s.pop()
@@ -210,11 +388,71 @@ func parseMatcherSpecification(ms *MatcherSpecification) error {
 		ms.vm = s.pop()
 		return nil
 	}
-	return fmt.Errorf("syntax error: last token: %s pos: %d", msp.sym, msp.lexPos)
+	if msp.diag == nil {
+		msp.diag = newDiagnostic(ms.spec, msp.tokPos, "syntax error", nil)
+	}
+	return msp.diag
 }
 
+// Converts the set of CIDR strings in a CIDR test into the network prefixes
+// that are checked at match time. A bare address is treated as a single host
+// network.
+func parseNetworks(stmt *Statement) error {
+	if stmt.field.tokenId != VAR_HOSTNAME && stmt.field.tokenId != VAR_FIELDS {
+		return fmt.Errorf("CIDR test not allowed on %s", stmt.field.token)
+	}
+	stmt.value.networks = make([]*net.IPNet, 0, len(stmt.value.stringSet))
+	for cidr := range stmt.value.stringSet {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return fmt.Errorf("invalid CIDR: %s", cidr)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			network = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+		}
+		stmt.value.networks = append(stmt.value.networks, network)
+	}
+	return nil
+}
+
+// Records a syntax error reported by the parser, unless the lexer already
+// found a problem. Messages are in the form "syntax error: unexpected X,
+// expecting Y or Z".
 func (m *MatcherSpecificationParser) Error(s string) {
-	fmt.Errorf("syntax error: %s last token: %s pos: %d", m.sym, m.lexPos)
+	if m.diag != nil {
+		return
+	}
+	var expected []string
+	if i := strings.Index(s, ", expecting "); i != -1 {
+		for _, name := range strings.Split(s[i+len(", expecting "):], " or ") {
+			expected = append(expected, tokenName(name))
+		}
+		s = s[:i]
+	}
+	if i := strings.Index(s, "unexpected "); i != -1 {
+		s = s[:i] + "unexpected " + tokenName(s[i+len("unexpected "):])
+	}
+	m.diag = newDiagnostic(m.spec, m.tokPos, s, expected)
+}
+
+// Records a problem found by the lexer at the start of the current token,
+// returning the end of input token so the parse stops.
+func (m *MatcherSpecificationParser) lexError(msg string) int {
+	if m.diag == nil {
+		m.diag = newDiagnostic(m.spec, m.tokPos, msg, nil)
+	}
+	return 0
+}
+
+func tokenName(name string) string {
+	if display, ok := tokenNames[name]; ok {
+		return display
+	}
+	return name
 }
 
 func (m *MatcherSpecificationParser) Lex(yylval *yySymType) int {
@@ -226,6 +464,12 @@ func (m *MatcherSpecificationParser) Lex(yylval *yySymType) int {
 	m.peekrune = ' '
 
 loop:
+	if c == 0 {
+		m.tokPos = m.lexPos
+	} else {
+		m.tokPos = m.lexPos - utf8.RuneLen(c)
+	}
+	yylval.pos = m.tokPos
 	if c >= 'A' && c <= 'Z' {
 		goto variable
 	}
@@ -233,7 +477,7 @@ loop:
 		goto number
 	}
 	switch c {
-	case ' ', '\t':
+	case ' ', '\t', '\n', '\r':
 		c = m.getrune()
 		goto loop
 	case '=':
@@ -257,7 +501,9 @@ loop:
 			yylval.token = "!~"
 			yylval.tokenId = OP_NRE
 		} else {
-			break
+			m.peekrune = c
+			yylval.token = "!"
+			yylval.tokenId = OP_NOT
 		}
 		return yylval.tokenId
 	case '>':
@@ -316,20 +562,23 @@ variable:
 		}
 	}
 	yylval.tokenId = variables[m.sym]
+	if yylval.tokenId == 0 {
+		return m.lexError(fmt.Sprintf("unknown variable %s", m.sym))
+	}
 	if yylval.tokenId == VAR_FIELDS {
 		if c != '[' {
-			return 0
+			return m.lexError("expected [ after Fields")
 		}
 		var bracketCount int
 		var idx [3]string
 		for {
 			c = m.getrune()
 			if c == 0 {
-				return 0
+				return m.lexError("unmatched [ in Fields variable")
 			}
 			if c == ']' { // a closing bracket in the variable name will fail validation
 				if len(idx[bracketCount]) == 0 {
-					return 0
+					return m.lexError("empty Fields index")
 				}
 				bracketCount++
 				m.peekrune = m.getrune()
@@ -343,10 +592,12 @@ variable:
 				case 0:
 					idx[bracketCount] += string(c)
 				case 1, 2:
-					if ddigit(c) {
+					if ddigit(c) && idx[bracketCount] != "*" {
 						idx[bracketCount] += string(c)
+					} else if c == '*' && len(idx[bracketCount]) == 0 {
+						idx[bracketCount] = "*"
 					} else {
-						return 0
+						return m.lexError("Fields index must be a number or *")
 					}
 				}
 			}
@@ -359,13 +610,11 @@ variable:
 		}
 		var err error
 		yylval.token = idx[0]
-		yylval.fieldIndex, err = strconv.Atoi(idx[1])
-		if err != nil {
-			return 0
+		if yylval.fieldIndex, err = parseIndex(idx[1]); err != nil {
+			return m.lexError(fmt.Sprintf("invalid field index: %s", err))
 		}
-		yylval.arrayIndex, err = strconv.Atoi(idx[2])
-		if err != nil {
-			return 0
+		if yylval.arrayIndex, err = parseIndex(idx[2]); err != nil {
+			return m.lexError(fmt.Sprintf("invalid array index: %s", err))
 		}
 	} else {
 		yylval.token = m.sym
@@ -382,23 +631,41 @@ number:
 			break
 		}
 	}
+	if rvariable(c) || c == 'µ' {
+		goto duration
+	}
 	m.peekrune = c
 	yylval.double, err = strconv.ParseFloat(m.sym, 64)
 	if err != nil {
-		log.Printf("error converting %v\n", m.sym)
-		yylval.double = 0
+		return m.lexError(fmt.Sprintf("invalid number %s", m.sym))
 	}
+	yylval.integer, err = strconv.ParseInt(m.sym, 10, 64)
+	yylval.isInteger = err == nil
 	yylval.token = m.sym
 	yylval.tokenId = NUMERIC_VALUE
 	return yylval.tokenId
 
+duration: // a number followed by a unit, i.e. 5m or 1h30m
+	for rvariable(c) || ddigit(c) || c == '.' || c == 'µ' {
+		m.sym += string(c)
+		c = m.getrune()
+	}
+	m.peekrune = c
+	yylval.duration, err = time.ParseDuration(m.sym)
+	if err != nil {
+		return m.lexError(fmt.Sprintf("invalid duration %s", m.sym))
+	}
+	yylval.token = m.sym
+	yylval.tokenId = DURATION_VALUE
+	return yylval.tokenId
+
 quotestring:
 	tmp = c
 	m.sym = ""
 	for {
 		c = m.getrune()
 		if c == 0 {
-			return 0
+			return m.lexError("unterminated string")
 		}
 		if c == '\\' {
 			m.peekrune = m.getrune()
@@ -425,7 +692,7 @@ regexpstring:
 	for {
 		c = m.getrune()
 		if c == 0 {
-			return 0
+			return m.lexError("unterminated regular expression")
 		}
 		if c == '\\' {
 			m.peekrune = m.getrune()
@@ -443,7 +710,7 @@ regexpstring:
 		}
 		m.sym += string(c)
 	}
-	m.sym = m.reToken.ReplaceAllStringFunc(m.sym,
+	m.sym = reToken.ReplaceAllStringFunc(m.sym,
 		func(match string) string {            
             replace, ok := HelperRegexSubs[match[1:len(match)-1]]
             if !ok {
@@ -453,14 +720,22 @@ regexpstring:
 		})
 	yylval.regexp, err = regexp.Compile(m.sym)
 	if err != nil {
-		log.Printf("invalid regexp %v\n", m.sym)
-		return 0
+		return m.lexError(fmt.Sprintf("invalid regular expression: %s", err))
 	}
 	yylval.token = m.sym
 	yylval.tokenId = REGEXP_VALUE
 	return yylval.tokenId
 }
 
+// Converts a field or array index to an int, "*" (any index) becoming
+// anyIndex.
+func parseIndex(idx string) (int, error) {
+	if idx == "*" {
+		return anyIndex, nil
+	}
+	return strconv.Atoi(idx)
+}
+
 func rvariable(c rune) bool {
 	if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') {
 		return true
@@ -494,8 +769,5 @@ func (m *MatcherSpecificationParser) getrune() rune {
 	}
 	c, n = utf8.DecodeRuneInString(m.spec[m.lexPos:len(m.spec)])
 	m.lexPos += n
-	if c == '\n' {
-		c = 0
-	}
 	return c
 }
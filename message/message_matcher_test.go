@@ -18,7 +18,9 @@ import (
 	"fmt"
 	"github.com/rafrombrc/gospec/src/gospec"
 	gs "github.com/rafrombrc/gospec/src/gospec"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func compareCaptures(c gospec.Context, m1, m2 map[string]string) {
@@ -41,6 +43,12 @@ func MatcherSpecificationSpec(c gospec.Context) {
 	field5, _ := NewField("foo", "alternate", Field_RAW)
 	field6, _ := NewField("Payload", "name=test;type=web;", Field_RAW)
 	field7, _ := NewField("Timestamp", date, Field_RAW)
+	field8, _ := NewField("big", int64(1<<53), Field_RAW)
+	field9, _ := NewField("ip", "10.1.2.3", Field_IPV4)
+	field9.AddValue("2001:db8::1")
+	field10, _ := NewField("rawip", []byte{192, 168, 0, 1}, Field_IPV4)
+	field11, _ := NewField("sent", time.Now().Unix()-60, Field_UTC_SECONDS)
+	field12, _ := NewField("sentns", float64(time.Now().UnixNano()), Field_UTC_NANOSECONDS)
 	msg.AddField(field1)
 	msg.AddField(field2)
 	msg.AddField(field3)
@@ -48,6 +56,11 @@ func MatcherSpecificationSpec(c gospec.Context) {
 	msg.AddField(field5)
 	msg.AddField(field6)
 	msg.AddField(field7)
+	msg.AddField(field8)
+	msg.AddField(field9)
+	msg.AddField(field10)
+	msg.AddField(field11)
+	msg.AddField(field12)
 
 	c.Specify("A MatcherSpecification", func() {
 		malformed := []string{
@@ -72,6 +85,27 @@ func MatcherSpecificationSpec(c gospec.Context) {
 			"Type =~ /\\ytest/",                                           // invalid escape character
 			"Type != 'test\"",                                             // mis matched quote types
 			"Pid =~ 6",                                                    // number instead of regexp
+			"Type IN ()",                                                  // empty set
+			"Type IN ('a', 1)",                                            // mixed set types
+			"Type IN 'a'",                                                 // missing parens
+			"Pid CONTAINS '6'",                                            // substring test on numeric
+			"Type CONTAINS /test/",                                        // regexp instead of string
+			"!",                                                           // nothing to negate
+			"Type ! 'test'",                                               // incorrect operator
+			"Fields[foo] > NIL",                                           // invalid NIL operator
+			"Type == NIL",                                                 // NIL test on a header
+			"Fields[foo][**]",                                             // repeated wildcard
+			"Fields[foo][*1]",                                             // wildcard mixed w/ digits
+			"Hostname IN CIDR ('10.0.0.0/33')",                            // invalid prefix length
+			"Hostname IN CIDR ('bogus')",                                  // invalid network
+			"Type IN CIDR ('10.0.0.0/8')",                                 // CIDR test on a non address
+			"Hostname IN CIDR (10)",                                       // numeric network
+			"Severity > NOW",                                              // NOW only valid for times
+			"Type == NOW",                                                 // NOW on a string
+			"Timestamp > NOW - 5",                                         // missing duration unit
+			"Timestamp > NOW - 5x",                                        // invalid duration unit
+			"Timestamp > NOW * 5m",                                        // invalid time operator
+			"Timestamp > 5m",                                              // duration w/o NOW
 		}
 
 		negative := []string{
@@ -99,6 +133,47 @@ func MatcherSpecificationSpec(c gospec.Context) {
 			"Type == \"te'st\"",
 			"Type == 'te\"st'",
 			"Fields[int] =~ /999/",
+			"!TRUE",
+			"NOT (Type == 'TEST' && Severity == 6)",
+			"!(Type == 'TEST') || Severity != 6",
+			"Type IN ('test', 'foo')",
+			"Severity IN (1, 2, 3)",
+			"Fields[foo] IN ('baz', 'qux')",
+			"Fields[int] IN (998, 1000)",
+			"Payload CONTAINS 'payload'",
+			"Logger STARTSWITH 'Spec'",
+			"Logger ENDSWITH 'Go'",
+			"Fields[foo] CONTAINS 'z'",
+			"Fields[int] CONTAINS '999'",
+			"Fields[bool] IN ('foo')",
+			"Fields[foo] == NIL",
+			"Fields[missing] != NIL",
+			"Fields[foo][2] != NIL",
+			"Fields[int][0][2] != NIL",
+			"Fields[foo] == 5",
+			"Fields[int] == '999'",
+			"Fields[int] == 1000",
+			"Fields[bool] == 'foo'",
+			"Fields[bool] != TRUE",
+			"Fields[double] == TRUE",
+			"Fields[big] == 9007199254740993",
+			"Fields[foo][*] == 'baz'",
+			"Fields[int][0][*] == 1000",
+			"Fields[foo][*][*] IN ('baz', 'qux')",
+			"Fields[ip] IN CIDR ('10.2.0.0/16', '2001:db8::/32')",
+			"Fields[ip][0][*] IN CIDR ('192.168.0.0/16', '2001:db9::/32')",
+			"Fields[ip] IN CIDR ('10.1.2.4')",
+			"Fields[foo] IN CIDR ('0.0.0.0/0')",
+			"Fields[int] IN CIDR ('0.0.0.0/0')",
+			"Fields[rawip] IN CIDR ('10.0.0.0/8')",
+			"Hostname IN CIDR ('0.0.0.0/0', '::/0')",
+			"Timestamp < NOW - 1m",
+			"Timestamp > NOW + 1m",
+			"Timestamp > NOW",
+			"Fields[sent] > NOW - 30s",
+			"Fields[sentns] < NOW - 1h",
+			"Fields[int] < NOW",
+			"Fields[foo] < NOW",
 		}
 
 		positive := []string{
@@ -143,6 +218,52 @@ func MatcherSpecificationSpec(c gospec.Context) {
 			"Type =~ /TEST/ && Payload =~ /Payload/",
 			"Fields[foo][1] =~ /alt/",
 			"Fields[Payload] =~ /name=\\w+/",
+			"!FALSE",
+			"NOT Type == 'test'",
+			"!(Type == 'test' || Severity == 7) && Logger == 'GoSpec'",
+			"!!(Type == 'TEST')",
+			"Type IN ('foo', 'TEST', 'bar')",
+			"Type IN (\"TEST\")",
+			"Severity IN (5, 6, 7)",
+			"Fields[foo] IN ('bar', 'baz')",
+			"Fields[foo][1] IN ('alternate')",
+			"Fields[int] IN (999, 1000)",
+			"Fields[double] IN (99.9)",
+			"Payload CONTAINS 'Pay'",
+			"Logger STARTSWITH 'Go'",
+			"Logger ENDSWITH 'Spec'",
+			"Fields[foo] STARTSWITH 'b'",
+			"Fields[bytes] ENDSWITH 'ta'",
+			"Fields[missing] == NIL",
+			"Fields[foo] != NIL",
+			"Fields[foo][1] != NIL",
+			"Fields[foo][2] == NIL",
+			"Fields[int][0][1] != NIL",
+			"Fields[int][0][2] == NIL",
+			"Fields[foo][*] != NIL",
+			"Fields[missing][*][*] == NIL",
+			"Fields[int] == 999.0",
+			"Fields[int] < 1000",
+			"Fields[bool] != FALSE",
+			"Fields[big] == 9007199254740992",
+			"Fields[big] != 9007199254740993",
+			"Fields[foo][*] == 'alternate'",
+			"Fields[foo][*][0] == 'bar'",
+			"Fields[int][0][*] == 1024",
+			"Fields[int][*][*] > 1000",
+			"Fields[foo][*][*] STARTSWITH 'alt'",
+			"Fields[ip] IN CIDR ('10.0.0.0/8')",
+			"Fields[ip] IN CIDR ('10.1.2.3')",
+			"Fields[ip][0][1] IN CIDR ('192.168.0.0/16', '2001:db8::/32')",
+			"Fields[ip][0][*] IN CIDR ('2001:db8::/32')",
+			"Fields[rawip] IN CIDR ('192.168.0.0/24')",
+			"!(Fields[ip] IN CIDR ('172.16.0.0/12'))",
+			"Timestamp > NOW - 5m",
+			"Timestamp < NOW + 30s",
+			"Timestamp <= NOW",
+			"Timestamp >= NOW-1h30m && Timestamp < NOW+500ms",
+			"Fields[sent] < NOW - 30s && Fields[sent] > NOW - 2m",
+			"Fields[sentns] > NOW - 1m",
 		}
 
 		type captureTest struct {
@@ -154,6 +275,7 @@ func MatcherSpecificationSpec(c gospec.Context) {
 			{"Type =~ /(ST)/", map[string]string{"Type(1)": "ST"}},
 			{"Payload =~ /(?P<pl>Payload)/ && Fields[Payload] =~ /name=(?P<name>\\w+)/", map[string]string{"pl": "Payload", "name": "test"}},
 			{"Fields[Timestamp] =~ /%TIMESTAMP%/", map[string]string{"Timestamp": date}},
+			{"Fields[foo][*] =~ /^(alt)/", map[string]string{"foo(1)": "alt"}},
 		}
 
 		captureNegative := []captureTest{
@@ -218,6 +340,117 @@ func MatcherSpecificationSpec(c gospec.Context) {
 			}
 		})
 
+		c.Specify("index keys", func() {
+			keys := []struct {
+				spec    string
+				types   []string
+				loggers []string
+			}{
+				{"TRUE", nil, nil},
+				{"Type == 'a'", []string{"a"}, nil},
+				{"Type != 'a'", nil, nil},
+				{"Type == 'a' && Logger == 'l'", []string{"a"}, []string{"l"}},
+				{"Type == 'a' || Type == 'b'", []string{"a", "b"}, nil},
+				{"Type == 'a' || Logger == 'l'", nil, nil},
+				{"(Type == 'a' || Type == 'b') && Type == 'b'", []string{"b"}, nil},
+				{"Type == 'a' && Type == 'b'", []string{}, nil},
+				{"Severity == 6 && (Logger == 'l' || Logger == 'm')", nil, []string{"l", "m"}},
+				{"Type IN ('b', 'a') && Type != 'c'", []string{"a", "b"}, nil},
+				{"Type IN ('a', 'b') && Type == 'b'", []string{"b"}, nil},
+				{"!(Type == 'a') && Logger IN ('l')", nil, []string{"l"}},
+				{"NOT Type IN ('a')", nil, nil},
+			}
+			for _, v := range keys {
+				ms, err := CreateMatcherSpecification(v.spec)
+				c.Expect(err, gs.IsNil)
+				types, loggers := ms.IndexKeys()
+				c.Expect(reflect.DeepEqual(types, v.types), gs.IsTrue)
+				c.Expect(reflect.DeepEqual(loggers, v.loggers), gs.IsTrue)
+			}
+		})
+
+		c.Specify("diagnostics", func() {
+			c.Expect(ValidateMatcher("Type == 'TEST' && Severity IN (6, 7)"), gs.IsNil)
+
+			diags := ValidateMatcher("Type == 'a' && (Severity == 7")
+			c.Assume(len(diags), gs.Equals, 1)
+			c.Expect(diags[0].Pos, gs.Equals, 29)
+			c.Expect(reflect.DeepEqual(diags[0].Expected,
+				[]string{"||", "&&", "')'"}), gs.IsTrue)
+			c.Expect(diags[0].Snippet, gs.Equals,
+				"Type == 'a' && (Severity == 7\n                             ^")
+
+			diags = ValidateMatcher("Type == 'a'\n\t&& (Severity == 7\n\t|| Bogus == 'b')")
+			c.Assume(len(diags), gs.Equals, 1)
+			c.Expect(diags[0].Pos, gs.Equals, 35)
+			c.Expect(diags[0].Snippet, gs.Equals,
+				"\t|| Bogus == 'b')\n    ^")
+
+			diags = ValidateMatcher("Type == 'a' || Bogus == 'b'")
+			c.Assume(len(diags), gs.Equals, 1)
+			c.Expect(diags[0].Pos, gs.Equals, 15)
+			c.Expect(diags[0].Message, gs.Equals, "unknown variable Bogus")
+
+			diags = ValidateMatcher("Hostname IN CIDR ('10.0.0.0/8', 'bogus')")
+			c.Assume(len(diags), gs.Equals, 1)
+			c.Expect(diags[0].Pos, gs.Equals, 18)
+
+			_, err := CreateMatcherSpecification("Type = 'a'")
+			c.Assume(err, gs.Not(gs.IsNil))
+			c.Expect(err.Error(), gs.Equals,
+				"syntax error: unexpected invalid character at position 5\n"+
+					"Type = 'a'\n     ^")
+		})
+
+		c.Specify("explains matches", func() {
+			ms, err := CreateMatcherSpecification(
+				"Type == 'TEST' && !(Severity IN (6, 7) || Fields[foo][*] =~ /^alt/)")
+			c.Assume(err, gs.IsNil)
+			c.Expect(ms.Explain(msg).String(), gs.Equals, `false &&
+  true  Type == "TEST"
+  false !
+    true  ||
+      true  Severity IN (6, 7)
+      true  Fields[foo][*][0] =~ /^alt/
+`)
+
+			ms, err = CreateMatcherSpecification(
+				"Fields[ip] IN CIDR ('10.0.0.0/8') || Timestamp < NOW - 1h")
+			c.Assume(err, gs.IsNil)
+			explanation := ms.Explain(msg)
+			c.Expect(explanation.Match, gs.IsTrue)
+			c.Assume(len(explanation.Children), gs.Equals, 2)
+			c.Expect(explanation.Children[0].Clause, gs.Equals,
+				`Fields[ip][0][0] IN CIDR ("10.0.0.0/8")`)
+			c.Expect(explanation.Children[1].Clause, gs.Equals,
+				"Timestamp < NOW - 1h0m0s")
+			c.Expect(explanation.Children[1].Match, gs.IsFalse)
+		})
+
+		c.Specify("can be created concurrently", func() {
+			// Each goroutine reports whether all of its matchers behaved.
+			done := make(chan bool)
+			for i := 0; i < 10; i++ {
+				go func(i int) {
+					for j := 0; j < 100; j++ {
+						spec := fmt.Sprintf("Severity == %d || Type == 'x%d'", i, j)
+						ms, err := CreateMatcherSpecification(spec)
+						if err != nil {
+							done <- false
+							return
+						}
+						if match, _ := ms.Match(msg); match != (i == 6) {
+							done <- false
+							return
+						}
+					}
+					done <- true
+				}(i)
+			}
+			for i := 0; i < 10; i++ {
+				c.Expect(<-done, gs.IsTrue)
+			}
+		})
 	})
 }
 
@@ -0,0 +1,510 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/mozilla-services/heka/client"
+	"github.com/mozilla-services/heka/message"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Maximum accepted size of an admin request body.
+const adminMaxBodySize = 64 * 1024
+
+// How far the X-Heka-Timestamp of an HMAC signed admin request may be from the
+// current time before the request is rejected as a possible replay. Signatures
+// seen within this window are remembered so they can't be replayed either.
+const adminMaxClockSkew = 5 * time.Minute
+
+// Input plugin implementation that runs an HTTP server exposing a JSON API
+// for inspecting and controlling the running hekad. Every request must be
+// authorized, either w/ the shared secret as a bearer token in the
+// Authorization header or by an HMAC signature made w/ one of the configured
+// signer keys.
+type AdminInput struct {
+	listener net.Listener
+	server   *http.Server
+	wg       sync.WaitGroup
+	ir       InputRunner
+	h        PluginHelper
+	config   *AdminInputConfig
+	// Closed by Stop to end any running taps.
+	stopChan chan bool
+	// Number of running taps, accessed atomically.
+	taps int32
+	// HMAC digests of accepted signed requests, w/ the time after which
+	// their timestamps are too old to be accepted again.
+	seenLock sync.Mutex
+	seen     map[string]time.Time
+}
+
+// ConfigStruct for AdminInput plugin.
+type AdminInputConfig struct {
+	// String representation of the address of the TCP connection on which
+	// the HTTP server should be listening (e.g. "127.0.0.1:4352").
+	Address string `toml:"address"`
+	// Secret that authorizes requests w/ an "Authorization: Bearer <secret>"
+	// header.
+	SharedSecret string `toml:"shared_secret"`
+	// Set of message signer objects, keyed by signer id string, whose keys
+	// can be used to sign requests.
+	Signers map[string]Signer `toml:"signer"`
+	// Maximum number of taps that can be running at once.
+	MaxTaps int `toml:"max_taps"`
+	// Maximum number of messages per second sent to each tap, 0 for no
+	// limit. Tap clients can request a lower rate.
+	TapRate uint `toml:"tap_rate"`
+}
+
+func (self *AdminInput) ConfigStruct() interface{} {
+	return &AdminInputConfig{
+		Address: "127.0.0.1:4352",
+		MaxTaps: 5,
+		TapRate: 100,
+	}
+}
+
+func (self *AdminInput) Init(config interface{}) error {
+	var err error
+	self.config = config.(*AdminInputConfig)
+	if self.config.SharedSecret == "" && len(self.config.Signers) == 0 {
+		return fmt.Errorf("AdminInput requires a shared_secret or a signer")
+	}
+	self.listener, err = net.Listen("tcp", self.config.Address)
+	if err != nil {
+		return fmt.Errorf("ListenTCP failed: %s\n", err.Error())
+	}
+	self.stopChan = make(chan bool)
+	self.seen = make(map[string]time.Time)
+	return nil
+}
+
+func (self *AdminInput) Run(ir InputRunner, h PluginHelper) (err error) {
+	self.ir = ir
+	self.h = h
+	// No WriteTimeout, tap responses stream for as long as the client
+	// stays connected.
+	self.server = &http.Server{
+		Handler:     self.handler(),
+		ReadTimeout: 10 * time.Second,
+	}
+	if err = self.server.Serve(self.listener); err != nil {
+		if strings.Contains(err.Error(), "use of closed") {
+			// Stop was called, this is a clean shutdown.
+			err = nil
+		}
+	}
+	self.wg.Wait()
+	return
+}
+
+func (self *AdminInput) Stop() {
+	close(self.stopChan)
+	self.listener.Close()
+}
+
+// Returns the HTTP handler serving the admin API.
+func (self *AdminInput) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/plugins", self.handlePlugins)
+	mux.HandleFunc("/plugins/", self.handlePlugin)
+	mux.HandleFunc("/reload", self.handleReload)
+	mux.HandleFunc("/globals", self.handleGlobals)
+	mux.HandleFunc("/matchers/validate", self.handleValidateMatcher)
+	mux.HandleFunc("/tap", self.handleTap)
+	return self.authorize(mux)
+}
+
+// Wraps the provided handler, only passing along authorized requests.
+func (self *AdminInput) authorize(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		self.wg.Add(1)
+		defer self.wg.Done()
+
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, adminMaxBodySize+1))
+		if err != nil {
+			adminError(w, http.StatusBadRequest,
+				fmt.Sprintf("error reading request body: %s", err))
+			return
+		}
+		if len(body) > adminMaxBodySize {
+			adminError(w, http.StatusRequestEntityTooLarge,
+				"request body too large")
+			return
+		}
+		if !self.authorized(req, body) {
+			adminError(w, http.StatusUnauthorized, "request not authorized")
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// Returns true if the request carries the shared secret or a valid signature
+// from one of the configured signers.
+func (self *AdminInput) authorized(req *http.Request, body []byte) bool {
+	if secret := self.config.SharedSecret; secret != "" {
+		auth := []byte(req.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(auth, []byte("Bearer "+secret)) == 1 {
+			return true
+		}
+	}
+
+	digest, err := hex.DecodeString(req.Header.Get("X-Heka-Hmac"))
+	if err != nil || len(digest) == 0 {
+		return false
+	}
+	signer := fmt.Sprintf("%s_%s", req.Header.Get("X-Heka-Hmac-Signer"),
+		req.Header.Get("X-Heka-Hmac-Key-Version"))
+	s, ok := self.config.Signers[signer]
+	if !ok {
+		return false
+	}
+	timestamp := req.Header.Get("X-Heka-Timestamp")
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := time.Since(time.Unix(secs, 0)); skew > adminMaxClockSkew ||
+		skew < -adminMaxClockSkew {
+		return false
+	}
+
+	var hm hash.Hash
+	switch req.Header.Get("X-Heka-Hmac-Hash-Function") {
+	case "", "MD5":
+		hm = hmac.New(md5.New, []byte(s.HmacKey))
+	case "SHA1":
+		hm = hmac.New(sha1.New, []byte(s.HmacKey))
+	default:
+		return false
+	}
+	hm.Write([]byte(AdminSigningString(req.Method, req.URL.RequestURI(),
+		timestamp)))
+	hm.Write(body)
+	if !hmac.Equal(digest, hm.Sum(nil)) {
+		return false
+	}
+	return self.firstUse(string(digest), time.Unix(secs, 0).Add(adminMaxClockSkew))
+}
+
+// Records an accepted signature, returning false if it has already been used.
+// Signatures are forgotten once their timestamp falls outside of the accepted
+// clock skew, after which they're rejected as stale instead.
+func (self *AdminInput) firstUse(digest string, expires time.Time) bool {
+	self.seenLock.Lock()
+	defer self.seenLock.Unlock()
+	now := time.Now()
+	for d, exp := range self.seen {
+		if now.After(exp) {
+			delete(self.seen, d)
+		}
+	}
+	if _, ok := self.seen[digest]; ok {
+		return false
+	}
+	self.seen[digest] = expires
+	return true
+}
+
+// Returns the string that, followed by the request body, is signed to
+// authorize an AdminInput request. `timestamp` is the X-Heka-Timestamp header
+// value, i.e. the current Unix time in seconds.
+func AdminSigningString(method, requestURI, timestamp string) string {
+	return fmt.Sprintf("%s\n%s\n%s\n", method, requestURI, timestamp)
+}
+
+// Writes the provided value to the response as JSON.
+func adminJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func adminError(w http.ResponseWriter, status int, msg string) {
+	adminJSON(w, status, map[string]string{"error": msg})
+}
+
+// Checks the request method, writing an error response if it's not the
+// expected one.
+func adminMethod(w http.ResponseWriter, req *http.Request, method string) bool {
+	if req.Method != method {
+		w.Header().Set("Allow", method)
+		adminError(w, http.StatusMethodNotAllowed,
+			fmt.Sprintf("only %s requests are accepted", method))
+		return false
+	}
+	return true
+}
+
+// Returns the report data for a single plugin, tagged w/ the plugin's name
+// and category.
+func adminReport(name, category string, runner PluginRunner) map[string]interface{} {
+	report := pluginReportData(runner)
+	report["Plugin"] = name
+	report["Category"] = category
+	return report
+}
+
+// Lists every running input, filter, and output w/ its report data.
+func (self *AdminInput) handlePlugins(w http.ResponseWriter, req *http.Request) {
+	if !adminMethod(w, req, "GET") {
+		return
+	}
+	inputs, filters, outputs := self.h.PipelineConfig().runners()
+	reports := map[string][]map[string]interface{}{
+		"inputs":  {},
+		"filters": {},
+		"outputs": {},
+	}
+	for name, runner := range inputs {
+		reports["inputs"] = append(reports["inputs"],
+			adminReport(name, "Input", runner))
+	}
+	for name, runner := range filters {
+		reports["filters"] = append(reports["filters"],
+			adminReport(name, "Filter", runner))
+	}
+	for name, runner := range outputs {
+		reports["outputs"] = append(reports["outputs"],
+			adminReport(name, "Output", runner))
+	}
+	adminJSON(w, http.StatusOK, reports)
+}
+
+// Handles requests for a single plugin: `GET /plugins/<name>` returns its
+// report data, `POST /plugins/<name>/stop` and `POST /plugins/<name>/start`
+// stop it, or start it from its config file section.
+func (self *AdminInput) handlePlugin(w http.ResponseWriter, req *http.Request) {
+	config := self.h.PipelineConfig()
+	path := strings.Split(strings.TrimPrefix(req.URL.Path, "/plugins/"), "/")
+	name := path[0]
+	if name == "" || len(path) > 2 {
+		adminError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	if len(path) == 1 {
+		if !adminMethod(w, req, "GET") {
+			return
+		}
+		if runner, ok := config.Input(name); ok {
+			adminJSON(w, http.StatusOK, adminReport(name, "Input", runner))
+		} else if runner, ok := config.Filter(name); ok {
+			adminJSON(w, http.StatusOK, adminReport(name, "Filter", runner))
+		} else if runner, ok := config.Output(name); ok {
+			adminJSON(w, http.StatusOK, adminReport(name, "Output", runner))
+		} else {
+			adminError(w, http.StatusNotFound,
+				fmt.Sprintf("no running plugin named '%s'", name))
+		}
+		return
+	}
+
+	switch path[1] {
+	case "stop":
+		if !adminMethod(w, req, "POST") {
+			return
+		}
+		if !config.StopPlugin(name) {
+			adminError(w, http.StatusNotFound,
+				fmt.Sprintf("no running plugin named '%s'", name))
+			return
+		}
+		self.ir.LogMessage(fmt.Sprintf("stopped '%s'", name))
+	case "start":
+		if !adminMethod(w, req, "POST") {
+			return
+		}
+		if config.IsRunning(name) {
+			adminError(w, http.StatusConflict,
+				fmt.Sprintf("'%s' is already running", name))
+			return
+		}
+		if err := config.StartPlugin(name); err != nil {
+			adminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		self.ir.LogMessage(fmt.Sprintf("started '%s'", name))
+	default:
+		adminError(w, http.StatusNotFound, "not found")
+		return
+	}
+	adminJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+// Reloads the config file, as happens on SIGHUP.
+func (self *AdminInput) handleReload(w http.ResponseWriter, req *http.Request) {
+	if !adminMethod(w, req, "POST") {
+		return
+	}
+	self.ir.LogMessage("reload requested")
+	if err := self.h.PipelineConfig().Reload(); err != nil {
+		adminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	adminJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+func (self *AdminInput) handleGlobals(w http.ResponseWriter, req *http.Request) {
+	if !adminMethod(w, req, "GET") {
+		return
+	}
+	adminJSON(w, http.StatusOK, Globals())
+}
+
+// Checks the message_matcher spec in the request body, responding w/ any
+// problems found.
+func (self *AdminInput) handleValidateMatcher(w http.ResponseWriter,
+	req *http.Request) {
+
+	if !adminMethod(w, req, "POST") {
+		return
+	}
+	spec, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		adminError(w, http.StatusBadRequest,
+			fmt.Sprintf("error reading request body: %s", err))
+		return
+	}
+	diagnostics := message.ValidateMatcher(string(spec))
+	if diagnostics == nil {
+		diagnostics = []message.Diagnostic{}
+	}
+	adminJSON(w, http.StatusOK, map[string]interface{}{
+		"valid":       len(diagnostics) == 0,
+		"diagnostics": diagnostics,
+	})
+}
+
+// Streams the messages matching the `matcher` query parameter, as JSON (one
+// message per line) or as a Heka protocol stream depending on the `format`
+// parameter, until the client disconnects. A `rate` parameter can lower the
+// maximum number of messages sent per second.
+func (self *AdminInput) handleTap(w http.ResponseWriter, req *http.Request) {
+	if !adminMethod(w, req, "GET") {
+		return
+	}
+	query := req.URL.Query()
+	spec := query.Get("matcher")
+	if spec == "" {
+		adminError(w, http.StatusBadRequest, "matcher parameter is required")
+		return
+	}
+	format := query.Get("format")
+	switch format {
+	case "":
+		format = "json"
+	case "json", "protobufstream":
+	default:
+		adminError(w, http.StatusBadRequest,
+			fmt.Sprintf("unknown format: %s", format))
+		return
+	}
+	rate := self.config.TapRate
+	if rateStr := query.Get("rate"); rateStr != "" {
+		requested, err := strconv.ParseUint(rateStr, 10, 32)
+		if err != nil {
+			adminError(w, http.StatusBadRequest,
+				fmt.Sprintf("invalid rate: %s", rateStr))
+			return
+		}
+		if requested > 0 && (rate == 0 || uint(requested) < rate) {
+			rate = uint(requested)
+		}
+	}
+
+	if atomic.AddInt32(&self.taps, 1) > int32(self.config.MaxTaps) {
+		atomic.AddInt32(&self.taps, -1)
+		adminError(w, http.StatusServiceUnavailable, "too many taps running")
+		return
+	}
+	defer atomic.AddInt32(&self.taps, -1)
+	tap, err := NewRouterTap(self.h.PipelineConfig().router, spec, rate)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// The tap ends when the client goes away or the input is stopped.
+	done := make(chan bool)
+	finished := make(chan bool)
+	defer close(finished)
+	var closed <-chan bool
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		closed = notifier.CloseNotify()
+	}
+	go func() {
+		select {
+		case <-closed:
+		case <-self.stopChan:
+		case <-finished:
+			return
+		}
+		close(done)
+	}()
+
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	encoder := client.NewProtobufEncoder(nil)
+	outBytes := make([]byte, 0, 1000)
+	send := func(msg *message.Message) (err error) {
+		outBytes = outBytes[:0]
+		if format == "json" {
+			var jsonBytes []byte
+			if jsonBytes, err = json.Marshal(msg); err != nil {
+				return
+			}
+			outBytes = append(append(outBytes, jsonBytes...), NEWLINE)
+		} else if err = encoder.EncodeMessageStream(msg, &outBytes); err != nil {
+			return
+		}
+		if _, err = w.Write(outBytes); err == nil && flusher != nil {
+			flusher.Flush()
+		}
+		return
+	}
+
+	self.ir.LogMessage(fmt.Sprintf("tap started: %s", spec))
+	tap.Run(send, done)
+	self.ir.LogMessage(fmt.Sprintf("tap ended: %s, %d sent, %d dropped", spec,
+		tap.Sent(), tap.Dropped()))
+}
@@ -43,9 +43,12 @@ func TestAllSpecs(t *testing.T) {
 	r.AddSpec(InputsSpec)
 	r.AddSpec(OutputsSpec)
 	r.AddSpec(LoadFromConfigSpec)
+	r.AddSpec(RuntimeRunnersSpec)
 	r.AddSpec(WhisperRunnerSpec)
 	r.AddSpec(WhisperOutputSpec)
 	r.AddSpec(ReportSpec)
+	r.AddSpec(DiskQueueSpec)
+	r.AddSpec(RouterSpec)
 	gospec.MainGoTest(r, t)
 }
 
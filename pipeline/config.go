@@ -22,7 +22,10 @@ import (
 	. "github.com/mozilla-services/heka/message"
 	"log"
 	"os"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 )
@@ -109,6 +112,21 @@ type PipelineConfig struct {
 	filtersLock sync.Mutex
 	// Is freed when all FilterRunners have stopped.
 	filtersWg sync.WaitGroup
+	// Locks protecting the sets of running inputs and outputs, which can
+	// change while Heka is running when the config is reloaded.
+	inputsLock  sync.Mutex
+	outputsLock sync.Mutex
+	// Is freed when all InputRunners have stopped.
+	inputsWg sync.WaitGroup
+	// Is freed when all OutputRunners have stopped.
+	outputsWg sync.WaitGroup
+	// Path of the config file the configuration was loaded from.
+	configFile string
+	// Generic decoding of each config file section, used to find what
+	// changed when the config is reloaded.
+	configSections map[string]interface{}
+	// Serializes reloads and plugin starts.
+	reloadLock sync.Mutex
 	// Is freed when all DecoderRunners have stopped.
 	decodersWg sync.WaitGroup
 	// Channel providing round-robin access to the initialized DecoderSets.
@@ -117,6 +135,8 @@ type PipelineConfig struct {
 	hostname string
 	// Heka process id.
 	pid int32
+	// Closed when Heka starts shutting down.
+	stopChan chan bool
 }
 
 // Creates and initializes a PipelineConfig object. `nil` value for `globals`
@@ -142,6 +162,7 @@ func NewPipelineConfig(globals *GlobalConfigStruct) (config *PipelineConfig) {
 	config.decodersChan = make(chan DecoderSet, globals.DecoderPoolSize)
 	config.hostname, _ = os.Hostname()
 	config.pid = int32(os.Getpid())
+	config.stopChan = make(chan bool)
 
 	return config
 }
@@ -166,6 +187,8 @@ func (self *PipelineConfig) PipelinePack(msgLoopCount uint) *PipelinePack {
 // Returns OutputRunner registered under the specified name, or nil (and ok ==
 // false) if no such name is registered.
 func (self *PipelineConfig) Output(name string) (oRunner OutputRunner, ok bool) {
+	self.outputsLock.Lock()
+	defer self.outputsLock.Unlock()
 	oRunner, ok = self.OutputRunners[name]
 	return
 }
@@ -186,6 +209,8 @@ func (self *PipelineConfig) DecoderSet() (ds DecoderSet) {
 // Returns a FilterRunner with the given name, or nil and ok == false if no
 // such name is registered.
 func (self *PipelineConfig) Filter(name string) (fRunner FilterRunner, ok bool) {
+	self.filtersLock.Lock()
+	defer self.filtersLock.Unlock()
 	fRunner, ok = self.FilterRunners[name]
 	return
 }
@@ -209,6 +234,13 @@ func (self *PipelineConfig) AddFilterRunner(fRunner FilterRunner) error {
 // Removes the specified FilterRunner from the configuration, returns false if
 // no such name is registered.
 func (self *PipelineConfig) RemoveFilterRunner(name string) bool {
+	return self.removeFilterRunner(name, nil)
+}
+
+// Removes the FilterRunner registered under the specified name. If `only` is
+// not nil the registered runner is only removed if it is that runner, so a
+// filter shutting down can't remove its replacement.
+func (self *PipelineConfig) removeFilterRunner(name string, only FilterRunner) bool {
 	if Globals().Stopping {
 		return false
 	}
@@ -216,6 +248,9 @@ func (self *PipelineConfig) RemoveFilterRunner(name string) bool {
 	self.filtersLock.Lock()
 	defer self.filtersLock.Unlock()
 	if fRunner, ok := self.FilterRunners[name]; ok {
+		if only != nil && fRunner != only {
+			return false
+		}
 		self.router.MrChan() <- fRunner.MatchRunner()
 		close(fRunner.InChan())
 		delete(self.FilterRunners, name)
@@ -224,17 +259,207 @@ func (self *PipelineConfig) RemoveFilterRunner(name string) bool {
 	return false
 }
 
+// Returns an InputRunner with the given name, or nil and ok == false if no
+// such name is registered.
+func (self *PipelineConfig) Input(name string) (iRunner InputRunner, ok bool) {
+	self.inputsLock.Lock()
+	defer self.inputsLock.Unlock()
+	iRunner, ok = self.InputRunners[name]
+	return
+}
+
+// Returns copies of the sets of running inputs, filters, and outputs, which
+// can be iterated over while plugins are being added or removed.
+func (self *PipelineConfig) runners() (inputs map[string]InputRunner,
+	filters map[string]FilterRunner, outputs map[string]OutputRunner) {
+
+	self.inputsLock.Lock()
+	inputs = make(map[string]InputRunner, len(self.InputRunners))
+	for name, runner := range self.InputRunners {
+		inputs[name] = runner
+	}
+	self.inputsLock.Unlock()
+	self.filtersLock.Lock()
+	filters = make(map[string]FilterRunner, len(self.FilterRunners))
+	for name, runner := range self.FilterRunners {
+		filters[name] = runner
+	}
+	self.filtersLock.Unlock()
+	self.outputsLock.Lock()
+	outputs = make(map[string]OutputRunner, len(self.OutputRunners))
+	for name, runner := range self.OutputRunners {
+		outputs[name] = runner
+	}
+	self.outputsLock.Unlock()
+	return
+}
+
+// Calls the provided function while holding the lock that protects the set of
+// running plugins to which the runner belongs, but only if Heka isn't stopping
+// and the runner is still registered. Returns false if the function wasn't
+// called.
+func (self *PipelineConfig) ifRegistered(runner PluginRunner, f func()) bool {
+	var (
+		lock       *sync.Mutex
+		registered PluginRunner
+		ok         bool
+	)
+	name := runner.Name()
+	switch runner.(type) {
+	case InputRunner:
+		lock = &self.inputsLock
+		lock.Lock()
+		registered, ok = self.InputRunners[name]
+	case FilterRunner:
+		// foRunners are both FilterRunners and OutputRunners.
+		self.filtersLock.Lock()
+		if registered, ok = self.FilterRunners[name]; ok && registered == runner {
+			lock = &self.filtersLock
+		} else {
+			self.filtersLock.Unlock()
+			lock = &self.outputsLock
+			lock.Lock()
+			registered, ok = self.OutputRunners[name]
+		}
+	default:
+		return false
+	}
+	defer lock.Unlock()
+	if Globals().Stopping || !ok || registered != runner {
+		return false
+	}
+	f()
+	return true
+}
+
+// Starts the provided InputRunner and adds it to the set of running Inputs.
+func (self *PipelineConfig) AddInputRunner(iRunner InputRunner) error {
+	self.inputsLock.Lock()
+	defer self.inputsLock.Unlock()
+	if _, ok := self.InputRunners[iRunner.Name()]; ok {
+		return fmt.Errorf("AddInputRunner '%s' failed: name already in use",
+			iRunner.Name())
+	}
+	self.inputsWg.Add(1)
+	if err := iRunner.Start(self, &self.inputsWg); err != nil {
+		self.inputsWg.Done()
+		return fmt.Errorf("AddInputRunner '%s' failed to start: %s",
+			iRunner.Name(), err)
+	}
+	self.InputRunners[iRunner.Name()] = iRunner
+	return nil
+}
+
+// Stops the specified InputRunner and removes it from the configuration,
+// returns false if no such name is registered.
+func (self *PipelineConfig) RemoveInputRunner(name string) bool {
+	if Globals().Stopping {
+		return false
+	}
+
+	self.inputsLock.Lock()
+	defer self.inputsLock.Unlock()
+	if iRunner, ok := self.InputRunners[name]; ok {
+		iRunner.Input().Stop()
+		delete(self.InputRunners, name)
+		return true
+	}
+	return false
+}
+
+// Starts the provided OutputRunner, adds it to the set of running Outputs,
+// and registers its MatchRunner w/ the router.
+func (self *PipelineConfig) AddOutputRunner(oRunner OutputRunner) error {
+	self.outputsLock.Lock()
+	defer self.outputsLock.Unlock()
+	if _, ok := self.OutputRunners[oRunner.Name()]; ok {
+		return fmt.Errorf("AddOutputRunner '%s' failed: name already in use",
+			oRunner.Name())
+	}
+	self.outputsWg.Add(1)
+	if err := oRunner.Start(self, &self.outputsWg); err != nil {
+		self.outputsWg.Done()
+		return fmt.Errorf("AddOutputRunner '%s' failed to start: %s",
+			oRunner.Name(), err)
+	}
+	if matcher := oRunner.MatchRunner(); matcher != nil {
+		self.router.OMrChan() <- matcher
+	}
+	self.OutputRunners[oRunner.Name()] = oRunner
+	return nil
+}
+
+// Detaches the specified OutputRunner from the router, lets it shut down, and
+// removes it from the configuration. Returns false if no such name is
+// registered.
+func (self *PipelineConfig) RemoveOutputRunner(name string) bool {
+	if Globals().Stopping {
+		return false
+	}
+
+	self.outputsLock.Lock()
+	defer self.outputsLock.Unlock()
+	oRunner, ok := self.OutputRunners[name]
+	if !ok {
+		return false
+	}
+	if matcher := oRunner.MatchRunner(); matcher != nil {
+		self.router.OMrChan() <- matcher
+	}
+	if runner, ok := oRunner.(*foRunner); ok {
+		if runner.queue != nil {
+			// Anything still queued is replayed once the output is back.
+			runner.stopReplay()
+		}
+		close(runner.stopChan)
+	}
+	close(oRunner.InChan())
+	delete(self.OutputRunners, name)
+	return true
+}
+
 type ConfigFile PluginConfig
 
 // The TOML spec for plugin configuration options that will be pulled out  by
 // Heka itself for runner configuration before the config is passed to the
 // Plugin.Init method.
 type PluginGlobals struct {
-	Typ      string `toml:"type"`
-	Ticker   uint   `toml:"ticker_interval"`
-	Encoding string `toml:"encoding_name"`
-	Matcher  string `toml:"message_matcher"`
-	Signer   string `toml:"message_signer"`
+	Typ         string `toml:"type"`
+	Ticker      uint   `toml:"ticker_interval"`
+	Encoding    string `toml:"encoding_name"`
+	Matcher     string `toml:"message_matcher"`
+	Signer      string `toml:"message_signer"`
+	CertSubject string `toml:"message_cert_subject"`
+	// What the router does when the plugin can't keep up, one of the
+	// OVERLOAD_* values, and how long (in milliseconds) it waits first.
+	OverloadPolicy  string `toml:"overload_policy"`
+	OverloadTimeout uint   `toml:"overload_timeout"`
+	// Disk queue settings, outputs only.
+	QueueToDisk      bool   `toml:"queue_to_disk"`
+	QueueDir         string `toml:"queue_dir"`
+	QueueMaxSize     int64  `toml:"queue_max_size"`
+	QueueSegmentSize int64  `toml:"queue_segment_size"`
+	QueueFullAction  string `toml:"queue_full_action"`
+	// What to do when the plugin's Run method exits while Heka is running.
+	Restart RestartPolicy `toml:"restart"`
+}
+
+// Settings controlling whether and how a plugin is restarted when its Run
+// method returns or panics while Heka is still running.
+type RestartPolicy struct {
+	// Maximum number of consecutive restarts, -1 for no limit. Defaults to 0,
+	// i.e. plugins aren't restarted.
+	MaxRetries int `toml:"max_retries"`
+	// Milliseconds to wait before the first restart, doubled for each
+	// consecutive restart. Defaults to 500.
+	Delay uint `toml:"delay"`
+	// Upper limit of the restart delay in milliseconds. A plugin that has been
+	// running for longer than this before exiting again is considered to have
+	// recovered, resetting the retry count. Defaults to 30000.
+	MaxDelay uint `toml:"max_delay"`
+	// Set to true to create a brand new plugin instance for each restart
+	// rather than calling Init again on the existing one.
+	Recreate bool `toml:"recreate"`
 }
 
 // Default Decoders configuration.
@@ -344,12 +569,41 @@ func (self *PipelineConfig) log(msg string) {
 }
 
 // loadSection must be passed a plugin name and the config for that plugin. It
-// will create a PluginWrapper (i.e. a factory). For decoders the
-// PluginWrappers are stored and used later to create the DecoderSet pool. For
-// the other plugin types, we create the plugin, configure it, then create the
-// appropriate plugin runner.
+// loads the plugin and registers the resulting runner w/ the (not yet
+// running) pipeline.
 func (self *PipelineConfig) loadSection(sectionName string,
 	configSection toml.Primitive) (errcnt uint) {
+
+	var runner PluginRunner
+	if runner, errcnt = self.loadPlugin(sectionName, configSection); runner == nil {
+		return
+	}
+	switch r := runner.(type) {
+	case InputRunner:
+		self.InputRunners[r.Name()] = r
+	case *foRunner:
+		if _, ok := r.plugin.(Filter); ok {
+			if r.matcher != nil {
+				self.router.fMatchers = append(self.router.fMatchers, r.matcher)
+			}
+			self.FilterRunners[r.name] = r
+		} else {
+			if r.matcher != nil {
+				self.router.oMatchers = append(self.router.oMatchers, r.matcher)
+			}
+			self.OutputRunners[r.name] = r
+		}
+	}
+	return
+}
+
+// loadPlugin must be passed a plugin name and the config for that plugin. It
+// will create a PluginWrapper (i.e. a factory). For decoders the
+// PluginWrappers are stored and used later to create the DecoderSet pool. For
+// the other plugin types, we create the plugin, configure it, then create and
+// return the appropriate (not yet started) plugin runner.
+func (self *PipelineConfig) loadPlugin(sectionName string,
+	configSection toml.Primitive) (pRunner PluginRunner, errcnt uint) {
 	var ok bool
 	var err error
 	var pluginGlobals PluginGlobals
@@ -358,6 +612,7 @@ func (self *PipelineConfig) loadSection(sectionName string,
 	wrapper := new(PluginWrapper)
 	wrapper.name = sectionName
 
+	pluginGlobals.Restart = RestartPolicy{Delay: 500, MaxDelay: 30000}
 	if err = toml.PrimitiveDecode(configSection, &pluginGlobals); err != nil {
 		self.log(fmt.Sprintf("Unable to decode config for plugin: %s, error: %s",
 			wrapper.name, err.Error()))
@@ -431,15 +686,20 @@ func (self *PipelineConfig) loadSection(sectionName string,
 		return
 	}
 
-	// For inputs we just store the InputRunner and we're done.
+	// For inputs we just create the InputRunner and we're done.
 	if pluginCategory == "Input" {
-		self.InputRunners[wrapper.name] = NewInputRunner(wrapper.name, plugin.(Input))
+		iRunner := NewInputRunner(wrapper.name, plugin.(Input)).(*iRunner)
+		iRunner.wrapper = wrapper
+		iRunner.restart = pluginGlobals.Restart
+		pRunner = iRunner
 		return
 	}
 
 	// Filters and outputs have a few more config settings.
 	runner := NewFORunner(wrapper.name, plugin.(Plugin))
 	runner.name = wrapper.name
+	runner.wrapper = wrapper
+	runner.restart = pluginGlobals.Restart
 
 	if pluginGlobals.Ticker != 0 {
 		runner.tickLength = time.Duration(pluginGlobals.Ticker) * time.Second
@@ -454,22 +714,43 @@ func (self *PipelineConfig) loadSection(sectionName string,
 			errcnt++
 			return
 		}
+		matcher.certSubject = pluginGlobals.CertSubject
+		if err = matcher.SetOverloadPolicy(pluginGlobals.OverloadPolicy,
+			time.Duration(pluginGlobals.OverloadTimeout)*time.Millisecond); err != nil {
+			self.log(fmt.Sprintf("'%s': %s", wrapper.name, err))
+			errcnt++
+			return
+		}
 		runner.matcher = matcher
 	}
 
 	switch pluginCategory {
 	case "Filter":
-		if matcher != nil {
-			self.router.fMatchers = append(self.router.fMatchers, matcher)
+		if pluginGlobals.QueueToDisk {
+			self.log(fmt.Sprintf("'%s': queue_to_disk is only supported for outputs",
+				wrapper.name))
+			errcnt++
+			return
 		}
-		self.FilterRunners[runner.name] = runner
 	case "Output":
-		if matcher != nil {
-			self.router.oMatchers = append(self.router.oMatchers, matcher)
+		if pluginGlobals.QueueToDisk {
+			queueDir := pluginGlobals.QueueDir
+			if queueDir == "" {
+				queueDir = filepath.Join(Globals().BaseDir, "output_queues",
+					runner.name)
+			}
+			if runner.queue, err = openDiskQueue(queueDir,
+				pluginGlobals.QueueMaxSize, pluginGlobals.QueueSegmentSize,
+				pluginGlobals.QueueFullAction); err != nil {
+				self.log(fmt.Sprintf("Can't open disk queue for '%s': %s",
+					wrapper.name, err))
+				errcnt++
+				return
+			}
 		}
-		self.OutputRunners[runner.name] = runner
 	}
 
+	pRunner = runner
 	return
 }
 
@@ -484,6 +765,10 @@ func (self *PipelineConfig) LoadFromConfigFile(filename string) (err error) {
 	if _, err = toml.DecodeFile(filename, &configFile); err != nil {
 		return fmt.Errorf("Error decoding config file: %s", err)
 	}
+	self.configFile = filename
+	if _, err = toml.DecodeFile(filename, &self.configSections); err != nil {
+		return fmt.Errorf("Error decoding config file: %s", err)
+	}
 
 	// Load all the plugins
 	var errcnt uint
@@ -526,6 +811,245 @@ func (self *PipelineConfig) LoadFromConfigFile(filename string) (err error) {
 	return
 }
 
+// Returns the plugin category (i.e. "Input", "Decoder", "Filter", or
+// "Output") of a generically decoded config section.
+func sectionCategory(sectionName string, section interface{}) string {
+	pluginType := sectionName
+	if conf, ok := section.(map[string]interface{}); ok {
+		if typ, ok := conf["type"].(string); ok && typ != "" {
+			pluginType = typ
+		}
+	}
+	if pluginCats := PluginTypeRegex.FindStringSubmatch(pluginType); len(pluginCats) == 2 {
+		return pluginCats[1]
+	}
+	return ""
+}
+
+// Reload rereads the config file the running configuration was loaded from
+// and brings the running plugins in line with it. Inputs, filters, and
+// outputs whose sections were removed are stopped, new ones are started, and
+// those whose config changed are restarted. Plugins whose config didn't
+// change are left alone, so they don't lose any messages. A changed plugin
+// whose new config fails to load keeps running w/ its old config. Decoder
+// changes only take effect after a restart.
+func (self *PipelineConfig) Reload() (err error) {
+	var (
+		configFile ConfigFile
+		sections   map[string]interface{}
+		stop       []string
+		replace    []string
+		start      []string
+		errcnt     uint
+	)
+	self.reloadLock.Lock()
+	defer self.reloadLock.Unlock()
+	if _, err = toml.DecodeFile(self.configFile, &configFile); err != nil {
+		return fmt.Errorf("Error decoding config file: %s", err)
+	}
+	if _, err = toml.DecodeFile(self.configFile, &sections); err != nil {
+		return fmt.Errorf("Error decoding config file: %s", err)
+	}
+
+	for name, oldSection := range self.configSections {
+		newSection, ok := sections[name]
+		if ok && reflect.DeepEqual(oldSection, newSection) {
+			continue
+		}
+		if sectionCategory(name, oldSection) == "Decoder" ||
+			(ok && sectionCategory(name, newSection) == "Decoder") {
+			self.log(fmt.Sprintf("Decoder '%s' changes require a restart", name))
+			continue
+		}
+		if ok {
+			replace = append(replace, name)
+		} else {
+			stop = append(stop, name)
+		}
+	}
+	for name, newSection := range sections {
+		if _, ok := self.configSections[name]; ok {
+			continue
+		}
+		if sectionCategory(name, newSection) == "Decoder" {
+			self.log(fmt.Sprintf("Decoder '%s' changes require a restart", name))
+			continue
+		}
+		start = append(start, name)
+	}
+
+	// Stop everything that's going away first, so new plugins can claim
+	// resources (e.g. listening addresses) held by the removed ones.
+	for _, name := range stop {
+		if !self.StopPlugin(name) {
+			log.Printf("Reload: '%s' wasn't running", name)
+		} else {
+			log.Printf("Reload: stopped '%s'", name)
+		}
+		delete(self.configSections, name)
+	}
+
+	for _, name := range replace {
+		errcnt += self.replacePlugin(name, configFile[name], sections[name])
+	}
+
+	for _, name := range start {
+		runner, cnt := self.loadPlugin(name, configFile[name])
+		if runner == nil {
+			errcnt += cnt
+			continue
+		}
+		if err = self.startRunner(runner); err != nil {
+			self.log(err.Error())
+			errcnt++
+			continue
+		}
+		self.configSections[name] = sections[name]
+		log.Printf("Reload: started '%s'", name)
+	}
+
+	if errcnt != 0 {
+		return fmt.Errorf("%d errors reloading plugins", errcnt)
+	}
+	return nil
+}
+
+// Returns true if the plugin defined by the config section holds resources a
+// second instance can't claim while it's running, i.e. an input's listening
+// address or an output's disk queue.
+func holdsResources(name string, section interface{}) bool {
+	if sectionCategory(name, section) == "Input" {
+		return true
+	}
+	conf, _ := section.(map[string]interface{})
+	queued, _ := conf["queue_to_disk"].(bool)
+	return queued
+}
+
+// Replaces the running plugin w/ one loaded from its changed config section,
+// returning the number of errors. The replacement is loaded before the
+// running plugin is stopped, so a broken config leaves it running. Plugins
+// holding resources the replacement needs have to be stopped first, and are
+// restarted w/ their old config if the replacement fails.
+func (self *PipelineConfig) replacePlugin(name string, section toml.Primitive,
+	newSection interface{}) (errcnt uint) {
+
+	var runner PluginRunner
+	oldSection := self.configSections[name]
+	stopFirst := holdsResources(name, oldSection)
+	if !stopFirst {
+		if runner, errcnt = self.loadPlugin(name, section); runner == nil {
+			log.Printf("Reload: '%s' keeps running w/ its old config", name)
+			return
+		}
+	}
+	self.StopPlugin(name)
+	if stopFirst {
+		runner, errcnt = self.loadPlugin(name, section)
+	}
+	if runner != nil {
+		if err := self.startRunner(runner); err != nil {
+			self.log(err.Error())
+			errcnt++
+			runner = nil
+		}
+	}
+	if runner == nil {
+		self.restorePlugin(name, oldSection)
+		return
+	}
+	self.configSections[name] = newSection
+	log.Printf("Reload: restarted '%s'", name)
+	return
+}
+
+// Starts the plugin again w/ the config section it was running with before
+// a failed reload.
+func (self *PipelineConfig) restorePlugin(name string, oldSection interface{}) {
+	runner, _ := self.loadPlugin(name, toml.Primitive(oldSection))
+	if runner != nil {
+		if err := self.startRunner(runner); err == nil {
+			log.Printf("Reload: restarted '%s' w/ its old config", name)
+			return
+		}
+	}
+	self.log(fmt.Sprintf("Reload: '%s' couldn't be restarted w/ its old config",
+		name))
+	delete(self.configSections, name)
+}
+
+// Starts a plugin that was loaded by `loadPlugin`, adding it to the set of
+// running inputs, filters, or outputs as appropriate.
+func (self *PipelineConfig) startRunner(runner PluginRunner) error {
+	switch r := runner.(type) {
+	case InputRunner:
+		return self.AddInputRunner(r)
+	case *foRunner:
+		if _, ok := r.plugin.(Filter); ok {
+			return self.AddFilterRunner(r)
+		}
+		return self.AddOutputRunner(r)
+	}
+	return fmt.Errorf("'%s' can't be started", runner.Name())
+}
+
+// Loads the plugin defined by the named section of the config file and starts
+// it. Fails if a plugin by that name is already running.
+func (self *PipelineConfig) StartPlugin(name string) (err error) {
+	var (
+		configFile ConfigFile
+		sections   map[string]interface{}
+	)
+	self.reloadLock.Lock()
+	defer self.reloadLock.Unlock()
+	if self.IsRunning(name) {
+		return fmt.Errorf("'%s' is already running", name)
+	}
+	if _, err = toml.DecodeFile(self.configFile, &configFile); err != nil {
+		return fmt.Errorf("Error decoding config file: %s", err)
+	}
+	if _, err = toml.DecodeFile(self.configFile, &sections); err != nil {
+		return fmt.Errorf("Error decoding config file: %s", err)
+	}
+	section, ok := configFile[name]
+	if !ok {
+		return fmt.Errorf("No '%s' section in config file", name)
+	}
+	if sectionCategory(name, sections[name]) == "Decoder" {
+		return fmt.Errorf("'%s': decoders can't be started individually", name)
+	}
+
+	logCount := len(self.logMsgs)
+	runner, _ := self.loadPlugin(name, section)
+	if runner == nil {
+		return fmt.Errorf("Can't load plugin: %s",
+			strings.Join(self.logMsgs[logCount:], "; "))
+	}
+	if err = self.startRunner(runner); err != nil {
+		return
+	}
+	self.configSections[name] = sections[name]
+	return
+}
+
+// Stops the running input, filter, or output w/ the specified name. Returns
+// false if no such plugin is running.
+func (self *PipelineConfig) StopPlugin(name string) bool {
+	return self.RemoveInputRunner(name) || self.RemoveFilterRunner(name) ||
+		self.RemoveOutputRunner(name)
+}
+
+// Returns true if an input, filter, or output w/ the specified name is
+// running.
+func (self *PipelineConfig) IsRunning(name string) (ok bool) {
+	if _, ok = self.Input(name); !ok {
+		if _, ok = self.Filter(name); !ok {
+			_, ok = self.Output(name)
+		}
+	}
+	return
+}
+
 func init() {
 	RegisterPlugin("UdpInput", func() interface{} {
 		return new(UdpInput)
@@ -533,6 +1057,18 @@ func init() {
 	RegisterPlugin("TcpInput", func() interface{} {
 		return new(TcpInput)
 	})
+	RegisterPlugin("HttpInput", func() interface{} {
+		return new(HttpInput)
+	})
+	RegisterPlugin("AdminInput", func() interface{} {
+		return new(AdminInput)
+	})
+	RegisterPlugin("SyslogInput", func() interface{} {
+		return new(SyslogInput)
+	})
+	RegisterPlugin("ProcessInput", func() interface{} {
+		return new(ProcessInput)
+	})
 	RegisterPlugin("JsonDecoder", func() interface{} {
 		return new(JsonDecoder)
 	})
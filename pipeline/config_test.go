@@ -18,6 +18,14 @@ import (
 	"github.com/mozilla-services/heka/message"
 	ts "github.com/mozilla-services/heka/testsupport"
 	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 func LoadFromConfigSpec(c gs.Context) {
@@ -112,5 +120,336 @@ func LoadFromConfigSpec(c gs.Context) {
 			err := pipeConfig.LoadFromConfigFile("../testsupport/config_panic.toml")
 			c.Expect(err, gs.Not(gs.IsNil))
 		})
+
+		c.Specify("reloads only what changed", func() {
+			tmpDir, err := ioutil.TempDir("", "heka-reload-test")
+			c.Assume(err, gs.IsNil)
+			defer os.RemoveAll(tmpDir)
+			configPath := filepath.Join(tmpDir, "hekad.toml")
+
+			origConfig := `
+[UdpInput]
+address = "127.0.0.1:29331"
+
+[LogOutput]
+message_matcher = "Type == 'counter'"
+
+[CounterFilter]
+message_matcher = "Type == 'counter'"
+`
+			err = ioutil.WriteFile(configPath, []byte(origConfig), 0644)
+			c.Assume(err, gs.IsNil)
+			err = pipeConfig.LoadFromConfigFile(configPath)
+			c.Assume(err, gs.IsNil)
+			pipeConfig.router.Start()
+			defer close(pipeConfig.router.InChan())
+
+			udpInput := pipeConfig.InputRunners["UdpInput"]
+			logOutput := pipeConfig.OutputRunners["LogOutput"]
+
+			newConfig := `
+[UdpInput]
+address = "127.0.0.1:29331"
+
+[LogOutput]
+message_matcher = "Type == 'gauge'"
+
+[log2]
+type = "LogOutput"
+message_matcher = "TRUE"
+
+[JsonDecoder]
+`
+			err = ioutil.WriteFile(configPath, []byte(newConfig), 0644)
+			c.Assume(err, gs.IsNil)
+			err = pipeConfig.Reload()
+			c.Expect(err, gs.IsNil)
+
+			c.Expect(pipeConfig.InputRunners["UdpInput"], gs.Equals, udpInput)
+			newLogOutput, ok := pipeConfig.OutputRunners["LogOutput"]
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(newLogOutput == logOutput, gs.IsFalse)
+			c.Expect(newLogOutput.MatchRunner().MatcherSpecification().String(),
+				gs.Equals, "Type == 'gauge'")
+			_, ok = pipeConfig.OutputRunners["log2"]
+			c.Expect(ok, gs.IsTrue)
+			_, ok = pipeConfig.FilterRunners["CounterFilter"]
+			c.Expect(ok, gs.IsFalse)
+			c.Expect(pipeConfig.logMsgs[0], ts.StringContains, "require a restart")
+		})
+
+		c.Specify("keeps plugins w/ invalid config changes running", func() {
+			tmpDir, err := ioutil.TempDir("", "heka-reload-test")
+			c.Assume(err, gs.IsNil)
+			defer os.RemoveAll(tmpDir)
+			configPath := filepath.Join(tmpDir, "hekad.toml")
+
+			origConfig := `
+[UdpInput]
+address = "127.0.0.1:29333"
+
+[LogOutput]
+message_matcher = "Type == 'counter'"
+`
+			err = ioutil.WriteFile(configPath, []byte(origConfig), 0644)
+			c.Assume(err, gs.IsNil)
+			err = pipeConfig.LoadFromConfigFile(configPath)
+			c.Assume(err, gs.IsNil)
+			pipeConfig.router.Start()
+			defer close(pipeConfig.router.InChan())
+			udpInput, _ := pipeConfig.Input("UdpInput")
+			logOutput := pipeConfig.OutputRunners["LogOutput"]
+
+			badConfig := `
+[UdpInput]
+address = "127.0.0.1:notaport"
+
+[LogOutput]
+message_matcher = "Type = 'gauge'"
+`
+			err = ioutil.WriteFile(configPath, []byte(badConfig), 0644)
+			c.Assume(err, gs.IsNil)
+			err = pipeConfig.Reload()
+			c.Expect(err, gs.Not(gs.IsNil))
+
+			// The output was never stopped, the input is back on its old
+			// address.
+			newLogOutput, ok := pipeConfig.Output("LogOutput")
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(newLogOutput == logOutput, gs.IsTrue)
+			newUdpInput, ok := pipeConfig.Input("UdpInput")
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(newUdpInput == udpInput, gs.IsFalse)
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1),
+				Port: 29333})
+			c.Expect(err, gs.Not(gs.IsNil))
+			if err == nil {
+				conn.Close()
+			}
+
+			// Fixing the config applies the changes.
+			fixedConfig := strings.Replace(badConfig, "notaport", "29333", 1)
+			fixedConfig = strings.Replace(fixedConfig, "= 'gauge'", "== 'gauge'", 1)
+			err = ioutil.WriteFile(configPath, []byte(fixedConfig), 0644)
+			c.Assume(err, gs.IsNil)
+			err = pipeConfig.Reload()
+			c.Expect(err, gs.IsNil)
+			newLogOutput, _ = pipeConfig.Output("LogOutput")
+			c.Expect(newLogOutput.MatchRunner().MatcherSpecification().String(),
+				gs.Equals, "Type == 'gauge'")
+			pipeConfig.StopPlugin("UdpInput")
+		})
+	})
+}
+
+// Output that passes along a copy of every message it receives, for testing
+// runtime output changes.
+type captureOutput struct {
+	msgs    chan *message.Message
+	stopped chan bool
+}
+
+func (self *captureOutput) Init(config interface{}) (err error) {
+	return
+}
+
+func (self *captureOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	for plc := range or.InChan() {
+		msg := new(message.Message)
+		plc.Pack.Message.Copy(msg)
+		self.msgs <- msg
+		plc.Pack.Recycle()
+	}
+	close(self.stopped)
+	return
+}
+
+// Output that panics the first `failures` times it's run.
+type flakyOutput struct {
+	failures int32
+	runs     int32
+	inits    int
+}
+
+func (self *flakyOutput) Init(config interface{}) (err error) {
+	self.inits++
+	return
+}
+
+func (self *flakyOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	if atomic.AddInt32(&self.runs, 1) <= self.failures {
+		panic("flaked")
+	}
+	for plc := range or.InChan() {
+		plc.Pack.Recycle()
+	}
+	return
+}
+
+func RuntimeRunnersSpec(c gs.Context) {
+	c.Specify("A running pipeline", func() {
+		origGlobals := Globals
+		pipeConfig := NewPipelineConfig(nil)
+		defer func() {
+			Globals = origGlobals
+		}()
+		pipeConfig.router.Start()
+		defer close(pipeConfig.router.InChan())
+
+		c.Specify("routes messages to an added output", func() {
+			output := &captureOutput{
+				msgs:    make(chan *message.Message, 1),
+				stopped: make(chan bool),
+			}
+			oRunner := NewFORunner("capture", output)
+			var err error
+			oRunner.matcher, err = NewMatchRunner("Type == 'TEST'", "")
+			c.Assume(err, gs.IsNil)
+			err = pipeConfig.AddOutputRunner(oRunner)
+			c.Expect(err, gs.IsNil)
+			_, ok := pipeConfig.Output("capture")
+			c.Expect(ok, gs.IsTrue)
+
+			err = pipeConfig.AddOutputRunner(oRunner)
+			c.Expect(err, gs.Not(gs.IsNil))
+
+			pack := NewPipelinePack(make(chan *PipelinePack, 1))
+			pack.Message = getTestMessage()
+			pack.Message.SetPayload("routed")
+			pipeConfig.router.InChan() <- pack
+			select {
+			case msg := <-output.msgs:
+				c.Expect(msg.GetPayload(), gs.Equals, "routed")
+			case <-time.After(time.Second):
+				c.Expect("message", gs.Equals, "delivered")
+			}
+
+			c.Specify("and stops it when removed", func() {
+				c.Expect(pipeConfig.RemoveOutputRunner("capture"), gs.IsTrue)
+				select {
+				case <-output.stopped:
+				case <-time.After(time.Second):
+					c.Expect("output", gs.Equals, "stopped")
+				}
+				_, ok := pipeConfig.Output("capture")
+				c.Expect(ok, gs.IsFalse)
+				c.Expect(pipeConfig.RemoveOutputRunner("capture"), gs.IsFalse)
+			})
+		})
+
+		c.Specify("restarts crashed plugins", func() {
+			restarted := &captureOutput{
+				msgs:    make(chan *message.Message, 10),
+				stopped: make(chan bool),
+			}
+			rRunner := NewFORunner("restarted", restarted)
+			var err error
+			rRunner.matcher, err = NewMatchRunner("Type == 'heka.plugin-restarted'", "")
+			c.Assume(err, gs.IsNil)
+			err = pipeConfig.AddOutputRunner(rRunner)
+			c.Assume(err, gs.IsNil)
+
+			for i := 0; i < Globals().PoolSize; i++ {
+				pipeConfig.injectRecycleChan <- NewPipelinePack(pipeConfig.injectRecycleChan)
+			}
+			flaky := new(flakyOutput)
+			fRunner := NewFORunner("flaky", flaky)
+			fRunner.wrapper = &PluginWrapper{
+				name:          "flaky",
+				configCreator: func() interface{} { return nil },
+				pluginCreator: func() interface{} { return flaky },
+			}
+			fRunner.restart = RestartPolicy{MaxRetries: 2, Delay: 1, MaxDelay: 10}
+
+			// Returns the restart messages received within the time limit.
+			restarts := func() (msgs []*message.Message) {
+				for {
+					select {
+					case msg := <-restarted.msgs:
+						msgs = append(msgs, msg)
+					case <-time.After(100 * time.Millisecond):
+						return
+					}
+				}
+			}
+
+			// Registers and starts the flaky runner, returning a channel
+			// that's closed once the runner has exited for good.
+			start := func() (finished chan bool) {
+				var wg sync.WaitGroup
+				wg.Add(1)
+				pipeConfig.OutputRunners["flaky"] = fRunner
+				err = fRunner.Start(pipeConfig, &wg)
+				c.Assume(err, gs.IsNil)
+				finished = make(chan bool)
+				go func() {
+					wg.Wait()
+					close(finished)
+				}()
+				return
+			}
+			// Returns true if the runner exits within the time limit.
+			exited := func(finished chan bool) bool {
+				select {
+				case <-finished:
+					return true
+				case <-time.After(time.Second):
+					return false
+				}
+			}
+
+			c.Specify("and emits a message for each restart", func() {
+				flaky.failures = 1
+				err = pipeConfig.AddOutputRunner(fRunner)
+				c.Assume(err, gs.IsNil)
+				msgs := restarts()
+				c.Expect(len(msgs), gs.Equals, 1)
+				if len(msgs) > 0 {
+					c.Expect(msgs[0].GetLogger(), gs.Equals, "flaky")
+					c.Expect(msgs[0].GetPayload(), gs.Equals, "PANIC: flaked")
+					restartCount, _ := msgs[0].GetFieldValue("Restarts")
+					c.Expect(restartCount, gs.Equals, int64(1))
+				}
+				c.Expect(flaky.inits, gs.Equals, 1)
+				c.Expect(atomic.LoadInt32(&flaky.runs), gs.Equals, int32(2))
+			})
+
+			c.Specify("and gives up after max retries", func() {
+				flaky.failures = 10
+				finished := start()
+				c.Expect(len(restarts()), gs.Equals, 2)
+				c.Expect(exited(finished), gs.IsTrue)
+				c.Expect(atomic.LoadInt32(&flaky.runs), gs.Equals, int32(3))
+			})
+
+			c.Specify("and stops waiting to restart when Heka shuts down", func() {
+				flaky.failures = 1
+				fRunner.restart = RestartPolicy{MaxRetries: 2, Delay: 60000,
+					MaxDelay: 60000}
+				finished := start()
+				time.Sleep(50 * time.Millisecond)
+
+				close(pipeConfig.stopChan)
+				c.Expect(exited(finished), gs.IsTrue)
+				c.Expect(len(restarts()), gs.Equals, 0)
+				c.Expect(atomic.LoadInt32(&flaky.runs), gs.Equals, int32(1))
+			})
+		})
+
+		c.Specify("adds and removes inputs", func() {
+			input := new(UdpInput)
+			err := input.Init(&UdpInputConfig{Address: "127.0.0.1:29332"})
+			c.Assume(err, gs.IsNil)
+			iRunner := NewInputRunner("udp", input)
+			err = pipeConfig.AddInputRunner(iRunner)
+			c.Expect(err, gs.IsNil)
+			_, ok := pipeConfig.Input("udp")
+			c.Expect(ok, gs.IsTrue)
+
+			c.Expect(pipeConfig.RemoveInputRunner("udp"), gs.IsTrue)
+			_, ok = pipeConfig.Input("udp")
+			c.Expect(ok, gs.IsFalse)
+			c.Expect(pipeConfig.RemoveInputRunner("udp"), gs.IsFalse)
+		})
 	})
 }
@@ -155,15 +155,24 @@ func (dr *dRunner) Start(h PluginHelper, wg *sync.WaitGroup) {
 			}
 		}()
 
-		var err error
+		var (
+			err error
+			ack func()
+		)
 		for pack = range dr.inChan {
+			// The pack may be recycled as soon as the router has it, so grab
+			// the ack callback first.
+			ack, pack.Ack = pack.Ack, nil
 			if err = dr.Decoder().Decode(pack); err != nil {
 				dr.LogError(err)
 				pack.Recycle()
-				continue
+			} else {
+				pack.Decoded = true
+				h.PipelineConfig().router.InChan() <- pack
+			}
+			if ack != nil {
+				ack()
 			}
-			pack.Decoded = true
-			h.PipelineConfig().router.InChan() <- pack
 		}
 		dr.LogMessage("stopped")
 		wg.Done()
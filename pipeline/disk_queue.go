@@ -0,0 +1,606 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions a disk queue can take when it has reached its maximum size.
+const (
+	QUEUE_BLOCK       = "block"
+	QUEUE_DROP_OLDEST = "drop_oldest"
+)
+
+const (
+	// Default maximum total size of a disk queue, in bytes.
+	DEFAULT_QUEUE_MAX_SIZE = 128 * 1024 * 1024
+	// Default maximum size of a single disk queue segment file, in bytes.
+	DEFAULT_QUEUE_SEGMENT_SIZE = 4 * 1024 * 1024
+	// Extension used for disk queue segment files.
+	queueSegmentExt = ".queue"
+	// Name of the file holding a disk queue's read position.
+	queueCheckpointFile = "checkpoint"
+	// Number of records consumed between checkpoint writes.
+	queueCheckpointInterval = 100
+)
+
+var errQueueClosed = errors.New("queue closed")
+
+// Error for queue data that doesn't hold a valid record. Returned by `Next`
+// w/ the number of bytes it skipped to get past the corruption.
+type corruptQueueError struct {
+	offset  int64
+	reason  string
+	skipped int64
+}
+
+func (e *corruptQueueError) Error() string {
+	if e.skipped > 0 {
+		return fmt.Sprintf("skipped %d bytes of corrupt queue data: %s at offset %d",
+			e.skipped, e.reason, e.offset)
+	}
+	return fmt.Sprintf("%s at offset %d", e.reason, e.offset)
+}
+
+// Disk backed FIFO of Heka protocol framed records, used to buffer the
+// messages matched for an output so a stalled output doesn't block the
+// router. Records are appended to numbered segment files in a dedicated
+// directory. The read position is checkpointed to disk so unconsumed records
+// are replayed after a restart.
+type diskQueue struct {
+	dir         string
+	maxSize     int64
+	segmentSize int64
+	fullAction  string
+	lock        sync.Mutex
+	cond        *sync.Cond
+	// Ids and sizes of the segment files on disk, oldest first. The first
+	// segment is always the one being read, the last the one being written.
+	segments []uint64
+	segSizes []int64
+	size     int64
+	writer   *os.File
+	reader   *os.File
+	readPos  int64
+	pending  int64
+	unsaved  int
+	dropped  int64
+	closed   bool
+}
+
+// Opens (or creates) the disk queue stored in the specified directory,
+// picking up where a previous instance left off.
+func openDiskQueue(dir string, maxSize, segmentSize int64,
+	fullAction string) (q *diskQueue, err error) {
+
+	if fullAction == "" {
+		fullAction = QUEUE_BLOCK
+	}
+	if fullAction != QUEUE_BLOCK && fullAction != QUEUE_DROP_OLDEST {
+		return nil, fmt.Errorf("invalid queue full action: %s", fullAction)
+	}
+	if maxSize <= 0 {
+		maxSize = DEFAULT_QUEUE_MAX_SIZE
+	}
+	if segmentSize <= 0 {
+		segmentSize = DEFAULT_QUEUE_SEGMENT_SIZE
+	}
+	// Need room for at least a few segments or the reader and writer will
+	// end up fighting over a single file.
+	if segmentSize > maxSize/4 {
+		segmentSize = maxSize / 4
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("can't create queue directory: %s", err)
+	}
+
+	q = &diskQueue{
+		dir:         dir,
+		maxSize:     maxSize,
+		segmentSize: segmentSize,
+		fullAction:  fullAction,
+	}
+	q.cond = sync.NewCond(&q.lock)
+	if err = q.loadSegments(); err != nil {
+		return nil, err
+	}
+	if err = q.roll(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Finds the existing segment files and restores the checkpointed read
+// position, removing any segments that were fully consumed.
+func (q *diskQueue) loadSegments() (err error) {
+	var (
+		names []string
+		id    uint64
+		info  os.FileInfo
+	)
+	if names, err = filepath.Glob(filepath.Join(q.dir, "*"+queueSegmentExt)); err != nil {
+		return
+	}
+	for _, name := range names {
+		base := strings.TrimSuffix(filepath.Base(name), queueSegmentExt)
+		if id, err = strconv.ParseUint(base, 10, 64); err != nil {
+			continue
+		}
+		q.segments = append(q.segments, id)
+	}
+	err = nil
+	sort.Sort(uint64Slice(q.segments))
+
+	readId, readPos := q.loadCheckpoint()
+	for len(q.segments) > 0 && q.segments[0] < readId {
+		os.Remove(q.segmentPath(q.segments[0]))
+		q.segments = q.segments[1:]
+	}
+	if len(q.segments) > 0 && q.segments[0] == readId {
+		q.readPos = readPos
+	}
+
+	for _, id = range q.segments {
+		if info, err = os.Stat(q.segmentPath(id)); err != nil {
+			return fmt.Errorf("can't stat queue segment: %s", err)
+		}
+		q.segSizes = append(q.segSizes, info.Size())
+		q.size += info.Size()
+	}
+	return
+}
+
+// Returns the segment id and offset stored in the checkpoint file, if any.
+func (q *diskQueue) loadCheckpoint() (id uint64, pos int64) {
+	contents, err := ioutil.ReadFile(filepath.Join(q.dir, queueCheckpointFile))
+	if err != nil {
+		return
+	}
+	fmt.Sscanf(string(contents), "%d %d", &id, &pos)
+	return
+}
+
+// Records the current read position. Must be called w/ the lock held.
+func (q *diskQueue) saveCheckpoint() (err error) {
+	if len(q.segments) == 0 {
+		return
+	}
+	contents := fmt.Sprintf("%d %d", q.segments[0], q.readPos)
+	path := filepath.Join(q.dir, queueCheckpointFile)
+	if err = ioutil.WriteFile(path+".tmp", []byte(contents), 0600); err != nil {
+		return
+	}
+	q.unsaved = 0
+	return os.Rename(path+".tmp", path)
+}
+
+func (q *diskQueue) segmentPath(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", id, queueSegmentExt))
+}
+
+// Starts a new segment file for writing. Must be called w/ the lock held.
+func (q *diskQueue) roll() (err error) {
+	var id uint64 = 1
+	if len(q.segments) > 0 {
+		id = q.segments[len(q.segments)-1] + 1
+	}
+	var file *os.File
+	flags := os.O_WRONLY | os.O_APPEND | os.O_CREATE | os.O_EXCL
+	if file, err = os.OpenFile(q.segmentPath(id), flags, 0600); err != nil {
+		return fmt.Errorf("can't create queue segment: %s", err)
+	}
+	if q.writer != nil {
+		q.writer.Close()
+	}
+	q.writer = file
+	q.segments = append(q.segments, id)
+	q.segSizes = append(q.segSizes, 0)
+	return
+}
+
+// Deletes the oldest segment, returning false if there's nothing that can be
+// dropped. Must be called w/ the lock held.
+func (q *diskQueue) dropOldest() bool {
+	if len(q.segments) == 1 {
+		if q.segSizes[0] == 0 || q.roll() != nil {
+			return false
+		}
+	}
+	if q.reader != nil {
+		q.reader.Close()
+		q.reader = nil
+	}
+	if file, err := os.Open(q.segmentPath(q.segments[0])); err == nil {
+		q.dropped += countQueueRecords(file, q.readPos)
+		file.Close()
+	}
+	q.removeOldest()
+	return true
+}
+
+// Deletes the oldest segment file and resets the read position to the start
+// of the next one. Must be called w/ the lock held.
+func (q *diskQueue) removeOldest() {
+	os.Remove(q.segmentPath(q.segments[0]))
+	q.size -= q.segSizes[0]
+	q.segments = q.segments[1:]
+	q.segSizes = q.segSizes[1:]
+	q.readPos, q.pending = 0, 0
+	q.saveCheckpoint()
+	q.cond.Broadcast()
+}
+
+// Appends a framed record to the queue. If the queue is full this will
+// either drop the oldest queued records or block until the reader has freed
+// up space, depending on the queue's full action.
+func (q *diskQueue) Push(record []byte) (err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	recordSize := int64(len(record))
+	if recordSize > q.maxSize {
+		return fmt.Errorf("record larger than the queue's max size: %d", q.maxSize)
+	}
+	for !q.closed && q.size+recordSize > q.maxSize {
+		if q.fullAction == QUEUE_DROP_OLDEST {
+			if !q.dropOldest() {
+				break
+			}
+			continue
+		}
+		// Make sure the reader isn't stuck waiting on the write segment.
+		if len(q.segments) == 1 && q.segSizes[0] > 0 {
+			if err = q.roll(); err != nil {
+				return
+			}
+		}
+		q.cond.Wait()
+	}
+	if q.closed {
+		return errQueueClosed
+	}
+	last := len(q.segments) - 1
+	if q.segSizes[last] >= q.segmentSize {
+		if err = q.roll(); err != nil {
+			return
+		}
+		last++
+	}
+	n, err := q.writer.Write(record)
+	q.segSizes[last] += int64(n)
+	q.size += int64(n)
+	q.cond.Broadcast()
+	if err != nil {
+		err = fmt.Errorf("can't write to queue segment: %s", err)
+	}
+	return
+}
+
+// Returns the oldest unconsumed record, blocking until one is available. The
+// record is not consumed until `Advance` is called. Corrupt data is skipped,
+// up to the next record or the end of the segment, after which a
+// *corruptQueueError saying how much was skipped is returned once.
+func (q *diskQueue) Next() (record []byte, err error) {
+	var corruption *corruptQueueError
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for {
+		if q.closed {
+			return nil, errQueueClosed
+		}
+		if q.reader == nil {
+			if q.reader, err = os.Open(q.segmentPath(q.segments[0])); err != nil {
+				return nil, fmt.Errorf("can't open queue segment: %s", err)
+			}
+		}
+		record, err = readQueueRecord(q.reader, q.readPos)
+		if err == nil && corruption == nil {
+			q.pending = int64(len(record))
+			return
+		}
+		if corrupt, ok := err.(*corruptQueueError); ok {
+			if corruption == nil {
+				corruption = corrupt
+			}
+			var skipped int64
+			if skipped, err = q.skipCorruption(); err != nil {
+				return nil, err
+			}
+			corruption.skipped += skipped
+			continue
+		}
+		if corruption != nil {
+			return nil, corruption
+		}
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("can't read queue segment: %s", err)
+		}
+		err = nil
+		if len(q.segments) == 1 {
+			// Caught up w/ the writer.
+			q.cond.Wait()
+			continue
+		}
+		// Done w/ this segment, move on to the next.
+		q.reader.Close()
+		q.reader = nil
+		q.removeOldest()
+	}
+}
+
+// Moves the read position past corrupt data to the next record separator in
+// the current segment that starts a complete record, or to the end of the
+// data written so far. Separator bytes that show up inside of message data
+// are passed over. Returns the number of bytes skipped. Must be called w/ the
+// lock held.
+func (q *diskQueue) skipCorruption() (skipped int64, err error) {
+	buf := make([]byte, 4096)
+	pos := q.readPos + 1
+	for {
+		n, e := q.reader.ReadAt(buf, pos)
+		if i := bytes.IndexByte(buf[:n], message.RECORD_SEPARATOR); i >= 0 {
+			pos += int64(i)
+			if q.recordStartsAt(pos) {
+				break
+			}
+			pos++
+			continue
+		}
+		pos += int64(n)
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			return 0, fmt.Errorf("can't read queue segment: %s", e)
+		}
+	}
+	skipped = pos - q.readPos
+	q.readPos, q.pending = pos, 0
+	return
+}
+
+// Reports whether a complete, non-empty record starts at the given offset and
+// is followed by either another record separator or the end of the data,
+// which rules out most separator bytes that turn up inside of message data.
+// Must be called w/ the lock held.
+func (q *diskQueue) recordStartsAt(offset int64) bool {
+	record, err := readQueueRecord(q.reader, offset)
+	if err != nil || len(record) == 3+int(record[1]) {
+		return false
+	}
+	next := make([]byte, 1)
+	_, err = q.reader.ReadAt(next, offset+int64(len(record)))
+	if err == io.EOF {
+		return true
+	}
+	return err == nil && next[0] == message.RECORD_SEPARATOR
+}
+
+// Consumes the record most recently returned by `Next`.
+func (q *diskQueue) Advance() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.readPos += q.pending
+	q.pending = 0
+	if q.unsaved++; q.unsaved >= queueCheckpointInterval {
+		q.saveCheckpoint()
+	}
+}
+
+// Returns the number of bytes the queue is currently holding on disk.
+func (q *diskQueue) Size() int64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.size
+}
+
+// Returns the number of records that have been dropped because the queue was
+// full.
+func (q *diskQueue) Dropped() int64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.dropped
+}
+
+// Saves the read position and closes the queue's files, waking up any
+// blocked readers or writers.
+func (q *diskQueue) Close() (err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	err = q.saveCheckpoint()
+	q.writer.Close()
+	if q.reader != nil {
+		q.reader.Close()
+	}
+	q.cond.Broadcast()
+	return
+}
+
+// Reads the framed record starting at the given offset.
+func readQueueRecord(file *os.File, offset int64) (record []byte, err error) {
+	prefix := make([]byte, 2)
+	if _, err = file.ReadAt(prefix, offset); err != nil {
+		return
+	}
+	if prefix[0] != message.RECORD_SEPARATOR {
+		return nil, &corruptQueueError{offset: offset,
+			reason: "missing record separator"}
+	}
+	headerEnd := 3 + int(prefix[1])
+	buf := make([]byte, headerEnd)
+	if _, err = file.ReadAt(buf, offset); err != nil {
+		return
+	}
+	header := &message.Header{}
+	if buf[headerEnd-1] != message.UNIT_SEPARATOR {
+		return nil, &corruptQueueError{offset: offset,
+			reason: "missing unit separator"}
+	}
+	if err = proto.Unmarshal(buf[2:headerEnd-1], header); err != nil {
+		return nil, &corruptQueueError{offset: offset,
+			reason: fmt.Sprintf("bad record header: %s", err)}
+	}
+	if header.GetMessageLength() > message.MAX_MESSAGE_SIZE {
+		return nil, &corruptQueueError{offset: offset,
+			reason: "record length exceeds the maximum message size"}
+	}
+	record = make([]byte, headerEnd+int(header.GetMessageLength()))
+	_, err = file.ReadAt(record, offset)
+	return
+}
+
+// Counts the complete records in a segment file from the given offset on.
+func countQueueRecords(file *os.File, offset int64) (count int64) {
+	for {
+		record, err := readQueueRecord(file, offset)
+		if err != nil {
+			return
+		}
+		offset += int64(len(record))
+		count++
+	}
+}
+
+type uint64Slice []uint64
+
+func (s uint64Slice) Len() int           { return len(s) }
+func (s uint64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Encodes the packs the output's matcher hands it and appends them to the
+// disk queue, until the matcher is removed from the router and closes
+// matchChan. Once the queue is closed packs are only recycled, so none are
+// lost from the shared pool.
+func (foRunner *foRunner) spool(matchChan chan *PipelineCapture) {
+	var err error
+	var closed bool
+	outBytes := make([]byte, 0, 2000)
+	for plc := range matchChan {
+		if closed {
+			plc.Pack.Recycle()
+			continue
+		}
+		outBytes = outBytes[:0]
+		err = createProtobufStream(plc.Pack, &outBytes)
+		plc.Pack.Recycle()
+		if err != nil {
+			foRunner.LogError(fmt.Errorf("can't encode message for queue: %s", err))
+			continue
+		}
+		if err = foRunner.queue.Push(outBytes); err != nil {
+			if err == errQueueClosed {
+				closed = true
+				continue
+			}
+			foRunner.LogError(err)
+		}
+	}
+}
+
+// Starts feeding queued records to the output.
+func (foRunner *foRunner) startReplay() {
+	foRunner.replayStop = make(chan bool)
+	foRunner.replayDone = make(chan bool)
+	go foRunner.replay()
+}
+
+// Stops feeding queued records to the output, closes the queue, and waits
+// for the replay goroutine to return, after which the output's input channel
+// can be closed. Records the output hasn't finished w/ stay on disk.
+func (foRunner *foRunner) stopReplay() {
+	if foRunner.replayDone == nil {
+		foRunner.queue.Close()
+		return
+	}
+	foRunner.replayOnce.Do(func() {
+		close(foRunner.replayStop)
+	})
+	foRunner.queue.Close()
+	<-foRunner.replayDone
+}
+
+// Reads records back out of the disk queue and feeds them to the output, one
+// at a time. A record is only consumed once the output has recycled its
+// pack, so records that were in flight when hekad stopped are replayed.
+func (foRunner *foRunner) replay() {
+	defer close(foRunner.replayDone)
+
+	recycleChan := make(chan *PipelinePack, 1)
+	pack := NewPipelinePack(recycleChan)
+	header := &message.Header{}
+	var (
+		record []byte
+		err    error
+		ok     bool
+	)
+	for {
+		if record, err = foRunner.queue.Next(); err != nil {
+			if err == errQueueClosed {
+				return
+			}
+			foRunner.LogError(err)
+			if _, ok = err.(*corruptQueueError); ok {
+				continue // already skipped
+			}
+			select {
+			case <-time.After(time.Second):
+			case <-foRunner.replayStop:
+				return
+			}
+			continue
+		}
+		header.Reset()
+		if _, ok = findMessage(record, header, &pack.MsgBytes); ok {
+			err = proto.Unmarshal(pack.MsgBytes, pack.Message)
+		} else {
+			err = errors.New("malformed record")
+		}
+		if err != nil {
+			foRunner.LogError(fmt.Errorf("dropping queued message: %s", err))
+			pack.Zero()
+			foRunner.queue.Advance()
+			continue
+		}
+		pack.Decoded = true
+		select {
+		case foRunner.inChan <- &PipelineCapture{Pack: pack}:
+		case <-foRunner.replayStop:
+			return
+		}
+		select {
+		case pack = <-recycleChan:
+		case <-foRunner.replayStop:
+			return
+		}
+		foRunner.queue.Advance()
+	}
+}
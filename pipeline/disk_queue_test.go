@@ -0,0 +1,342 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+func DiskQueueSpec(c gs.Context) {
+	NewPipelineConfig(nil) // initializes Globals()
+	tmpDir, err := ioutil.TempDir("", "heka-queue-test")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	// Returns a framed record for a message w/ the given payload.
+	record := func(payload string) []byte {
+		pack := NewPipelinePack(nil)
+		pack.Message = getTestMessage()
+		pack.Message.SetPayload(payload)
+		outBytes := make([]byte, 0, 200)
+		createProtobufStream(pack, &outBytes)
+		return outBytes
+	}
+
+	// Extracts the payload from a framed record.
+	payload := func(rec []byte) string {
+		header := &message.Header{}
+		msgBytes := make([]byte, message.MAX_MESSAGE_SIZE)
+		if _, ok := findMessage(rec, header, &msgBytes); !ok {
+			return "BAD RECORD"
+		}
+		msg := new(message.Message)
+		proto.Unmarshal(msgBytes, msg)
+		return msg.GetPayload()
+	}
+
+	recSize := int64(len(record("0")))
+
+	// Overwrites the byte at the given offset of a segment file.
+	corrupt := func(path string, offset int64) {
+		file, err := os.OpenFile(path, os.O_WRONLY, 0600)
+		c.Assume(err, gs.IsNil)
+		defer file.Close()
+		_, err = file.WriteAt([]byte{0xff}, offset)
+		c.Assume(err, gs.IsNil)
+	}
+
+	c.Specify("A disk queue", func() {
+		q, err := openDiskQueue(tmpDir, 40*recSize, 2*recSize, QUEUE_BLOCK)
+		c.Assume(err, gs.IsNil)
+		defer q.Close()
+
+		c.Specify("returns records in order across segments", func() {
+			for i := 0; i < 5; i++ {
+				c.Expect(q.Push(record(fmt.Sprint(i))), gs.IsNil)
+			}
+			c.Expect(len(q.segments) > 1, gs.IsTrue)
+			for i := 0; i < 5; i++ {
+				rec, err := q.Next()
+				c.Expect(err, gs.IsNil)
+				c.Expect(payload(rec), gs.Equals, fmt.Sprint(i))
+				q.Advance()
+			}
+		})
+
+		c.Specify("only consumes a record once advanced", func() {
+			q.Push(record("0"))
+			q.Push(record("1"))
+			rec, _ := q.Next()
+			c.Expect(payload(rec), gs.Equals, "0")
+			rec, _ = q.Next()
+			c.Expect(payload(rec), gs.Equals, "0")
+			q.Advance()
+			rec, _ = q.Next()
+			c.Expect(payload(rec), gs.Equals, "1")
+		})
+
+		c.Specify("picks up where it left off after a restart", func() {
+			for i := 0; i < 5; i++ {
+				q.Push(record(fmt.Sprint(i)))
+			}
+			for i := 0; i < 3; i++ {
+				q.Next()
+				q.Advance()
+			}
+			c.Expect(q.Close(), gs.IsNil)
+
+			q, err = openDiskQueue(tmpDir, 40*recSize, 2*recSize, QUEUE_BLOCK)
+			c.Assume(err, gs.IsNil)
+			rec, err := q.Next()
+			c.Expect(err, gs.IsNil)
+			c.Expect(payload(rec), gs.Equals, "3")
+			q.Advance()
+			q.Push(record("5"))
+			rec, _ = q.Next()
+			c.Expect(payload(rec), gs.Equals, "4")
+			q.Advance()
+			rec, _ = q.Next()
+			c.Expect(payload(rec), gs.Equals, "5")
+		})
+
+		c.Specify("blocks writers when full", func() {
+			for i := 0; i < 40; i++ {
+				c.Expect(q.Push(record("x")), gs.IsNil)
+			}
+			pushed := make(chan bool)
+			go func() {
+				q.Push(record("last"))
+				close(pushed)
+			}()
+			select {
+			case <-pushed:
+				c.Expect("push", gs.Equals, "blocked")
+			case <-time.After(50 * time.Millisecond):
+			}
+			for i := 0; i < 3; i++ {
+				q.Next()
+				q.Advance()
+			}
+			select {
+			case <-pushed:
+			case <-time.After(time.Second):
+				c.Expect("push", gs.Equals, "unblocked")
+			}
+		})
+
+		c.Specify("skips over corrupt data", func() {
+			for i := 0; i < 3; i++ {
+				q.Push(record(fmt.Sprint(i)))
+			}
+			corrupt(q.segmentPath(q.segments[0]), recSize)
+			rec, err := q.Next()
+			c.Expect(err, gs.IsNil)
+			c.Expect(payload(rec), gs.Equals, "0")
+			q.Advance()
+			_, err = q.Next()
+			corruption, ok := err.(*corruptQueueError)
+			c.Expect(ok, gs.IsTrue)
+			if ok {
+				c.Expect(corruption.skipped, gs.Equals, recSize)
+			}
+			rec, err = q.Next()
+			c.Expect(err, gs.IsNil)
+			c.Expect(payload(rec), gs.Equals, "2")
+		})
+
+		c.Specify("passes over separators inside of corrupt records", func() {
+			// Looks like an empty record if read from the separator on.
+			bogus := "\x1e\x00\x1f"
+			for _, p := range []string{"0", bogus, "2"} {
+				q.Push(record(p))
+			}
+			corrupt(q.segmentPath(q.segments[0]), recSize)
+			rec, err := q.Next()
+			c.Expect(err, gs.IsNil)
+			c.Expect(payload(rec), gs.Equals, "0")
+			q.Advance()
+			_, err = q.Next()
+			corruption, ok := err.(*corruptQueueError)
+			c.Expect(ok, gs.IsTrue)
+			if ok {
+				c.Expect(corruption.skipped, gs.Equals, int64(len(record(bogus))))
+			}
+			rec, err = q.Next()
+			c.Expect(err, gs.IsNil)
+			c.Expect(payload(rec), gs.Equals, "2")
+		})
+
+		c.Specify("rejects an invalid full action", func() {
+			_, err := openDiskQueue(tmpDir, 0, 0, "explode")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("A drop_oldest disk queue", func() {
+		q, err := openDiskQueue(tmpDir, 8*recSize, 2*recSize, QUEUE_DROP_OLDEST)
+		c.Assume(err, gs.IsNil)
+		defer q.Close()
+
+		for i := 0; i < 10; i++ {
+			c.Expect(q.Push(record(fmt.Sprint(i))), gs.IsNil)
+		}
+		c.Expect(q.Dropped(), gs.Equals, int64(2))
+		c.Expect(q.Size() <= 8*recSize, gs.IsTrue)
+		rec, err := q.Next()
+		c.Expect(err, gs.IsNil)
+		c.Expect(payload(rec), gs.Equals, "2")
+	})
+
+	c.Specify("An output runner w/ a disk queue", func() {
+		q, err := openDiskQueue(tmpDir, 0, 0, QUEUE_BLOCK)
+		c.Assume(err, gs.IsNil)
+		runner := NewFORunner("queued", new(LogOutput))
+		runner.queue = q
+		spoolChan := make(chan *PipelineCapture, 1)
+		spooled := make(chan bool)
+		go func() {
+			runner.spool(spoolChan)
+			close(spooled)
+		}()
+		runner.startReplay()
+
+		recycleChan := make(chan *PipelinePack, 1)
+		spool := func(payload string) {
+			pack := NewPipelinePack(recycleChan)
+			pack.Message = getTestMessage()
+			pack.Message.SetPayload(payload)
+			spoolChan <- &PipelineCapture{Pack: pack}
+			select {
+			case <-recycleChan:
+			case <-time.After(time.Second):
+				c.Expect(payload, gs.Equals, "recycled")
+			}
+		}
+		// Returns the next pack fed to the output, or nil if none shows up.
+		replayed := func(wait time.Duration) *PipelinePack {
+			select {
+			case plc := <-runner.InChan():
+				return plc.Pack
+			case <-time.After(wait):
+				return nil
+			}
+		}
+
+		c.Specify("feeds spooled messages to the output", func() {
+			spool("spooled")
+			pack := replayed(time.Second)
+			c.Assume(pack, gs.Not(gs.IsNil))
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "spooled")
+			c.Expect(pack.Decoded, gs.IsTrue)
+			runner.stopReplay()
+		})
+
+		c.Specify("only consumes records the output is done with", func() {
+			spool("first")
+			spool("second")
+			pack := replayed(time.Second)
+			c.Assume(pack, gs.Not(gs.IsNil))
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "first")
+			c.Expect(replayed(50*time.Millisecond), gs.IsNil)
+			pack.Recycle()
+			pack = replayed(time.Second)
+			c.Assume(pack, gs.Not(gs.IsNil))
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "second")
+
+			// Stopping before the output is done leaves the record queued.
+			runner.stopReplay()
+			q, err = openDiskQueue(tmpDir, 0, 0, QUEUE_BLOCK)
+			c.Assume(err, gs.IsNil)
+			defer q.Close()
+			rec, err := q.Next()
+			c.Expect(err, gs.IsNil)
+			c.Expect(payload(rec), gs.Equals, "second")
+		})
+
+		c.Specify("stops while the output isn't reading", func() {
+			for i := 0; i < cap(runner.InChan())+2; i++ {
+				spool(fmt.Sprintf("%d", i))
+			}
+			stopped := make(chan bool)
+			go func() {
+				runner.stopReplay()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-time.After(time.Second):
+				c.Expect("replay", gs.Equals, "stopped")
+			}
+			// No more sends are coming, so closing the channel is safe.
+			close(runner.InChan())
+		})
+
+		c.Specify("recycles packs spooled after the queue is closed", func() {
+			runner.stopReplay()
+			spool("after close")
+			spool("after close")
+			close(spoolChan) // the matcher was removed from the router
+			select {
+			case <-spooled:
+			case <-time.After(time.Second):
+				c.Expect("spool", gs.Equals, "finished")
+			}
+		})
+	})
+
+	c.Specify("An output runner replaying a corrupt disk queue", func() {
+		q, err := openDiskQueue(tmpDir, 0, 0, QUEUE_BLOCK)
+		c.Assume(err, gs.IsNil)
+		for _, p := range []string{"0", "1", "2"} {
+			q.Push(record(p))
+		}
+		// Breaks the second record's header.
+		corrupt(q.segmentPath(q.segments[0]), recSize+2)
+		runner := NewFORunner("queued", new(LogOutput))
+		runner.queue = q
+		runner.startReplay()
+		defer runner.stopReplay()
+
+		for _, p := range []string{"0", "2"} {
+			select {
+			case plc := <-runner.InChan():
+				c.Expect(plc.Pack.Message.GetPayload(), gs.Equals, p)
+				plc.Pack.Recycle()
+			case <-time.After(time.Second):
+				c.Expect(p, gs.Equals, "replayed")
+			}
+		}
+	})
+
+	c.Specify("A match runner started w/ StartClosing", func() {
+		matcher, err := NewMatchRunner("TRUE", "")
+		c.Assume(err, gs.IsNil)
+		matchChan := make(chan *PipelineCapture, 1)
+		matcher.StartClosing(matchChan)
+		close(matcher.inChan) // what the router does when removing it
+		select {
+		case _, ok := <-matchChan:
+			c.Expect(ok, gs.IsFalse)
+		case <-time.After(time.Second):
+			c.Expect("match channel", gs.Equals, "closed")
+		}
+	})
+}
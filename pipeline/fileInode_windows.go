@@ -0,0 +1,32 @@
+//go:build windows
+// +build windows
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"os"
+	"syscall"
+)
+
+// Windows has no inodes, the NTFS file index serves the same purpose.
+func fileInode(fd *os.File) (inode uint64, err error) {
+	var info syscall.ByHandleFileInformation
+	if err = syscall.GetFileInformationByHandle(syscall.Handle(fd.Fd()), &info); err != nil {
+		return
+	}
+	return uint64(info.FileIndexHigh)<<32 | uint64(info.FileIndexLow), nil
+}
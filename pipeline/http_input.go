@@ -0,0 +1,271 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"context"
+	"encoding/json"
+	"fmt"
+	. "github.com/mozilla-services/heka/message"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Input plugin implementation that accepts HTTP POST requests whose body is
+// either a Heka protocol stream (one or more framed records) or a single bare
+// JSON encoded message. Every request is answered with a status code
+// indicating whether or not the posted data was accepted.
+type HttpInput struct {
+	listener net.Listener
+	server   *http.Server
+	// Closed once Stop has shut the server down and in-flight requests have
+	// handed off their packs.
+	stopped chan bool
+	ir      InputRunner
+	h       PluginHelper
+	config  *HttpInputConfig
+}
+
+// ConfigStruct for HttpInput plugin.
+type HttpInputConfig struct {
+	// String representation of the address of the TCP connection on which
+	// the HTTP server should be listening (e.g. "127.0.0.1:8325").
+	Address string `toml:"address"`
+	// Maximum accepted size of a request body, in bytes. Defaults to the
+	// size of a single maximum sized Heka protocol record.
+	MaxBodySize int64 `toml:"max_body_size"`
+	// Set of message signer objects, keyed by signer id string.
+	Signers map[string]Signer `toml:"signer"`
+}
+
+// A single message extracted from a request body, validated and ready to be
+// handed to its decoder.
+type httpRecord struct {
+	msgBytes []byte
+	signer   string
+	decoder  DecoderRunner
+}
+
+// Describes why a request body was rejected and the HTTP status code that
+// should be returned to the client.
+type httpInputError struct {
+	status int
+	msg    string
+}
+
+func (e *httpInputError) Error() string {
+	return e.msg
+}
+
+func newHttpInputError(status int, format string, args ...interface{}) *httpInputError {
+	return &httpInputError{status, fmt.Sprintf(format, args...)}
+}
+
+func (self *HttpInput) ConfigStruct() interface{} {
+	return &HttpInputConfig{
+		Address:     ":8325",
+		MaxBodySize: MAX_MESSAGE_SIZE + MAX_HEADER_SIZE + 3,
+	}
+}
+
+func (self *HttpInput) Init(config interface{}) error {
+	var err error
+	self.config = config.(*HttpInputConfig)
+	self.listener, err = net.Listen("tcp", self.config.Address)
+	if err != nil {
+		return fmt.Errorf("ListenTCP failed: %s\n", err.Error())
+	}
+	self.server = &http.Server{
+		Handler:      self,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	self.stopped = make(chan bool)
+	return nil
+}
+
+func (self *HttpInput) Run(ir InputRunner, h PluginHelper) (err error) {
+	self.ir = ir
+	self.h = h
+	if err = self.server.Serve(self.listener); err == http.ErrServerClosed {
+		// Stop was called, this is a clean shutdown. Don't return until
+		// in-flight requests have handed off their packs.
+		<-self.stopped
+		err = nil
+	}
+	return
+}
+
+// Closes the listener along w/ any idle kept-alive connections, and waits for
+// in-flight requests to finish before closing their connections, too, so no
+// packs are delivered once Stop returns.
+func (self *HttpInput) Stop() {
+	self.server.Shutdown(context.Background())
+	close(self.stopped)
+}
+
+// Handles a single POST request, delivering the contained message(s) to the
+// appropriate decoders only if the entire body is valid.
+func (self *HttpInput) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "only POST requests are accepted",
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	maxSize := self.config.MaxBodySize
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxSize+1))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading request body: %s", err),
+			http.StatusBadRequest)
+		return
+	}
+	if int64(len(body)) > maxSize {
+		http.Error(w, fmt.Sprintf("request body exceeds the maximum size (bytes): %d",
+			maxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var records []httpRecord
+	var e *httpInputError
+	if len(body) > 0 && body[0] == RECORD_SEPARATOR {
+		records, e = self.streamRecords(body)
+	} else {
+		records, e = self.jsonRecord(body)
+	}
+	if e != nil {
+		http.Error(w, e.msg, e.status)
+		return
+	}
+
+	var pack *PipelinePack
+	packSupply := self.ir.InChan()
+	for _, record := range records {
+		pack = <-packSupply
+		pack.MsgBytes = pack.MsgBytes[:len(record.msgBytes)]
+		copy(pack.MsgBytes, record.msgBytes)
+		pack.Signer = record.signer
+		record.decoder.InChan() <- pack
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Extracts and authenticates every framed record in a Heka protocol stream.
+// Fails if any record is incomplete, can't be authenticated, uses an encoding
+// for which no decoder is registered, or doesn't hold a decodable message.
+func (self *HttpInput) streamRecords(body []byte) (records []httpRecord,
+	e *httpInputError) {
+
+	var (
+		scanPos, posDelta int
+		ok                bool
+		decoder           DecoderRunner
+	)
+	header := &Header{}
+	// Scratch pack used only to hold message bytes for authentication and
+	// decoding checks.
+	check := &PipelinePack{MsgBytes: make([]byte, MAX_MESSAGE_SIZE),
+		Message: new(Message)}
+	decoders := self.h.DecoderSet()
+
+	for scanPos < len(body) {
+		posDelta, ok = findMessage(body[scanPos:], header, &check.MsgBytes)
+		if !ok {
+			if oversizedRecord(body[scanPos:]) {
+				return nil, newHttpInputError(http.StatusRequestEntityTooLarge,
+					"message exceeds the maximum length (bytes): %d", MAX_MESSAGE_SIZE)
+			}
+			return nil, newHttpInputError(http.StatusBadRequest,
+				"malformed or incomplete Heka record at byte %d", scanPos)
+		}
+		scanPos += posDelta
+		if !authenticateMessage(self.config.Signers, header, check) {
+			return nil, newHttpInputError(http.StatusUnauthorized,
+				"message signature could not be verified")
+		}
+		encoding := header.GetMessageEncoding()
+		if decoder, ok = decoders.ByEncoding(encoding); !ok {
+			return nil, newHttpInputError(http.StatusUnsupportedMediaType,
+				"no decoder available for encoding: %s", encoding)
+		}
+		if !decodable(encoding, check) {
+			return nil, newHttpInputError(http.StatusBadRequest,
+				"undecodable message in Heka record ending at byte %d", scanPos)
+		}
+		records = append(records, httpRecord{
+			msgBytes: body[scanPos-len(check.MsgBytes) : scanPos],
+			signer:   check.Signer,
+			decoder:  decoder,
+		})
+		check.Signer = ""
+		header.Reset()
+	}
+	return
+}
+
+// Returns true if the buffer starts w/ a record whose header declares a
+// message longer than MAX_MESSAGE_SIZE, which findMessage rejects the same
+// way it does malformed records.
+func oversizedRecord(buf []byte) bool {
+	if len(buf) < 2 || buf[0] != RECORD_SEPARATOR {
+		return false
+	}
+	headerEnd := int(buf[1]) + 3 // recsep+len+header+unitsep
+	if len(buf) < headerEnd || buf[headerEnd-1] != UNIT_SEPARATOR {
+		return false
+	}
+	header := &Header{}
+	if err := proto.Unmarshal(buf[2:headerEnd-1], header); err != nil {
+		return false
+	}
+	return header.GetMessageLength() > MAX_MESSAGE_SIZE
+}
+
+// Returns true if the pack's message bytes can be decoded as a message using
+// the given encoding, leaving the result in the pack's Message.
+func decodable(encoding Header_MessageEncoding, pack *PipelinePack) bool {
+	pack.Message.Reset()
+	if encoding == Header_JSON {
+		return json.Unmarshal(pack.MsgBytes, pack.Message) == nil
+	}
+	return proto.Unmarshal(pack.MsgBytes, pack.Message) == nil
+}
+
+// Wraps a bare JSON message body as a single record for the JSON decoder.
+func (self *HttpInput) jsonRecord(body []byte) (records []httpRecord,
+	e *httpInputError) {
+
+	if len(body) > MAX_MESSAGE_SIZE {
+		return nil, newHttpInputError(http.StatusRequestEntityTooLarge,
+			"message exceeds the maximum length (bytes): %d", MAX_MESSAGE_SIZE)
+	}
+	check := &PipelinePack{MsgBytes: body, Message: new(Message)}
+	if !decodable(Header_JSON, check) {
+		return nil, newHttpInputError(http.StatusBadRequest,
+			"request body is neither a Heka stream nor a JSON encoded message")
+	}
+	decoder, ok := self.h.DecoderSet().ByEncoding(Header_JSON)
+	if !ok {
+		return nil, newHttpInputError(http.StatusUnsupportedMediaType,
+			"no decoder available for encoding: %s", Header_JSON)
+	}
+	records = []httpRecord{{msgBytes: body, decoder: decoder}}
+	return
+}
@@ -20,15 +20,19 @@ import (
 	"crypto/hmac"
 	"crypto/md5"
 	"crypto/sha1"
+	"crypto/tls"
 	"fmt"
 	. "github.com/mozilla-services/heka/message"
 	"hash"
+	"io"
 	"log"
 	"net"
 	"os"
+	"os/user"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Heka PluginRunner for Input plugins.
@@ -78,26 +82,42 @@ func (ir *iRunner) Start(h PluginHelper, wg *sync.WaitGroup) (err error) {
 	ir.h = h
 	ir.inChan = h.PipelineConfig().inputRecycleChan
 	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				// Panics in separate goroutines that are spun up by the input
-				// will still bring the process down, but this protects us at
-				// least a little bit. :P
-				ir.LogError(fmt.Errorf("PANIC: %s", r))
-			}
-			wg.Done()
-		}()
+		defer wg.Done()
 
-		// ir.Input().Run() shouldn't return unless error or shutdown
-		if err = ir.Input().Run(ir, h); err != nil {
-			err = fmt.Errorf("Input '%s' error: %s", ir.name, err)
-		} else {
-			ir.LogMessage("stopped")
+		var runErr error
+		setPlugin := func(plugin Plugin) {
+			ir.plugin = plugin
+			ir.input = plugin.(Input)
+		}
+		for {
+			ir.lastStart = time.Now()
+			if runErr = ir.run(h); runErr != nil {
+				ir.LogError(runErr)
+			} else {
+				ir.LogMessage("stopped")
+			}
+			if !ir.restartPlugin(h, ir, runErr, setPlugin) {
+				break
+			}
 		}
 	}()
 	return
 }
 
+// Calls the input's `Run` method, which shouldn't return unless there's an
+// error or we're shutting down. Panics are returned as errors.
+func (ir *iRunner) run(h PluginHelper) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			// Panics in separate goroutines that are spun up by the input
+			// will still bring the process down, but this protects us at
+			// least a little bit. :P
+			err = fmt.Errorf("PANIC: %s", r)
+		}
+	}()
+	return ir.Input().Run(ir, h)
+}
+
 func (ir *iRunner) Inject(pack *PipelinePack) {
 	ir.h.PipelineConfig().router.InChan() <- pack
 }
@@ -121,22 +141,129 @@ type Input interface {
 	Stop()
 }
 
+// Splits a "unix:" or "unixgram:" prefixed listener address into the unix
+// network type and the socket's path. Returns ok == false for other
+// addresses.
+func unixSocketAddress(address string) (network, path string, ok bool) {
+	for _, network = range []string{"unix", "unixgram"} {
+		if strings.HasPrefix(address, network+":") {
+			return network, address[len(network)+1:], true
+		}
+	}
+	return "", "", false
+}
+
+// Removes a socket file left behind by an earlier listener so the path can be
+// bound again. Anything that isn't a socket is left alone.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// Applies the configured file mode (an octal string, e.g. "0660"), owner and
+// group (names or numeric ids) to a newly created unix socket. Empty values
+// leave the defaults in place.
+func setSocketPermissions(path, mode, owner, group string) (err error) {
+	if mode != "" {
+		var perm uint64
+		if perm, err = strconv.ParseUint(mode, 8, 32); err != nil {
+			return fmt.Errorf("invalid socket mode '%s': %s", mode, err)
+		}
+		if err = os.Chmod(path, os.FileMode(perm)&os.ModePerm); err != nil {
+			return fmt.Errorf("can't set socket mode: %s", err)
+		}
+	}
+	if owner == "" && group == "" {
+		return
+	}
+	uid, gid := -1, -1
+	if owner != "" {
+		if uid, err = strconv.Atoi(owner); err != nil {
+			var u *user.User
+			if u, err = user.Lookup(owner); err != nil {
+				return fmt.Errorf("unknown socket owner '%s': %s", owner, err)
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+	if group != "" {
+		if gid, err = strconv.Atoi(group); err != nil {
+			var g *user.Group
+			if g, err = user.LookupGroup(group); err != nil {
+				return fmt.Errorf("unknown socket group '%s': %s", group, err)
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	if err = os.Chown(path, uid, gid); err != nil {
+		return fmt.Errorf("can't set socket ownership: %s", err)
+	}
+	return
+}
+
+// Creates a unix socket listener of the given network type, replacing any
+// stale socket at the path and applying the configured permissions. Returns
+// a *net.UnixListener for "unix" and a *net.UnixConn for "unixgram". If
+// permissions are configured the socket starts out accessible only by its
+// owner, so nobody else can connect before they're applied.
+func listenUnix(network, path, mode, owner, group string) (
+	listener io.Closer, err error) {
+
+	if err = removeStaleSocket(path); err != nil {
+		return nil, fmt.Errorf("can't remove stale socket: %s", err)
+	}
+	addr := &net.UnixAddr{Name: path, Net: network}
+	listen := func() error {
+		if network == "unixgram" {
+			listener, err = net.ListenUnixgram(network, addr)
+		} else {
+			listener, err = net.ListenUnix(network, addr)
+		}
+		return err
+	}
+	if mode != "" || owner != "" || group != "" {
+		err = withPrivateUmask(listen)
+	} else {
+		err = listen()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Listen on %s socket failed: %s", network, err)
+	}
+	if err = setSocketPermissions(path, mode, owner, group); err != nil {
+		listener.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return
+}
+
 // Input plugin implementation that listens for Heka protocol messages on a
 // specified UDP socket.
 type UdpInput struct {
 	listener net.Conn
 	name     string
-	stopped  bool
+	stopChan chan bool
 	config   *UdpInputConfig
+	// Path of the unix datagram socket, if listening on one.
+	socketPath string
 }
 
 // ConfigStruct for UdpInput plugin.
 type UdpInputConfig struct {
 	// String representation of the address of the UDP connection on which
-	// the listener should be listening (e.g. "127.0.0.1:5565").
+	// the listener should be listening (e.g. "127.0.0.1:5565"), a file
+	// descriptor (e.g. "fd:3"), or a unix datagram socket path (e.g.
+	// "unixgram:/var/run/hekad.sock").
 	Address string `toml:"address"`
 	// Set of message signer objects, keyed by signer id string.
 	Signers map[string]Signer `toml:"signer"`
+	// File mode (in octal), owner, and group of a unix socket.
+	SocketMode  string `toml:"socket_mode"`
+	SocketOwner string `toml:"socket_owner"`
+	SocketGroup string `toml:"socket_group"`
 }
 
 func (self *UdpInput) ConfigStruct() interface{} {
@@ -145,7 +272,19 @@ func (self *UdpInput) ConfigStruct() interface{} {
 
 func (self *UdpInput) Init(config interface{}) error {
 	self.config = config.(*UdpInputConfig)
-	if len(self.config.Address) > 3 && self.config.Address[:3] == "fd:" {
+	if network, path, ok := unixSocketAddress(self.config.Address); ok {
+		if network != "unixgram" {
+			return fmt.Errorf("UdpInput needs a datagram socket, use unixgram:%s",
+				path)
+		}
+		listener, err := listenUnix(network, path, self.config.SocketMode,
+			self.config.SocketOwner, self.config.SocketGroup)
+		if err != nil {
+			return err
+		}
+		self.listener = listener.(net.Conn)
+		self.socketPath = path
+	} else if len(self.config.Address) > 3 && self.config.Address[:3] == "fd:" {
 		// File descriptor
 		fdStr := self.config.Address[3:]
 		fdInt, err := strconv.ParseUint(fdStr, 0, 0)
@@ -170,6 +309,7 @@ func (self *UdpInput) Init(config interface{}) error {
 			return fmt.Errorf("ListenUDP failed: %s\n", err.Error())
 		}
 	}
+	self.stopChan = make(chan bool)
 	return nil
 }
 
@@ -182,8 +322,13 @@ func (self *UdpInput) Run(ir InputRunner, h PluginHelper) (err error) {
 	var n int
 	var pack *PipelinePack
 	var msgOk bool
-	for !self.stopped {
-		pack = <-ir.InChan()
+	for {
+		select {
+		case <-self.stopChan:
+			self.listener.Close()
+			return
+		case pack = <-ir.InChan():
+		}
 		if n, e = self.listener.Read(buf); e != nil {
 			if !strings.Contains(e.Error(), "use of closed") {
 				ir.LogError(fmt.Errorf("Read error: ", e))
@@ -208,14 +353,16 @@ func (self *UdpInput) Run(ir InputRunner, h PluginHelper) (err error) {
 		}
 		header.Reset()
 	}
-
-	self.listener.Close()
-	return
 }
 
 func (self *UdpInput) Stop() {
-	self.stopped = true
+	close(self.stopChan)
 	self.listener.Close()
+	if self.socketPath != "" {
+		// Unlike stream listeners, datagram sockets don't clean up after
+		// themselves.
+		os.Remove(self.socketPath)
+	}
 }
 
 // Input plugin implementation that listens for Heka protocol messages on a
@@ -238,10 +385,19 @@ type Signer struct {
 // ConfigStruct for TcpInput plugin.
 type TcpInputConfig struct {
 	// String representation of the address of the TCP connection on which
-	// the listener should be listening (e.g. "127.0.0.1:5565").
+	// the listener should be listening (e.g. "127.0.0.1:5565"), or a unix
+	// stream socket path (e.g. "unix:/var/run/hekad.sock").
 	Address string
 	// Set of message signer objects, keyed by signer id string.
 	Signers map[string]Signer `toml:"signer"`
+	// Set to true if the listener should only accept TLS connections.
+	UseTls bool `toml:"use_tls"`
+	// TLS settings, used only if UseTls is true.
+	Tls TlsConfig `toml:"tls"`
+	// File mode (in octal), owner, and group of a unix socket.
+	SocketMode  string `toml:"socket_mode"`
+	SocketOwner string `toml:"socket_owner"`
+	SocketGroup string `toml:"socket_group"`
 }
 
 func (self *TcpInput) ConfigStruct() interface{} {
@@ -273,7 +429,7 @@ func decodeHeader(buf []byte, header *Header) bool {
 func findMessage(buf []byte, header *Header, message *[]byte) (pos int, ok bool) {
 	pos = bytes.IndexByte(buf, RECORD_SEPARATOR)
 	if pos != -1 {
-		if len(buf) > 1 {
+		if len(buf) > pos+1 {
 			headerLength := int(buf[pos+1])
 			headerEnd := pos + headerLength + 3 // recsep+len+header+unitsep
 			if len(buf) >= headerEnd {
@@ -343,8 +499,19 @@ func (self *TcpInput) handleConnection(conn net.Conn) {
 		encoding                   Header_MessageEncoding
 		decoder                    DecoderRunner
 		ok, stopped                bool
+		acker                      *batchAcker
+		ack                        func()
 	)
 
+	certSubject, err := tlsCertSubject(conn)
+	if err != nil {
+		self.ir.LogError(fmt.Errorf("TLS handshake with %s failed: %s",
+			conn.RemoteAddr(), err))
+		conn.Close()
+		self.wg.Done()
+		return
+	}
+
 	packSupply := self.ir.InChan()
 	decoders := self.h.DecoderSet()
 
@@ -369,15 +536,28 @@ func (self *TcpInput) handleConnection(conn net.Conn) {
 						break
 					}
 					if ok {
-						if authenticateMessage(self.config.Signers, header, pack) {
-							encoding = header.GetMessageEncoding()
-							if decoder, ok = decoders.ByEncoding(encoding); ok {
-								decoder.InChan() <- pack
-							} else {
-								pack.Recycle()
+						ack = nil
+						if header.GetBatchSize() > 0 {
+							if acker == nil {
+								acker = newBatchAcker(conn)
 							}
+							ack = acker.AckFunc(header.GetBatchSequence(),
+								header.GetBatchSize())
+						}
+						if ok = authenticateMessage(self.config.Signers, header, pack); ok {
+							encoding = header.GetMessageEncoding()
+							decoder, ok = decoders.ByEncoding(encoding)
+						}
+						if ok {
+							pack.CertSubject = certSubject
+							pack.Ack = ack
+							decoder.InChan() <- pack
 						} else {
 							pack.Recycle()
+							if ack != nil {
+								// Undeliverable, retransmitting won't help.
+								ack()
+							}
 						}
 					} else {
 						pack.Recycle()
@@ -402,6 +582,9 @@ func (self *TcpInput) handleConnection(conn net.Conn) {
 			}
 		}
 	}
+	if acker != nil {
+		acker.Stop()
+	}
 	conn.Close()
 	self.wg.Done()
 }
@@ -409,9 +592,30 @@ func (self *TcpInput) handleConnection(conn net.Conn) {
 func (self *TcpInput) Init(config interface{}) error {
 	var err error
 	self.config = config.(*TcpInputConfig)
-	self.listener, err = net.Listen("tcp", self.config.Address)
-	if err != nil {
-		return fmt.Errorf("ListenTCP failed: %s\n", err.Error())
+	if network, path, ok := unixSocketAddress(self.config.Address); ok {
+		if network != "unix" {
+			return fmt.Errorf("TcpInput needs a stream socket, use unix:%s", path)
+		}
+		var listener io.Closer
+		listener, err = listenUnix(network, path, self.config.SocketMode,
+			self.config.SocketOwner, self.config.SocketGroup)
+		if err != nil {
+			return err
+		}
+		self.listener = listener.(net.Listener)
+	} else {
+		self.listener, err = net.Listen("tcp", self.config.Address)
+		if err != nil {
+			return fmt.Errorf("ListenTCP failed: %s\n", err.Error())
+		}
+	}
+	if self.config.UseTls {
+		var goTlsConfig *tls.Config
+		if goTlsConfig, err = self.config.Tls.ServerConfig(); err != nil {
+			self.listener.Close()
+			return fmt.Errorf("TLS init failed: %s", err)
+		}
+		self.listener = tls.NewListener(self.listener, goTlsConfig)
 	}
 	return nil
 }
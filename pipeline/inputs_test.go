@@ -15,21 +15,36 @@
 package pipeline
 
 import (
+	"bufio"
+	"bytes"
 	"code.google.com/p/gomock/gomock"
 	"code.google.com/p/goprotobuf/proto"
+	"compress/gzip"
 	"crypto/hmac"
 	"crypto/md5"
 	"crypto/sha1"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/client"
 	"github.com/mozilla-services/heka/message"
 	ts "github.com/mozilla-services/heka/testsupport"
 	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -100,7 +115,7 @@ func InputsSpec(c gs.Context) {
 
 	c.Specify("A UdpInput", func() {
 		udpInput := UdpInput{}
-		err := udpInput.Init(&UdpInputConfig{ith.AddrStr, signers})
+		err := udpInput.Init(&UdpInputConfig{Address: ith.AddrStr, Signers: signers})
 		c.Assume(err, gs.IsNil)
 		realListener := (udpInput.listener).(*net.UDPConn)
 		c.Expect(realListener.LocalAddr().String(), gs.Equals, ith.ResolvedAddrStr)
@@ -188,7 +203,7 @@ func InputsSpec(c gs.Context) {
 
 	c.Specify("A TcpInput", func() {
 		tcpInput := TcpInput{}
-		err := tcpInput.Init(&TcpInputConfig{ith.AddrStr, signers})
+		err := tcpInput.Init(&TcpInputConfig{Address: ith.AddrStr, Signers: signers})
 		c.Assume(err, gs.IsNil)
 		realListener := tcpInput.listener
 		c.Expect(realListener.Addr().String(), gs.Equals, ith.ResolvedAddrStr)
@@ -359,6 +374,998 @@ func InputsSpec(c gs.Context) {
 		})
 	})
 
+	c.Specify("A TcpInput receiving acked batches", func() {
+		tcpInput := TcpInput{}
+		err := tcpInput.Init(&TcpInputConfig{Address: ith.AddrStr})
+		c.Assume(err, gs.IsNil)
+
+		mockDecoderRunner := ith.Decoders[message.Header_PROTOCOL_BUFFER].(*MockDecoderRunner)
+		mockDecoderRunner.EXPECT().InChan().Return(ith.DecodeChan).Times(2)
+		ith.MockInputRunner.EXPECT().InChan().Return(ith.PackSupply)
+		ith.MockHelper.EXPECT().DecoderSet().Return(ith.MockDecoderSet)
+		pbcall := ith.MockDecoderSet.EXPECT().ByEncoding(message.Header_PROTOCOL_BUFFER)
+		pbcall.Return(mockDecoderRunner, true).Times(2)
+
+		go tcpInput.Run(ith.MockInputRunner, ith.MockHelper)
+		defer tcpInput.Stop()
+
+		conn, err := net.Dial("tcp", ith.AddrStr)
+		c.Assume(err, gs.IsNil)
+		defer conn.Close()
+
+		mbytes, _ := proto.Marshal(ith.Msg)
+		data, err := encodeAckBatch(42, [][]byte{mbytes, mbytes})
+		c.Assume(err, gs.IsNil)
+		_, err = conn.Write(data)
+		c.Assume(err, gs.IsNil)
+
+		pack2 := NewPipelinePack(ith.Pack.RecycleChan)
+		ith.PackSupply <- ith.Pack
+		ith.PackSupply <- pack2
+		packs := []*PipelinePack{<-ith.DecodeChan, <-ith.DecodeChan}
+		c.Expect(packs[0].Ack, gs.Not(gs.IsNil))
+		c.Expect(packs[1].Ack, gs.Not(gs.IsNil))
+
+		c.Specify("acks the batch once every record is delivered", func() {
+			packs[0].Ack()
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			ackBytes := make([]byte, ACK_SIZE)
+			_, err = conn.Read(ackBytes)
+			c.Expect(err, gs.Not(gs.IsNil)) // timeout, batch incomplete
+
+			packs[1].Ack()
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = io.ReadFull(conn, ackBytes)
+			c.Expect(err, gs.IsNil)
+			c.Expect(binary.BigEndian.Uint64(ackBytes), gs.Equals, uint64(42))
+		})
+	})
+
+	c.Specify("A TLS TcpInput", func() {
+		tlsConf := TlsConfig{
+			CertFile:          "../testsupport/tls/server.pem",
+			KeyFile:           "../testsupport/tls/server.key",
+			CaFile:            "../testsupport/tls/ca.pem",
+			RequireClientCert: true,
+		}
+		clientTlsConf := TlsConfig{
+			CertFile: "../testsupport/tls/client.pem",
+			KeyFile:  "../testsupport/tls/client.key",
+			CaFile:   "../testsupport/tls/ca.pem",
+		}
+
+		c.Specify("fails to init with bad TLS settings", func() {
+			tcpInput := TcpInput{}
+			tlsConf.MinVersion = "SSL3"
+			err := tcpInput.Init(&TcpInputConfig{Address: ith.AddrStr, UseTls: true,
+				Tls: tlsConf})
+			c.Expect(err, gs.Not(gs.IsNil))
+
+			tlsConf.MinVersion = ""
+			tlsConf.CaFile = ""
+			err = tcpInput.Init(&TcpInputConfig{Address: ith.AddrStr, UseTls: true,
+				Tls: tlsConf})
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("records the verified client cert subject", func() {
+			tcpInput := TcpInput{}
+			err := tcpInput.Init(&TcpInputConfig{Address: ith.AddrStr,
+				Signers: signers, UseTls: true, Tls: tlsConf})
+			c.Assume(err, gs.IsNil)
+
+			mockDecoderRunner := ith.Decoders[message.Header_PROTOCOL_BUFFER].(*MockDecoderRunner)
+			mockDecoderRunner.EXPECT().InChan().Return(ith.DecodeChan)
+			ith.MockInputRunner.EXPECT().InChan().Return(ith.PackSupply)
+			ith.MockHelper.EXPECT().DecoderSet().Return(ith.MockDecoderSet)
+			pbcall := ith.MockDecoderSet.EXPECT().ByEncoding(message.Header_PROTOCOL_BUFFER)
+			pbcall.Return(mockDecoderRunner, true)
+
+			go tcpInput.Run(ith.MockInputRunner, ith.MockHelper)
+			defer tcpInput.Stop()
+
+			goTlsConfig, err := clientTlsConf.ClientConfig()
+			c.Assume(err, gs.IsNil)
+			conn, err := tls.Dial("tcp", ith.AddrStr, goTlsConfig)
+			c.Assume(err, gs.IsNil)
+			defer conn.Close()
+
+			mbytes, _ := proto.Marshal(ith.Msg)
+			header := &message.Header{}
+			header.SetMessageLength(uint32(len(mbytes)))
+			hbytes, _ := proto.Marshal(header)
+			buf := make([]byte, 3+len(hbytes)+len(mbytes))
+			getPayloadBytes(hbytes, mbytes)(buf)
+			_, err = conn.Write(buf)
+			c.Assume(err, gs.IsNil)
+
+			ith.PackSupply <- ith.Pack
+			timeout := make(chan bool, 1)
+			go func() {
+				time.Sleep(500 * time.Millisecond)
+				timeout <- true
+			}()
+			select {
+			case packRef := <-ith.DecodeChan:
+				c.Expect(ith.Pack, gs.Equals, packRef)
+				c.Expect(string(ith.Pack.MsgBytes), gs.Equals, string(mbytes))
+				c.Expect(ith.Pack.CertSubject, gs.Equals, "CN=heka-client,O=Heka Test")
+			case t := <-timeout:
+				c.Expect(t, gs.IsNil)
+			}
+		})
+
+		c.Specify("drops clients that don't complete the handshake", func() {
+			defer func(timeout time.Duration) {
+				tlsHandshakeTimeout = timeout
+			}(tlsHandshakeTimeout)
+			tlsHandshakeTimeout = 50 * time.Millisecond
+			tcpInput := TcpInput{}
+			err := tcpInput.Init(&TcpInputConfig{Address: ith.AddrStr,
+				UseTls: true, Tls: tlsConf})
+			c.Assume(err, gs.IsNil)
+			logged := make(chan bool, 1)
+			logCall := ith.MockInputRunner.EXPECT().LogError(gomock.Any())
+			logCall.Do(func(err error) {
+				logged <- true
+			})
+
+			go tcpInput.Run(ith.MockInputRunner, ith.MockHelper)
+			defer tcpInput.Stop()
+
+			conn, err := net.Dial("tcp", ith.AddrStr)
+			c.Assume(err, gs.IsNil)
+			defer conn.Close()
+			select {
+			case <-logged:
+			case <-time.After(time.Second):
+				c.Expect(false, gs.IsTrue)
+			}
+			// The server side of the connection has been closed.
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = conn.Read(make([]byte, 1))
+			c.Expect(err, gs.Equals, io.EOF)
+		})
+	})
+
+	c.Specify("A HttpInput", func() {
+		httpInput := HttpInput{}
+		httpConfig := httpInput.ConfigStruct().(*HttpInputConfig)
+		httpConfig.Address = ith.AddrStr
+		httpConfig.Signers = signers
+		err := httpInput.Init(httpConfig)
+		c.Assume(err, gs.IsNil)
+		c.Expect(httpInput.listener.Addr().String(), gs.Equals, ith.ResolvedAddrStr)
+		httpInput.listener.Close()
+		httpInput.ir = ith.MockInputRunner
+		httpInput.h = ith.MockHelper
+
+		mockDecoderRunner := ith.Decoders[message.Header_PROTOCOL_BUFFER].(*MockDecoderRunner)
+		mockDecoderRunner.EXPECT().InChan().Return(ith.DecodeChan).AnyTimes()
+		ith.MockInputRunner.EXPECT().InChan().Return(ith.PackSupply).AnyTimes()
+		ith.MockHelper.EXPECT().DecoderSet().Return(ith.MockDecoderSet).AnyTimes()
+
+		mbytes, _ := proto.Marshal(ith.Msg)
+		header := &message.Header{}
+		header.SetMessageLength(uint32(len(mbytes)))
+
+		post := func(body []byte) (recorder *httptest.ResponseRecorder) {
+			recorder = httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/", bytes.NewReader(body))
+			httpInput.ServeHTTP(recorder, req)
+			return
+		}
+
+		streamBytes := func() []byte {
+			hbytes, _ := proto.Marshal(header)
+			buf := make([]byte, 3+len(hbytes)+len(mbytes))
+			getPayloadBytes(hbytes, mbytes)(buf)
+			return buf
+		}
+
+		c.Specify("passes a posted Heka stream to the decoder", func() {
+			pbcall := ith.MockDecoderSet.EXPECT().ByEncoding(message.Header_PROTOCOL_BUFFER)
+			pbcall.Return(mockDecoderRunner, true)
+			ith.PackSupply <- ith.Pack
+			respChan := make(chan int)
+			go func() {
+				respChan <- post(streamBytes()).Code
+			}()
+			packRef := <-ith.DecodeChan
+			c.Expect(ith.Pack, gs.Equals, packRef)
+			c.Expect(string(ith.Pack.MsgBytes), gs.Equals, string(mbytes))
+			c.Expect(<-respChan, gs.Equals, http.StatusOK)
+		})
+
+		c.Specify("passes a signed Heka stream to the decoder", func() {
+			pbcall := ith.MockDecoderSet.EXPECT().ByEncoding(message.Header_PROTOCOL_BUFFER)
+			pbcall.Return(mockDecoderRunner, true)
+			header.SetHmacHashFunction(message.Header_SHA1)
+			header.SetHmacSigner(signer)
+			header.SetHmacKeyVersion(uint32(1))
+			hm := hmac.New(sha1.New, []byte(key))
+			hm.Write(mbytes)
+			header.SetHmac(hm.Sum(nil))
+			ith.PackSupply <- ith.Pack
+			respChan := make(chan int)
+			go func() {
+				respChan <- post(streamBytes()).Code
+			}()
+			packRef := <-ith.DecodeChan
+			c.Expect(ith.Pack, gs.Equals, packRef)
+			c.Expect(ith.Pack.Signer, gs.Equals, "test")
+			c.Expect(<-respChan, gs.Equals, http.StatusOK)
+		})
+
+		c.Specify("passes a posted JSON message to the decoder", func() {
+			jsonDecoderRunner := ith.Decoders[message.Header_JSON].(*MockDecoderRunner)
+			jsonDecoderRunner.EXPECT().InChan().Return(ith.DecodeChan)
+			jcall := ith.MockDecoderSet.EXPECT().ByEncoding(message.Header_JSON)
+			jcall.Return(jsonDecoderRunner, true)
+			jbytes, _ := json.Marshal(ith.Msg)
+			ith.PackSupply <- ith.Pack
+			respChan := make(chan int)
+			go func() {
+				respChan <- post(jbytes).Code
+			}()
+			packRef := <-ith.DecodeChan
+			c.Expect(ith.Pack, gs.Equals, packRef)
+			c.Expect(string(ith.Pack.MsgBytes), gs.Equals, string(jbytes))
+			c.Expect(<-respChan, gs.Equals, http.StatusOK)
+		})
+
+		c.Specify("rejects a message with an incorrect hmac", func() {
+			header.SetHmacHashFunction(message.Header_MD5)
+			header.SetHmacSigner(signer)
+			header.SetHmacKeyVersion(uint32(1))
+			hm := hmac.New(md5.New, []byte(key))
+			hm.Write([]byte("some bytes"))
+			header.SetHmac(hm.Sum(nil))
+			c.Expect(post(streamBytes()).Code, gs.Equals, http.StatusUnauthorized)
+		})
+
+		c.Specify("rejects an incomplete Heka stream", func() {
+			buf := streamBytes()
+			c.Expect(post(buf[:len(buf)-1]).Code, gs.Equals, http.StatusBadRequest)
+		})
+
+		c.Specify("rejects a Heka record that's too large", func() {
+			header.SetMessageLength(uint32(message.MAX_MESSAGE_SIZE + 1))
+			c.Expect(post(streamBytes()).Code, gs.Equals,
+				http.StatusRequestEntityTooLarge)
+		})
+
+		c.Specify("rejects a body that isn't valid JSON", func() {
+			c.Expect(post([]byte("{bogus")).Code, gs.Equals, http.StatusBadRequest)
+		})
+
+		c.Specify("rejects JSON that isn't a message", func() {
+			c.Expect(post([]byte("[1, 2]")).Code, gs.Equals, http.StatusBadRequest)
+		})
+
+		c.Specify("rejects a Heka record that can't be decoded", func() {
+			pbcall := ith.MockDecoderSet.EXPECT().ByEncoding(message.Header_PROTOCOL_BUFFER)
+			pbcall.Return(mockDecoderRunner, true)
+			mbytes = []byte{0xff, 0xff, 0xff}
+			header.SetMessageLength(uint32(len(mbytes)))
+			c.Expect(post(streamBytes()).Code, gs.Equals, http.StatusBadRequest)
+		})
+
+		c.Specify("rejects an oversized body", func() {
+			body := make([]byte, httpConfig.MaxBodySize+1)
+			c.Expect(post(body).Code, gs.Equals, http.StatusRequestEntityTooLarge)
+		})
+
+		c.Specify("rejects non-POST requests", func() {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/", nil)
+			httpInput.ServeHTTP(recorder, req)
+			c.Expect(recorder.Code, gs.Equals, http.StatusMethodNotAllowed)
+		})
+
+		c.Specify("stops serving kept-alive connections when stopped", func() {
+			ith.MockDecoderSet.EXPECT().ByEncoding(message.Header_PROTOCOL_BUFFER).Return(
+				mockDecoderRunner, true).AnyTimes()
+			httpInput.listener, err = net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			url := fmt.Sprintf("http://%s/", httpInput.listener.Addr())
+			runDone := make(chan bool)
+			go func() {
+				httpInput.Run(ith.MockInputRunner, ith.MockHelper)
+				close(runDone)
+			}()
+
+			client := &http.Client{Timeout: 5 * time.Second}
+			errChan := make(chan error, 1)
+			postAsync := func() {
+				go func() {
+					resp, err := client.Post(url, "application/octet-stream",
+						bytes.NewReader(streamBytes()))
+					if err == nil {
+						resp.Body.Close()
+					}
+					errChan <- err
+				}()
+			}
+			ith.PackSupply <- ith.Pack
+			postAsync()
+			<-ith.DecodeChan
+			c.Expect(<-errChan, gs.IsNil)
+
+			httpInput.Stop()
+			select {
+			case <-runDone:
+			case <-time.After(time.Second):
+				c.Expect("Run returned", gs.Equals, "Run blocked")
+			}
+			ith.PackSupply <- ith.Pack
+			postAsync()
+			select {
+			case <-ith.DecodeChan:
+				c.Expect("pack delivered", gs.Equals, "connection closed")
+			case err = <-errChan:
+				c.Expect(err, gs.Not(gs.IsNil))
+			}
+		})
+	})
+
+	c.Specify("An AdminInput", func() {
+		adminInput := AdminInput{}
+		adminConfig := adminInput.ConfigStruct().(*AdminInputConfig)
+		adminConfig.Address = ith.AddrStr
+
+		c.Specify("requires a shared secret or signer", func() {
+			err := adminInput.Init(adminConfig)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		adminConfig.SharedSecret = "s3cret"
+		adminConfig.Signers = signers
+		err := adminInput.Init(adminConfig)
+		c.Assume(err, gs.IsNil)
+		adminInput.listener.Close()
+		adminInput.ir = ith.MockInputRunner
+		adminInput.h = config
+		ith.MockInputRunner.EXPECT().LogMessage(gomock.Any()).AnyTimes()
+		handler := adminInput.handler()
+
+		fRunner := NewFORunner("counter", new(CounterFilter))
+		fRunner.matcher, err = NewMatchRunner("TRUE", "")
+		c.Assume(err, gs.IsNil)
+		config.FilterRunners["counter"] = fRunner
+		config.router.Start()
+		defer close(config.router.InChan())
+
+		request := func(method, uri string) (req *http.Request) {
+			req, _ = http.NewRequest(method, uri, bytes.NewReader(nil))
+			req.Header.Set("Authorization", "Bearer s3cret")
+			return
+		}
+		serve := func(req *http.Request) (recorder *httptest.ResponseRecorder) {
+			recorder = httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			return
+		}
+		sign := func(req *http.Request, timestamp time.Time) {
+			ts := strconv.FormatInt(timestamp.Unix(), 10)
+			hm := hmac.New(sha1.New, []byte(key))
+			hm.Write([]byte(AdminSigningString(req.Method, req.URL.RequestURI(), ts)))
+			req.Header.Set("X-Heka-Timestamp", ts)
+			req.Header.Set("X-Heka-Hmac-Signer", signer)
+			req.Header.Set("X-Heka-Hmac-Key-Version", "1")
+			req.Header.Set("X-Heka-Hmac-Hash-Function", "SHA1")
+			req.Header.Set("X-Heka-Hmac", hex.EncodeToString(hm.Sum(nil)))
+		}
+
+		c.Specify("rejects unauthorized requests", func() {
+			req := request("GET", "/plugins")
+			req.Header.Set("Authorization", "Bearer wrong")
+			c.Expect(serve(req).Code, gs.Equals, http.StatusUnauthorized)
+		})
+
+		c.Specify("lists running plugins as JSON", func() {
+			recorder := serve(request("GET", "/plugins"))
+			c.Expect(recorder.Code, gs.Equals, http.StatusOK)
+			var plugins map[string][]map[string]interface{}
+			err := json.Unmarshal(recorder.Body.Bytes(), &plugins)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(plugins["filters"]), gs.Equals, 1)
+			if len(plugins["filters"]) == 1 {
+				c.Expect(plugins["filters"][0]["Plugin"], gs.Equals, "counter")
+				c.Expect(plugins["filters"][0]["InChanCapacity"], gs.Equals,
+					float64(Globals().PluginChanSize))
+			}
+		})
+
+		c.Specify("accepts requests signed w/ a signer key", func() {
+			req, _ := http.NewRequest("GET", "/globals", bytes.NewReader(nil))
+			sign(req, time.Now())
+			recorder := serve(req)
+			c.Expect(recorder.Code, gs.Equals, http.StatusOK)
+			var globals GlobalConfigStruct
+			err := json.Unmarshal(recorder.Body.Bytes(), &globals)
+			c.Expect(err, gs.IsNil)
+			c.Expect(globals.PoolSize, gs.Equals, Globals().PoolSize)
+		})
+
+		c.Specify("rejects replayed signed requests", func() {
+			req, _ := http.NewRequest("GET", "/globals", bytes.NewReader(nil))
+			sign(req, time.Now())
+			c.Expect(serve(req).Code, gs.Equals, http.StatusOK)
+			replay, _ := http.NewRequest("GET", "/globals", bytes.NewReader(nil))
+			replay.Header = req.Header
+			c.Expect(serve(replay).Code, gs.Equals, http.StatusUnauthorized)
+		})
+
+		c.Specify("rejects requests w/ a stale signature", func() {
+			req, _ := http.NewRequest("GET", "/globals", bytes.NewReader(nil))
+			sign(req, time.Now().Add(-time.Hour))
+			c.Expect(serve(req).Code, gs.Equals, http.StatusUnauthorized)
+		})
+
+		c.Specify("stops a running plugin", func() {
+			c.Expect(serve(request("GET", "/plugins/counter/stop")).Code, gs.Equals,
+				http.StatusMethodNotAllowed)
+			c.Expect(serve(request("POST", "/plugins/counter/stop")).Code, gs.Equals,
+				http.StatusOK)
+			c.Expect(serve(request("GET", "/plugins/counter")).Code, gs.Equals,
+				http.StatusNotFound)
+			c.Expect(serve(request("POST", "/plugins/counter/stop")).Code, gs.Equals,
+				http.StatusNotFound)
+		})
+
+		c.Specify("won't start a plugin that's already running", func() {
+			c.Expect(serve(request("POST", "/plugins/counter/start")).Code, gs.Equals,
+				http.StatusConflict)
+		})
+
+		c.Specify("streams tapped messages until the client disconnects", func() {
+			adminInput.stopChan = make(chan bool)
+			server := httptest.NewServer(handler)
+			defer server.Close()
+			req, _ := http.NewRequest("GET",
+				server.URL+"/tap?matcher=Type+%3D%3D+%27TEST%27", nil)
+			req.Header.Set("Authorization", "Bearer s3cret")
+			resp, err := http.DefaultClient.Do(req)
+			c.Assume(err, gs.IsNil)
+			c.Expect(resp.StatusCode, gs.Equals, http.StatusOK)
+
+			lines := make(chan string, 1)
+			go func() {
+				line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+				lines <- line
+			}()
+			var line string
+			packSupply := make(chan *PipelinePack, 100)
+			for i := 0; i < 100 && line == ""; i++ {
+				pack := NewPipelinePack(packSupply)
+				pack.Message = getTestMessage()
+				config.router.InChan() <- pack
+				select {
+				case line = <-lines:
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+			var msg message.Message
+			c.Expect(json.Unmarshal([]byte(line), &msg), gs.IsNil)
+			c.Expect(msg.GetType(), gs.Equals, "TEST")
+
+			resp.Body.Close()
+			for i := 0; i < 100 && atomic.LoadInt32(&adminInput.taps) > 0; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			c.Expect(atomic.LoadInt32(&adminInput.taps), gs.Equals, int32(0))
+		})
+
+		c.Specify("rejects bad tap requests", func() {
+			c.Expect(serve(request("GET", "/tap")).Code, gs.Equals,
+				http.StatusBadRequest)
+			c.Expect(serve(request("GET", "/tap?matcher=Type+%3D")).Code,
+				gs.Equals, http.StatusBadRequest)
+			c.Expect(serve(request("GET", "/tap?matcher=TRUE&format=xml")).Code,
+				gs.Equals, http.StatusBadRequest)
+			adminConfig.MaxTaps = 0
+			c.Expect(serve(request("GET", "/tap?matcher=TRUE")).Code, gs.Equals,
+				http.StatusServiceUnavailable)
+		})
+
+		c.Specify("validates message matchers", func() {
+			validate := func(spec string) (result map[string]interface{}) {
+				req, _ := http.NewRequest("POST", "/matchers/validate",
+					strings.NewReader(spec))
+				req.Header.Set("Authorization", "Bearer s3cret")
+				recorder := serve(req)
+				c.Expect(recorder.Code, gs.Equals, http.StatusOK)
+				json.Unmarshal(recorder.Body.Bytes(), &result)
+				return
+			}
+			result := validate("Type == 'TEST'")
+			c.Expect(result["valid"], gs.Equals, true)
+			result = validate("Type = 'TEST'")
+			c.Expect(result["valid"], gs.Equals, false)
+			diagnostics, _ := result["diagnostics"].([]interface{})
+			c.Expect(len(diagnostics), gs.Equals, 1)
+			if len(diagnostics) == 1 {
+				diag := diagnostics[0].(map[string]interface{})
+				c.Expect(diag["Pos"], gs.Equals, float64(5))
+			}
+		})
+	})
+
+	c.Specify("An input listening on a unix socket", func() {
+		tmpDir, err := ioutil.TempDir("", "heka-unix-test")
+		c.Assume(err, gs.IsNil)
+		defer os.RemoveAll(tmpDir)
+		sockPath := filepath.Join(tmpDir, "hekad.sock")
+
+		mockDecoderRunner := ith.Decoders[message.Header_PROTOCOL_BUFFER].(*MockDecoderRunner)
+		mockDecoderRunner.EXPECT().InChan().AnyTimes().Return(ith.DecodeChan)
+		ith.MockInputRunner.EXPECT().InChan().AnyTimes().Return(ith.PackSupply)
+		ith.MockHelper.EXPECT().DecoderSet().AnyTimes().Return(ith.MockDecoderSet)
+		pbcall := ith.MockDecoderSet.EXPECT().ByEncoding(message.Header_PROTOCOL_BUFFER)
+		pbcall.AnyTimes().Return(mockDecoderRunner, true)
+
+		var stream []byte
+		encoder := client.NewProtobufEncoder(nil)
+		err = encoder.EncodeMessageStream(ith.Msg, &stream)
+		c.Assume(err, gs.IsNil)
+		mbytes, _ := proto.Marshal(ith.Msg)
+
+		// Sends the test message to the socket and waits for it to be decoded.
+		received := func(network, addr string) bool {
+			sender, err := client.NewNetworkSender(network, addr)
+			c.Assume(err, gs.IsNil)
+			defer sender.Close()
+			err = sender.SendMessage(stream)
+			c.Assume(err, gs.IsNil)
+			ith.PackSupply <- ith.Pack
+			select {
+			case pack := <-ith.DecodeChan:
+				return string(pack.MsgBytes) == string(mbytes)
+			case <-time.After(time.Second):
+				return false
+			}
+		}
+
+		// Waits for the input's Run method to return after it was stopped.
+		finished := make(chan error, 1)
+		stopped := func() bool {
+			select {
+			case <-finished:
+				return true
+			case <-time.After(time.Second):
+				return false
+			}
+		}
+
+		c.Specify("w/ a UdpInput", func() {
+			udpInput := new(UdpInput)
+			config := udpInput.ConfigStruct().(*UdpInputConfig)
+			config.Address = "unixgram:" + sockPath
+			config.SocketMode = "0600"
+			err := udpInput.Init(config)
+			c.Assume(err, gs.IsNil)
+			info, err := os.Stat(sockPath)
+			c.Assume(err, gs.IsNil)
+			c.Expect(info.Mode()&os.ModeSocket != 0, gs.IsTrue)
+			c.Expect(info.Mode().Perm(), gs.Equals, os.FileMode(0600))
+
+			go func() {
+				finished <- udpInput.Run(ith.MockInputRunner, ith.MockHelper)
+			}()
+			c.Expect(received("udp", "unixgram:"+sockPath), gs.IsTrue)
+			udpInput.Stop()
+			c.Expect(stopped(), gs.IsTrue)
+			_, err = os.Stat(sockPath)
+			c.Expect(os.IsNotExist(err), gs.IsTrue)
+		})
+
+		c.Specify("w/ a TcpInput", func() {
+			tcpInput := new(TcpInput)
+			config := tcpInput.ConfigStruct().(*TcpInputConfig)
+			config.Address = "unix:" + sockPath
+			config.SocketMode = "0660"
+			config.SocketOwner = strconv.Itoa(os.Getuid())
+			err := tcpInput.Init(config)
+			c.Assume(err, gs.IsNil)
+			info, err := os.Stat(sockPath)
+			c.Assume(err, gs.IsNil)
+			c.Expect(info.Mode().Perm(), gs.Equals, os.FileMode(0660))
+
+			go func() {
+				finished <- tcpInput.Run(ith.MockInputRunner, ith.MockHelper)
+			}()
+			c.Expect(received("tcp", "unix:"+sockPath), gs.IsTrue)
+			tcpInput.Stop()
+			// The connection handler wants a pack before it sees the EOF.
+			ith.PackSupply <- ith.Pack
+			c.Expect(stopped(), gs.IsTrue)
+			_, err = os.Stat(sockPath)
+			c.Expect(os.IsNotExist(err), gs.IsTrue)
+		})
+
+		c.Specify("leaves the umask alone once the socket is created", func() {
+			fileMode := func(name string) os.FileMode {
+				path := filepath.Join(tmpDir, name)
+				err := ioutil.WriteFile(path, []byte("data"), 0666)
+				c.Assume(err, gs.IsNil)
+				info, err := os.Stat(path)
+				c.Assume(err, gs.IsNil)
+				return info.Mode().Perm()
+			}
+			before := fileMode("before")
+			listener, err := listenUnix("unix", sockPath, "0666", "", "")
+			c.Assume(err, gs.IsNil)
+			defer listener.Close()
+			info, err := os.Stat(sockPath)
+			c.Assume(err, gs.IsNil)
+			c.Expect(info.Mode().Perm(), gs.Equals, os.FileMode(0666))
+			c.Expect(fileMode("after"), gs.Equals, before)
+		})
+
+		c.Specify("replaces a stale socket", func() {
+			stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: sockPath, Net: "unix"})
+			c.Assume(err, gs.IsNil)
+			stale.SetUnlinkOnClose(false)
+			stale.Close()
+			tcpInput := new(TcpInput)
+			err = tcpInput.Init(&TcpInputConfig{Address: "unix:" + sockPath})
+			c.Expect(err, gs.IsNil)
+			if err == nil {
+				tcpInput.listener.Close()
+			}
+		})
+
+		c.Specify("won't overwrite a regular file", func() {
+			err := ioutil.WriteFile(sockPath, []byte("data"), 0644)
+			c.Assume(err, gs.IsNil)
+			udpInput := new(UdpInput)
+			err = udpInput.Init(&UdpInputConfig{Address: "unixgram:" + sockPath})
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects the wrong kind of socket", func() {
+			udpInput := new(UdpInput)
+			err := udpInput.Init(&UdpInputConfig{Address: "unix:" + sockPath})
+			c.Expect(err, gs.Not(gs.IsNil))
+			tcpInput := new(TcpInput)
+			err = tcpInput.Init(&TcpInputConfig{Address: "unixgram:" + sockPath})
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects an invalid socket mode", func() {
+			tcpInput := new(TcpInput)
+			err := tcpInput.Init(&TcpInputConfig{Address: "unix:" + sockPath,
+				SocketMode: "rw-rw----"})
+			c.Expect(err, gs.Not(gs.IsNil))
+			_, err = os.Stat(sockPath)
+			c.Expect(os.IsNotExist(err), gs.IsTrue)
+		})
+	})
+
+	c.Specify("A SyslogInput", func() {
+		msg := new(message.Message)
+		now := time.Date(2013, time.May, 1, 12, 0, 0, 0, time.Local)
+		fieldValue := func(name string) interface{} {
+			if field := msg.FindFirstField(name); field != nil {
+				return field.GetValue()
+			}
+			return nil
+		}
+
+		c.Specify("parses RFC5424 messages", func() {
+			parseSyslog(`<165>1 2013-05-01T10:14:15.003Z mymachine.example.com `+
+				`evntslog 123 ID47 [exampleSDID@32473 iut="3" eventSource=`+
+				`"App\"lication\]"][examplePriority@32473 class="high"] `+
+				"\xef\xbb\xbfAn application event log entry...", msg, now)
+			c.Expect(msg.GetSeverity(), gs.Equals, int32(5))
+			c.Expect(fieldValue("facility"), gs.Equals, int64(20))
+			expected := time.Date(2013, time.May, 1, 10, 14, 15, 3000000, time.UTC)
+			c.Expect(msg.GetTimestamp(), gs.Equals, expected.UnixNano())
+			c.Expect(msg.GetHostname(), gs.Equals, "mymachine.example.com")
+			c.Expect(msg.GetLogger(), gs.Equals, "evntslog")
+			c.Expect(msg.GetPid(), gs.Equals, int32(123))
+			c.Expect(fieldValue("msgid"), gs.Equals, "ID47")
+			c.Expect(fieldValue("exampleSDID@32473.iut"), gs.Equals, "3")
+			c.Expect(fieldValue("exampleSDID@32473.eventSource"), gs.Equals,
+				"App\"lication]")
+			c.Expect(fieldValue("examplePriority@32473.class"), gs.Equals, "high")
+			c.Expect(msg.GetPayload(), gs.Equals, "An application event log entry...")
+		})
+
+		c.Specify("parses RFC5424 messages w/ NILVALUEs", func() {
+			parseSyslog("<34>1 - - - - - -", msg, now)
+			c.Expect(msg.GetSeverity(), gs.Equals, int32(2))
+			c.Expect(msg.GetTimestamp(), gs.Equals, now.UnixNano())
+			c.Expect(msg.GetHostname(), gs.Equals, "")
+			c.Expect(msg.GetLogger(), gs.Equals, "")
+			c.Expect(msg.GetPayload(), gs.Equals, "")
+		})
+
+		c.Specify("parses RFC3164 messages", func() {
+			parseSyslog("<34>Apr 30 22:14:15 mymachine su[42]: 'su root' failed",
+				msg, now)
+			c.Expect(msg.GetSeverity(), gs.Equals, int32(2))
+			c.Expect(fieldValue("facility"), gs.Equals, int64(4))
+			expected := time.Date(2013, time.April, 30, 22, 14, 15, 0, time.Local)
+			c.Expect(msg.GetTimestamp(), gs.Equals, expected.UnixNano())
+			c.Expect(msg.GetHostname(), gs.Equals, "mymachine")
+			c.Expect(msg.GetLogger(), gs.Equals, "su")
+			c.Expect(msg.GetPid(), gs.Equals, int32(42))
+			c.Expect(msg.GetPayload(), gs.Equals, "'su root' failed")
+		})
+
+		c.Specify("parses RFC3164 messages w/o a hostname from last year", func() {
+			parseSyslog("<13>Dec 31 23:59:59 cron: job done", msg, now)
+			expected := time.Date(2012, time.December, 31, 23, 59, 59, 0, time.Local)
+			c.Expect(msg.GetTimestamp(), gs.Equals, expected.UnixNano())
+			c.Expect(msg.GetHostname(), gs.Equals, "")
+			c.Expect(msg.GetLogger(), gs.Equals, "cron")
+			c.Expect(msg.GetPayload(), gs.Equals, "job done")
+		})
+
+		c.Specify("keeps unparseable messages in the payload", func() {
+			parseSyslog("just some text", msg, now)
+			c.Expect(msg.GetSeverity(), gs.Equals, int32(5))
+			c.Expect(msg.GetTimestamp(), gs.Equals, now.UnixNano())
+			c.Expect(msg.GetPayload(), gs.Equals, "just some text")
+		})
+
+		c.Specify("only takes digits as the PRI", func() {
+			for _, pri := range []string{"<-13>", "<+13>", "< 13>"} {
+				msg = new(message.Message)
+				parseSyslog(pri+"just some text", msg, now)
+				c.Expect(msg.GetSeverity(), gs.Equals, int32(5))
+				c.Expect(fieldValue("facility"), gs.Equals, int64(1))
+				c.Expect(msg.GetPayload(), gs.Equals, pri+"just some text")
+			}
+		})
+
+		c.Specify("listening on a socket", func() {
+			packSupply := make(chan *PipelinePack, 10)
+			for i := 0; i < 10; i++ {
+				packSupply <- NewPipelinePack(packSupply)
+			}
+			injected := make(chan *PipelinePack, 10)
+			ith.MockInputRunner.EXPECT().InChan().AnyTimes().Return(packSupply)
+			injectCall := ith.MockInputRunner.EXPECT().Inject(gomock.Any())
+			injectCall.AnyTimes().Do(func(pack *PipelinePack) {
+				injected <- pack
+			})
+			syslogInput := new(SyslogInput)
+			syslogConfig := syslogInput.ConfigStruct().(*SyslogInputConfig)
+			// Returns the payloads of the next n messages injected.
+			payloads := func(n int) (payloads []string) {
+				for len(payloads) < n {
+					select {
+					case pack := <-injected:
+						c.Expect(pack.Decoded, gs.IsTrue)
+						c.Expect(pack.Message.GetType(), gs.Equals, "syslog")
+						payloads = append(payloads, pack.Message.GetPayload())
+					case <-time.After(time.Second):
+						return
+					}
+				}
+				return
+			}
+
+			c.Specify("over UDP", func() {
+				syslogConfig.Address = "127.0.0.1:55514"
+				err := syslogInput.Init(syslogConfig)
+				c.Assume(err, gs.IsNil)
+				go syslogInput.Run(ith.MockInputRunner, ith.MockHelper)
+				defer syslogInput.Stop()
+				conn, err := net.Dial("udp", syslogConfig.Address)
+				c.Assume(err, gs.IsNil)
+				defer conn.Close()
+				conn.Write([]byte("<13>May  1 12:00:00 app: hi\n"))
+				msgs := payloads(1)
+				c.Expect(len(msgs), gs.Equals, 1)
+				if len(msgs) == 1 {
+					c.Expect(msgs[0], gs.Equals, "hi")
+				}
+			})
+
+			c.Specify("over TCP w/ both kinds of framing", func() {
+				syslogConfig.Net = "tcp"
+				syslogConfig.Address = "127.0.0.1:55514"
+				err := syslogInput.Init(syslogConfig)
+				c.Assume(err, gs.IsNil)
+				go syslogInput.Run(ith.MockInputRunner, ith.MockHelper)
+				defer syslogInput.Stop()
+				conn, err := net.Dial("tcp", syslogConfig.Address)
+				c.Assume(err, gs.IsNil)
+				defer conn.Close()
+				conn.Write([]byte("<13>1 - - - - - - one\n" +
+					"27 <13>1 - - - - - - two\nlines" +
+					"<13>1 - - - - - - three\r\n"))
+				msgs := payloads(3)
+				c.Expect(len(msgs), gs.Equals, 3)
+				if len(msgs) == 3 {
+					c.Expect(msgs[0], gs.Equals, "one")
+					c.Expect(msgs[1], gs.Equals, "two\nlines")
+					c.Expect(msgs[2], gs.Equals, "three")
+				}
+			})
+
+			c.Specify("over a unix datagram socket", func() {
+				tmpDir, err := ioutil.TempDir("", "heka-syslog-test")
+				c.Assume(err, gs.IsNil)
+				defer os.RemoveAll(tmpDir)
+				syslogConfig.Net = "unixgram"
+				syslogConfig.Address = filepath.Join(tmpDir, "log")
+				syslogConfig.SocketMode = "0622"
+				err = syslogInput.Init(syslogConfig)
+				c.Assume(err, gs.IsNil)
+				info, err := os.Stat(syslogConfig.Address)
+				c.Assume(err, gs.IsNil)
+				c.Expect(info.Mode().Perm(), gs.Equals, os.FileMode(0622))
+				go syslogInput.Run(ith.MockInputRunner, ith.MockHelper)
+				defer syslogInput.Stop()
+				conn, err := net.Dial("unixgram", syslogConfig.Address)
+				c.Assume(err, gs.IsNil)
+				defer conn.Close()
+				conn.Write([]byte("<13>May  1 12:00:00 app: hi"))
+				msgs := payloads(1)
+				c.Expect(len(msgs), gs.Equals, 1)
+				if len(msgs) == 1 {
+					c.Expect(msgs[0], gs.Equals, "hi")
+				}
+			})
+		})
+	})
+
+	c.Specify("A ProcessInput", func() {
+		packSupply := make(chan *PipelinePack, 10)
+		for i := 0; i < 10; i++ {
+			packSupply <- NewPipelinePack(packSupply)
+		}
+		injected := make(chan *PipelinePack, 10)
+		ith.MockInputRunner.EXPECT().InChan().AnyTimes().Return(packSupply)
+		injectCall := ith.MockInputRunner.EXPECT().Inject(gomock.Any())
+		injectCall.AnyTimes().Do(func(pack *PipelinePack) {
+			injected <- pack
+		})
+		processInput := new(ProcessInput)
+		config := processInput.ConfigStruct().(*ProcessInputConfig)
+		config.Command = "/bin/sh"
+		config.TickerInterval = 60
+
+		// Returns the next injected message, or nil if there isn't one.
+		next := func() *message.Message {
+			select {
+			case pack := <-injected:
+				c.Expect(pack.Decoded, gs.IsTrue)
+				msg := pack.Message // recycling gives the pack a new message
+				pack.Recycle()
+				return msg
+			case <-time.After(5 * time.Second):
+				return nil
+			}
+		}
+		// Returns the messages injected for one run of the command, mapping
+		// each stream to its payloads, and the exit message.
+		run := func() (output map[string][]string, exit *message.Message) {
+			output = make(map[string][]string)
+			for msg := next(); msg != nil; msg = next() {
+				c.Expect(msg.GetLogger(), gs.Equals, "sh")
+				if msg.GetType() == "process_exit" {
+					return output, msg
+				}
+				c.Expect(msg.GetType(), gs.Equals, "process")
+				stream := msg.FindFirstField("stream").GetValue().(string)
+				output[stream] = append(output[stream], msg.GetPayload())
+			}
+			return
+		}
+		finished := make(chan error, 1)
+		start := func() {
+			err := processInput.Init(config)
+			c.Assume(err, gs.IsNil)
+			go func() {
+				finished <- processInput.Run(ith.MockInputRunner, ith.MockHelper)
+			}()
+		}
+		stop := func() (stopped bool) {
+			processInput.Stop()
+			select {
+			case <-finished:
+				return true
+			case <-time.After(5 * time.Second):
+				return false
+			}
+		}
+
+		c.Specify("injects a command's output and exit status", func() {
+			config.Args = []string{"-c", "echo one; echo two >&2; echo three; exit 3"}
+			start()
+			output, exit := run()
+			c.Expect(stop(), gs.IsTrue)
+			c.Expect(len(output["stdout"]), gs.Equals, 2)
+			c.Expect(len(output["stderr"]), gs.Equals, 1)
+			if len(output["stdout"]) == 2 && len(output["stderr"]) == 1 {
+				c.Expect(output["stdout"][0], gs.Equals, "one\n")
+				c.Expect(output["stdout"][1], gs.Equals, "three\n")
+				c.Expect(output["stderr"][0], gs.Equals, "two\n")
+			}
+			c.Assume(exit, gs.Not(gs.IsNil))
+			c.Expect(exit.FindFirstField("exit_status").GetValue(), gs.Equals, int64(3))
+			c.Expect(exit.FindFirstField("timed_out").GetValue(), gs.IsFalse)
+			runtime := exit.FindFirstField("runtime").GetValue().(float64)
+			c.Expect(runtime > 0, gs.IsTrue)
+		})
+
+		c.Specify("runs a command w/ its environment and directory", func() {
+			tmpDir, err := ioutil.TempDir("", "heka-process-test")
+			c.Assume(err, gs.IsNil)
+			defer os.RemoveAll(tmpDir)
+			tmpDir, _ = filepath.EvalSymlinks(tmpDir)
+			config.Args = []string{"-c", "echo $HEKA_TEST; pwd"}
+			config.Env = []string{"HEKA_TEST=ok"}
+			config.Directory = tmpDir
+			start()
+			output, exit := run()
+			c.Expect(stop(), gs.IsTrue)
+			c.Assume(len(output["stdout"]), gs.Equals, 2)
+			c.Expect(output["stdout"][0], gs.Equals, "ok\n")
+			c.Expect(output["stdout"][1], gs.Equals, tmpDir+"\n")
+			c.Assume(exit, gs.Not(gs.IsNil))
+			c.Expect(exit.FindFirstField("exit_status").GetValue(), gs.Equals, int64(0))
+		})
+
+		c.Specify("groups output lines into records", func() {
+			config.Args = []string{"-c", "printf 'a\\n b\\n c\\nd\\ne'"}
+			config.RecordStartRegex = `^\S`
+			start()
+			output, _ := run()
+			c.Expect(stop(), gs.IsTrue)
+			c.Assume(len(output["stdout"]), gs.Equals, 3)
+			c.Expect(output["stdout"][0], gs.Equals, "a\n b\n c\n")
+			c.Expect(output["stdout"][1], gs.Equals, "d\n")
+			c.Expect(output["stdout"][2], gs.Equals, "e")
+		})
+
+		c.Specify("kills a command that runs too long", func() {
+			config.Args = []string{"-c", "sleep 30 & wait"}
+			config.Timeout = 1
+			start()
+			_, exit := run()
+			c.Expect(stop(), gs.IsTrue)
+			c.Assume(exit, gs.Not(gs.IsNil))
+			c.Expect(exit.FindFirstField("timed_out").GetValue(), gs.IsTrue)
+			c.Expect(exit.FindFirstField("exit_status").GetValue(), gs.Equals, int64(-1))
+		})
+
+		c.Specify("kills the command's process group when stopped", func() {
+			// The backgrounded sleep would keep the output open, and Run
+			// from returning, if it survived.
+			config.Args = []string{"-c", "sleep 30 & echo started; wait"}
+			config.TickerInterval = 0
+			start()
+			msg := next()
+			c.Assume(msg, gs.Not(gs.IsNil))
+			c.Expect(msg.GetPayload(), gs.Equals, "started\n")
+			c.Expect(stop(), gs.IsTrue)
+		})
+
+		c.Specify("returns an error when a long-running command exits", func() {
+			config.Args = []string{"-c", "exit 0"}
+			config.TickerInterval = 0
+			start()
+			select {
+			case err := <-finished:
+				c.Expect(err, gs.Not(gs.IsNil))
+			case <-time.After(5 * time.Second):
+				c.Expect(false, gs.IsTrue)
+			}
+		})
+
+		c.Specify("requires a command", func() {
+			err := processInput.Init(&ProcessInputConfig{})
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
 	c.Specify("Runner recovers from panic in input's `Run()` method", func() {
 		input := new(PanicInput)
 		iRunner := NewInputRunner("panic", input)
@@ -412,4 +1419,453 @@ func InputsSpec(c gs.Context) {
 			}
 		})
 	})
+
+	c.Specify("A LogfileInput w/ a seek journal", func() {
+		tmpDir, err := ioutil.TempDir("", "heka-journal-test")
+		c.Assume(err, gs.IsNil)
+		defer os.RemoveAll(tmpDir)
+		logPath := filepath.Join(tmpDir, "test.log")
+		journalDir := filepath.Join(tmpDir, "journal")
+
+		writeLines := func(flag int, lines ...string) {
+			file, err := os.OpenFile(logPath, flag|os.O_WRONLY|os.O_CREATE, 0644)
+			c.Assume(err, gs.IsNil)
+			for _, line := range lines {
+				file.WriteString(line + "\n")
+			}
+			file.Close()
+		}
+
+		// Starts an input on the log file and returns the first n lines it
+		// reads, stopping it again afterward.
+		readLines := func(n int) (lines []string) {
+			lfInput := new(LogfileInput)
+			lfiConfig := lfInput.ConfigStruct().(*LogfileInputConfig)
+			lfiConfig.LogFiles = []string{logPath}
+			lfiConfig.DiscoverInterval = 1
+			lfiConfig.StatInterval = 1
+			lfiConfig.SeekJournal = journalDir
+			err := lfInput.Init(lfiConfig)
+			c.Assume(err, gs.IsNil)
+			defer lfInput.Stop()
+			for len(lines) < n {
+				select {
+				case logline := <-lfInput.Monitor.NewLines:
+					lines = append(lines, logline.Line)
+				case <-time.After(time.Second):
+					return
+				}
+			}
+			return
+		}
+
+		writeLines(os.O_TRUNC, "one", "two")
+		lines := readLines(2)
+		c.Assume(len(lines), gs.Equals, 2)
+
+		c.Specify("resumes from the saved offset", func() {
+			writeLines(os.O_APPEND, "three")
+			lines = readLines(1)
+			c.Expect(len(lines), gs.Equals, 1)
+			c.Expect(lines[0], gs.Equals, "three\n")
+		})
+
+		c.Specify("starts over if the file was replaced", func() {
+			err := os.Remove(logPath)
+			c.Assume(err, gs.IsNil)
+			writeLines(os.O_TRUNC, "uno", "dos", "tres")
+			lines = readLines(1)
+			c.Expect(len(lines), gs.Equals, 1)
+			c.Expect(lines[0], gs.Equals, "uno\n")
+		})
+	})
+
+	c.Specify("A LogfileInput searching for files", func() {
+		tmpDir, err := ioutil.TempDir("", "heka-search-test")
+		c.Assume(err, gs.IsNil)
+		defer os.RemoveAll(tmpDir)
+		err = os.Mkdir(filepath.Join(tmpDir, "sub"), 0755)
+		c.Assume(err, gs.IsNil)
+		writeFile := func(name, line string) string {
+			path := filepath.Join(tmpDir, name)
+			err := ioutil.WriteFile(path, []byte(line+"\n"), 0644)
+			c.Assume(err, gs.IsNil)
+			return path
+		}
+		writeFile("app-1.log", "app-1")
+		writeFile("app-2.txt", "app-2")
+		writeFile("sub/app-3.log", "app-3")
+		writeFile("sub/app-3.log.old", "app-3 old")
+
+		lfInput := new(LogfileInput)
+		lfiConfig := lfInput.ConfigStruct().(*LogfileInputConfig)
+		lfiConfig.DiscoverInterval = 1
+		lfiConfig.StatInterval = 1
+
+		// Returns the paths of the files the lines read in the next 100ms
+		// came from.
+		readPaths := func() map[string]bool {
+			paths := make(map[string]bool)
+			timeout := time.After(100 * time.Millisecond)
+			for {
+				select {
+				case logline := <-lfInput.Monitor.NewLines:
+					paths[filepath.Base(logline.Path)] = true
+				case <-timeout:
+					return paths
+				}
+			}
+		}
+
+		c.Specify("reads the files matching a glob pattern", func() {
+			lfiConfig.LogFiles = []string{filepath.Join(tmpDir, "app-*")}
+			err := lfInput.Init(lfiConfig)
+			c.Assume(err, gs.IsNil)
+			defer lfInput.Stop()
+			paths := readPaths()
+			c.Expect(len(paths), gs.Equals, 2)
+			c.Expect(paths["app-1.log"], gs.IsTrue)
+			c.Expect(paths["app-2.txt"], gs.IsTrue)
+
+			writeFile("app-4.log", "app-4")
+			paths = readPaths()
+			c.Expect(len(paths), gs.Equals, 1)
+			c.Expect(paths["app-4.log"], gs.IsTrue)
+		})
+
+		c.Specify("reads the included files in directories recursively", func() {
+			lfiConfig.LogDirectories = []string{tmpDir}
+			lfiConfig.IncludeRegex = `\.log`
+			lfiConfig.ExcludeRegex = `\.old$`
+			err := lfInput.Init(lfiConfig)
+			c.Assume(err, gs.IsNil)
+			defer lfInput.Stop()
+			paths := readPaths()
+			c.Expect(len(paths), gs.Equals, 2)
+			c.Expect(paths["app-1.log"], gs.IsTrue)
+			c.Expect(paths["app-3.log"], gs.IsTrue)
+
+			writeFile("sub/app-4.log", "app-4")
+			paths = readPaths()
+			c.Expect(len(paths), gs.Equals, 1)
+			c.Expect(paths["app-4.log"], gs.IsTrue)
+		})
+
+		c.Specify("forgets files that have been deleted", func() {
+			lfiConfig.LogDirectories = []string{tmpDir}
+			err := lfInput.Init(lfiConfig)
+			c.Assume(err, gs.IsNil)
+			c.Expect(len(readPaths()), gs.Equals, 4)
+			deleted := filepath.Join(tmpDir, "app-1.log")
+			err = os.Remove(deleted)
+			c.Assume(err, gs.IsNil)
+			time.Sleep(100 * time.Millisecond)
+			lfInput.Stop()
+
+			monitor := lfInput.Monitor
+			_, ok := monitor.fds[deleted]
+			c.Expect(ok, gs.IsFalse)
+			_, ok = monitor.seek[deleted]
+			c.Expect(ok, gs.IsFalse)
+			c.Expect(monitor.discover[deleted], gs.IsFalse)
+			c.Expect(len(monitor.fds), gs.Equals, 3)
+		})
+
+		c.Specify("rejects an invalid regex", func() {
+			lfiConfig.LogDirectories = []string{tmpDir}
+			lfiConfig.IncludeRegex = `(\.log`
+			err := lfInput.Init(lfiConfig)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("A LogfileInput assembling multi-line records", func() {
+		tmpDir, err := ioutil.TempDir("", "heka-record-test")
+		c.Assume(err, gs.IsNil)
+		defer os.RemoveAll(tmpDir)
+		logPath := filepath.Join(tmpDir, "test.log")
+		traceback := "2013-05-01 ERROR boom\n\tat Foo.bar\n\tat Baz.qux\n"
+		info := "2013-05-01 INFO ok\n"
+		err = ioutil.WriteFile(logPath, []byte(traceback+info), 0644)
+		c.Assume(err, gs.IsNil)
+
+		lfInput := new(LogfileInput)
+		lfiConfig := lfInput.ConfigStruct().(*LogfileInputConfig)
+		lfiConfig.LogFiles = []string{logPath}
+		lfiConfig.DiscoverInterval = 1
+		lfiConfig.StatInterval = 1
+		lfiConfig.FlushTimeout = 10
+
+		// Returns the records read in the next 100ms.
+		readRecords := func() (records []string) {
+			timeout := time.After(100 * time.Millisecond)
+			for {
+				select {
+				case logline := <-lfInput.Monitor.NewLines:
+					records = append(records, logline.Line)
+				case <-timeout:
+					return
+				}
+			}
+		}
+
+		c.Specify("starts a record w/ each line matching the start regex", func() {
+			lfiConfig.RecordStartRegex = `^\d{4}-\d{2}-\d{2} `
+			err := lfInput.Init(lfiConfig)
+			c.Assume(err, gs.IsNil)
+			defer lfInput.Stop()
+			records := readRecords()
+			c.Expect(len(records), gs.Equals, 2)
+			if len(records) == 2 {
+				c.Expect(records[0], gs.Equals, traceback)
+				c.Expect(records[1], gs.Equals, info)
+			}
+		})
+
+		c.Specify("appends the lines matching the continuation regex", func() {
+			lfiConfig.ContinuationRegex = `^\s`
+			err := lfInput.Init(lfiConfig)
+			c.Assume(err, gs.IsNil)
+			defer lfInput.Stop()
+			records := readRecords()
+			c.Expect(len(records), gs.Equals, 2)
+			if len(records) == 2 {
+				c.Expect(records[0], gs.Equals, traceback)
+				c.Expect(records[1], gs.Equals, info)
+			}
+		})
+
+		c.Specify("starts a new record when one gets too large", func() {
+			lfiConfig.ContinuationRegex = `^\s`
+			lfiConfig.MaxRecordSize = 40
+			err := lfInput.Init(lfiConfig)
+			c.Assume(err, gs.IsNil)
+			defer lfInput.Stop()
+			records := readRecords()
+			c.Expect(len(records), gs.Equals, 3)
+			if len(records) == 3 {
+				c.Expect(records[0], gs.Equals, "2013-05-01 ERROR boom\n\tat Foo.bar\n")
+				c.Expect(records[1], gs.Equals, "\tat Baz.qux\n")
+			}
+		})
+
+		c.Specify("reads an unfinished record again after a restart", func() {
+			lfiConfig.ContinuationRegex = `^\s`
+			lfiConfig.FlushTimeout = 10000
+			lfiConfig.SeekJournal = filepath.Join(tmpDir, "journal")
+			err := lfInput.Init(lfiConfig)
+			c.Assume(err, gs.IsNil)
+			records := readRecords()
+			lfInput.Stop()
+			c.Expect(len(records), gs.Equals, 1)
+
+			lfInput = new(LogfileInput)
+			lfiConfig.FlushTimeout = 10
+			err = lfInput.Init(lfiConfig)
+			c.Assume(err, gs.IsNil)
+			defer lfInput.Stop()
+			records = readRecords()
+			c.Expect(len(records), gs.Equals, 1)
+			if len(records) == 1 {
+				c.Expect(records[0], gs.Equals, info)
+			}
+		})
+
+		c.Specify("rejects both a start and a continuation regex", func() {
+			lfiConfig.RecordStartRegex = `^\d`
+			lfiConfig.ContinuationRegex = `^\s`
+			err := lfInput.Init(lfiConfig)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("A LogfileInput w/ a rotated log file", func() {
+		tmpDir, err := ioutil.TempDir("", "heka-rotation-test")
+		c.Assume(err, gs.IsNil)
+		defer os.RemoveAll(tmpDir)
+		logPath := filepath.Join(tmpDir, "app.log")
+		appendFile := func(path, contents string) {
+			file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			c.Assume(err, gs.IsNil)
+			file.WriteString(contents)
+			file.Close()
+		}
+
+		lfInput := new(LogfileInput)
+		lfiConfig := lfInput.ConfigStruct().(*LogfileInputConfig)
+		lfiConfig.LogFiles = []string{logPath}
+		lfiConfig.DiscoverInterval = 1
+		lfiConfig.StatInterval = 1
+
+		// Returns the lines read in the next 100ms.
+		readLines := func() (lines []string) {
+			timeout := time.After(100 * time.Millisecond)
+			for {
+				select {
+				case logline := <-lfInput.Monitor.NewLines:
+					lines = append(lines, logline.Line)
+				case <-timeout:
+					return
+				}
+			}
+		}
+
+		c.Specify("waits for the last line to be finished", func() {
+			appendFile(logPath, "one\ntw")
+			err := lfInput.Init(lfiConfig)
+			c.Assume(err, gs.IsNil)
+			defer lfInput.Stop()
+			lines := readLines()
+			c.Expect(len(lines), gs.Equals, 1)
+			appendFile(logPath, "o\n")
+			lines = readLines()
+			c.Expect(len(lines), gs.Equals, 1)
+			if len(lines) == 1 {
+				c.Expect(lines[0], gs.Equals, "two\n")
+			}
+		})
+
+		c.Specify("reads the old file to the end after a rotation", func() {
+			appendFile(logPath, "one\n")
+			err := lfInput.Init(lfiConfig)
+			c.Assume(err, gs.IsNil)
+			defer lfInput.Stop()
+			c.Expect(len(readLines()), gs.Equals, 1)
+			appendFile(logPath, "two")
+			err = os.Rename(logPath, logPath+".1")
+			c.Assume(err, gs.IsNil)
+			appendFile(logPath, "three\n")
+			lines := readLines()
+			c.Expect(len(lines), gs.Equals, 2)
+			if len(lines) == 2 {
+				c.Expect(lines[0], gs.Equals, "two")
+				c.Expect(lines[1], gs.Equals, "three\n")
+			}
+		})
+
+		c.Specify("w/ a seek journal", func() {
+			lfiConfig.SeekJournal = filepath.Join(tmpDir, "journal")
+			appendFile(logPath, "one\n")
+			err := lfInput.Init(lfiConfig)
+			c.Assume(err, gs.IsNil)
+			c.Assume(len(readLines()), gs.Equals, 1)
+			lfInput.Stop()
+
+			// Rotate twice while hekad isn't running, compressing the oldest.
+			appendFile(logPath, "two\n")
+			contents, err := ioutil.ReadFile(logPath)
+			c.Assume(err, gs.IsNil)
+			gzFile, err := os.Create(logPath + ".2.gz")
+			c.Assume(err, gs.IsNil)
+			gzWriter := gzip.NewWriter(gzFile)
+			gzWriter.Write(contents)
+			gzWriter.Close()
+			gzFile.Close()
+			err = os.Remove(logPath)
+			c.Assume(err, gs.IsNil)
+			appendFile(logPath+".1", "three\n")
+			appendFile(logPath, "four\n")
+			lfInput = new(LogfileInput)
+
+			c.Specify("catches up on the rotated files", func() {
+				lfiConfig.CatchUpRotated = true
+				err := lfInput.Init(lfiConfig)
+				c.Assume(err, gs.IsNil)
+				defer lfInput.Stop()
+				lines := readLines()
+				c.Expect(len(lines), gs.Equals, 3)
+				if len(lines) == 3 {
+					c.Expect(lines[0], gs.Equals, "two\n")
+					c.Expect(lines[1], gs.Equals, "three\n")
+					c.Expect(lines[2], gs.Equals, "four\n")
+				}
+			})
+
+			c.Specify("only reads the new file by default", func() {
+				err := lfInput.Init(lfiConfig)
+				c.Assume(err, gs.IsNil)
+				defer lfInput.Stop()
+				lines := readLines()
+				c.Expect(len(lines), gs.Equals, 1)
+				if len(lines) == 1 {
+					c.Expect(lines[0], gs.Equals, "four\n")
+				}
+			})
+		})
+	})
+
+	c.Specify("A LogfileInput notified of file changes", func() {
+		notifier, err := newFileNotifier()
+		if err != nil {
+			return // only polling on this platform
+		}
+		notifier.Close()
+		tmpDir, err := ioutil.TempDir("", "heka-notify-test")
+		c.Assume(err, gs.IsNil)
+		defer os.RemoveAll(tmpDir)
+		appendFile := func(name, contents string) {
+			path := filepath.Join(tmpDir, name)
+			file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			c.Assume(err, gs.IsNil)
+			file.WriteString(contents)
+			file.Close()
+		}
+		appendFile("app.log", "one\n")
+
+		// Never polls during the test.
+		lfInput := new(LogfileInput)
+		lfiConfig := lfInput.ConfigStruct().(*LogfileInputConfig)
+		lfiConfig.LogFiles = []string{filepath.Join(tmpDir, "*.log")}
+		lfiConfig.DiscoverInterval = 60000
+		lfiConfig.StatInterval = 60000
+
+		// Returns the lines read in the next 100ms.
+		readLines := func() (lines []string) {
+			timeout := time.After(100 * time.Millisecond)
+			for {
+				select {
+				case logline := <-lfInput.Monitor.NewLines:
+					lines = append(lines, logline.Line)
+				case <-timeout:
+					return
+				}
+			}
+		}
+
+		c.Specify("reads changes right away", func() {
+			err := lfInput.Init(lfiConfig)
+			c.Assume(err, gs.IsNil)
+			defer lfInput.Stop()
+			c.Expect(len(readLines()), gs.Equals, 1)
+
+			appendFile("app.log", "two\n")
+			appendFile("other.log", "three\n")
+			lines := readLines()
+			c.Expect(len(lines), gs.Equals, 2)
+			if len(lines) == 2 {
+				c.Expect(lines[0], gs.Equals, "two\n")
+				c.Expect(lines[1], gs.Equals, "three\n")
+			}
+
+			err = os.Rename(filepath.Join(tmpDir, "app.log"),
+				filepath.Join(tmpDir, "app.log.1"))
+			c.Assume(err, gs.IsNil)
+			appendFile("app.log", "four\n")
+			lines = readLines()
+			c.Expect(len(lines), gs.Equals, 1)
+			if len(lines) == 1 {
+				c.Expect(lines[0], gs.Equals, "four\n")
+			}
+		})
+
+		c.Specify("only polls if asked to", func() {
+			lfiConfig.PollOnly = true
+			err := lfInput.Init(lfiConfig)
+			c.Assume(err, gs.IsNil)
+			defer lfInput.Stop()
+			c.Expect(len(readLines()), gs.Equals, 1)
+			appendFile("app.log", "two\n")
+			c.Expect(len(readLines()), gs.Equals, 0)
+		})
+	})
 }
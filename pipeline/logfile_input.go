@@ -17,16 +17,45 @@ package pipeline
 
 import (
 	"bufio"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
+const (
+	// Interval btn writes of changed offsets to the seek journal.
+	seekJournalInterval = time.Second
+	// Maximum number of bytes at the start of a log file hashed to recognize
+	// it when resuming from the seek journal.
+	fingerprintLength = 1024
+)
+
 // ConfigStruct for LogfileInput plugin.
 type LogfileInputConfig struct {
-	// Paths for all of the log files that this input should be reading.
+	// Paths for all of the log files that this input should be reading. Paths
+	// may be glob patterns, i.e. "/var/log/app/*.log".
 	LogFiles []string
+	// Directories that should be searched, recursively, for log files to
+	// read.
+	LogDirectories []string `toml:"log_directories"`
+	// Only files whose paths match this regex are read from glob patterns
+	// and directories.
+	IncludeRegex string `toml:"include_regex"`
+	// Files whose paths match this regex aren't read from glob patterns and
+	// directories.
+	ExcludeRegex string `toml:"exclude_regex"`
 	// Hostname to use for the generated logfile message objects.
 	Hostname string
 	// Interval btn hd scans for existence of watched files, in milliseconds,
@@ -35,6 +64,30 @@ type LogfileInputConfig struct {
 	// Interval btn reads from open file handles, in milliseconds, default
 	// 500.
 	StatInterval int
+	// Lines matching this regex start a new record, any other lines are
+	// appended to the current record. Each line is a record if neither this
+	// nor ContinuationRegex is set.
+	RecordStartRegex string `toml:"record_start_regex"`
+	// Lines matching this regex are appended to the current record, any
+	// other lines start a new record.
+	ContinuationRegex string `toml:"continuation_regex"`
+	// Maximum size of a multi-line record in bytes, default 32768. Lines
+	// that would make a record larger start a new one.
+	MaxRecordSize int `toml:"max_record_size"`
+	// Time after which a multi-line record is complete if no more lines
+	// were appended to it, in milliseconds, default 1000.
+	FlushTimeout int `toml:"flush_timeout"`
+	// Directory in which the read offset of each log file is saved, so
+	// reading resumes where it left off after a restart. Relative paths are
+	// relative to the base_dir. Offsets aren't saved if empty.
+	SeekJournal string `toml:"seek_journal"`
+	// If a log file was rotated while hekad wasn't running, finish reading
+	// the rotated file, i.e. "app.log.1" or "app.log.1.gz", and any newer
+	// rotated files on startup. Requires a seek journal.
+	CatchUpRotated bool `toml:"catch_up_rotated"`
+	// Only poll files for changes, even where change notifications (i.e.
+	// inotify on Linux) are available.
+	PollOnly bool `toml:"poll_only"`
 }
 
 // Heka Input plugin that reads files from the filesystem, converts each line
@@ -48,7 +101,7 @@ type LogfileInput struct {
 	stopped  bool
 }
 
-// Represents a single line from a log file.
+// Represents a single line, or a multi-line record, from a log file.
 type Logline struct {
 	// Path to the file from which the line was extracted.
 	Path string
@@ -60,6 +113,8 @@ func (lw *LogfileInput) ConfigStruct() interface{} {
 	return &LogfileInputConfig{
 		DiscoverInterval: 5000,
 		StatInterval:     500,
+		MaxRecordSize:    32768,
+		FlushTimeout:     1000,
 	}
 }
 
@@ -74,8 +129,7 @@ func (lw *LogfileInput) Init(config interface{}) (err error) {
 		}
 	}
 	lw.hostname = val
-	if err = lw.Monitor.Init(conf.LogFiles, conf.DiscoverInterval,
-		conf.StatInterval); err != nil {
+	if err = lw.Monitor.Init(conf); err != nil {
 		return err
 	}
 	return nil
@@ -99,7 +153,7 @@ func (lw *LogfileInput) Run(ir InputRunner, h PluginHelper) (err error) {
 
 func (lw *LogfileInput) Stop() {
 	close(lw.Monitor.stopChan) // stops the monitor's watcher
-	close(lw.Monitor.NewLines)
+	<-lw.Monitor.done          // wait for the final seek journal write
 }
 
 // FileMonitor, manages a group of FileTailers
@@ -117,6 +171,33 @@ type FileMonitor struct {
 	checkStat        <-chan time.Time
 	discoverInterval time.Duration
 	statInterval     time.Duration
+	// Glob patterns and directories searched for files to read, w/ the
+	// regexes filtering what they find.
+	patterns    []string
+	directories []string
+	include     *regexp.Regexp
+	exclude     *regexp.Regexp
+	// Files found by searching, which are forgotten once they go away.
+	matched map[string]bool
+	// Regexes determining which lines belong to a multi-line record, both
+	// nil if each line is a record.
+	recordStart   *regexp.Regexp
+	continuation  *regexp.Regexp
+	maxRecordSize int
+	flushTimeout  time.Duration
+	// Records still being assembled, by file name.
+	records map[string]*logRecord
+	// Directory holding the seek journal, empty if disabled.
+	seekJournal string
+	// Offsets as of the last seek journal write, by file name.
+	journaled map[string]int64
+	// Whether rotated files are read on startup.
+	catchUpRotated bool
+	// Notifies us of changes to the files being read, nil if we're only
+	// polling.
+	notifier fileNotifier
+	// Closed by the watcher once it has shut down.
+	done chan bool
 }
 
 // Tries to open specified file, adding file descriptor to the FileMonitor's
@@ -127,6 +208,25 @@ func (fm *FileMonitor) OpenFile(fileName string) (err error) {
 	if err != nil {
 		return
 	}
+
+	// Pick up where a previous hekad left off if this is the file it was
+	// reading, or if it was rotated since, where it left off in the rotated
+	// file.
+	if _, ok := fm.seek[fileName]; !ok && fm.seekJournal != "" {
+		if entry := fm.loadJournal(fileName); entry == nil {
+			fm.seek[fileName] = 0
+		} else if entry.matches(fd) {
+			fm.seek[fileName] = entry.Seek
+			fm.journaled[fileName] = entry.Seek
+		} else {
+			if fm.catchUpRotated && !fm.catchUp(fileName, entry) {
+				// Stopped, try again next time.
+				fd.Close()
+				return errors.New("stopped while reading rotated files")
+			}
+			fm.seek[fileName] = 0
+		}
+	}
 	fm.fds[fileName] = fd
 
 	// Seek as needed
@@ -149,8 +249,16 @@ func (fm *FileMonitor) OpenFile(fileName string) (err error) {
 func (fm *FileMonitor) Watcher() {
 	discovery := time.Tick(fm.discoverInterval)
 	checkStat := time.Tick(fm.statInterval)
+	var journal <-chan time.Time
+	if fm.seekJournal != "" {
+		journal = time.Tick(seekJournalInterval)
+	}
+	var notifications <-chan string
+	if fm.notifier != nil {
+		notifications = fm.notifier.Events()
+	}
 
-	ok := true
+	ok := fm.discoverFiles()
 
 	for ok {
 		select {
@@ -158,89 +266,668 @@ func (fm *FileMonitor) Watcher() {
 			break
 		case <-checkStat:
 			for fileName, _ := range fm.fds {
+				if !fm.needsPoll(fileName) {
+					continue
+				}
 				ok = fm.ReadLines(fileName)
 				if !ok {
 					break
 				}
 			}
 		case <-discovery:
-			// Check to see if the files exist now, start reading them
-			// if we can, and watch them
-			for fileName, _ := range fm.discover {
-				if fm.OpenFile(fileName) == nil {
-					delete(fm.discover, fileName)
-				}
+			ok = fm.discoverFiles()
+		case path, open := <-notifications:
+			if !open {
+				// Notifications failed, fall back to polling everything.
+				notifications = nil
+				fm.notifier = nil
+				break
 			}
+			ok = fm.notified(path)
+		case <-journal:
+			fm.saveJournals()
 		}
 	}
+	if fm.notifier != nil {
+		fm.notifier.Close()
+	}
+	if fm.seekJournal != "" {
+		fm.saveJournals()
+	}
 	for _, fd := range fm.fds {
 		fd.Close()
 	}
+	close(fm.NewLines)
+	close(fm.done)
+}
+
+// Searches for new files, then opens and reads the files on the discover list
+// that exist now. Returns false if the monitor was stopped.
+func (fm *FileMonitor) discoverFiles() bool {
+	fm.search()
+	for fileName, _ := range fm.discover {
+		// Watch first so no changes are missed btn reading and watching.
+		fm.watch(filepath.Dir(fileName))
+		if fm.OpenFile(fileName) == nil {
+			delete(fm.discover, fileName)
+			if !fm.ReadLines(fileName) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Adds a watch for changes to the files in the directory, if we're being
+// notified of changes. Directories that can't be watched are polled.
+func (fm *FileMonitor) watch(dir string) {
+	if fm.notifier != nil {
+		fm.notifier.Watch(dir)
+	}
+}
+
+// Returns true if the open file has to be polled for changes, either
+// because we aren't notified of them or because a multi-line record may be
+// waiting for its flush timeout.
+func (fm *FileMonitor) needsPoll(fileName string) bool {
+	if fm.notifier == nil || !fm.notifier.Watching(filepath.Dir(fileName)) {
+		return true
+	}
+	_, ok := fm.records[fileName]
+	return ok
+}
+
+// Handles a notification that the file at the path was modified, created,
+// moved, or deleted. An empty path means notifications were lost. Returns
+// false if the monitor was stopped.
+func (fm *FileMonitor) notified(path string) bool {
+	if path == "" {
+		for fileName, _ := range fm.fds {
+			if !fm.ReadLines(fileName) {
+				return false
+			}
+		}
+		return fm.discoverFiles()
+	}
+	if _, ok := fm.fds[path]; ok {
+		return fm.ReadLines(path)
+	}
+	if !fm.discover[path] {
+		if !fm.searchesFor(path) {
+			return true
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return true
+		}
+		if info.IsDir() {
+			// A new directory to search.
+			return fm.discoverFiles()
+		}
+		fm.addFound(path)
+	}
+	if fm.discover[path] && fm.OpenFile(path) == nil {
+		delete(fm.discover, path)
+		return fm.ReadLines(path)
+	}
+	return true
 }
 
 // Reads all unread lines out of the specified file, creates a LogLine object
 // for each line, and puts it on the NewLine channel for processing.
 func (fm *FileMonitor) ReadLines(fileName string) (ok bool) {
 	ok = true
-	defer func() {
-		// Capture send on close chan as this is a shut-down
-		if r := recover(); r != nil {
-			rStr := fmt.Sprintf("%s", r)
-			if strings.Contains(rStr, "send on closed channel") {
-				ok = false
-			} else {
-				panic(rStr)
-			}
-		}
-	}()
-
 	fd, _ := fm.fds[fileName]
 
 	// Determine if we're farther into the file than possible (truncate)
 	finfo, err := fd.Stat()
 	if err == nil {
 		if finfo.Size() < fm.seek[fileName] {
+			if !fm.flushRecord(fileName) {
+				return false
+			}
 			fd.Seek(0, 0)
 			fm.seek[fileName] = 0
 		}
 	}
 
 	// Attempt to read lines from where we are
-	reader := bufio.NewReader(fd)
-	readLine, err := reader.ReadString('\n')
-	for err == nil {
-		line := Logline{Path: fileName, Line: readLine}
-		fm.NewLines <- line
-		fm.seek[fileName] += int64(len(readLine))
-		readLine, err = reader.ReadString('\n')
+	if !fm.readToEOF(fileName, fd, false) {
+		return false
+	}
+
+	// A record is complete once no lines have been appended for a while.
+	if record, ok := fm.records[fileName]; ok &&
+		time.Since(record.updated) >= fm.flushTimeout {
+		if !fm.flushRecord(fileName) {
+			return false
+		}
 	}
-	fm.seek[fileName] += int64(len(readLine))
 
 	// Check that we haven't been rotated, if we have, put this back on
 	// discover
 	pinfo, err := os.Stat(fileName)
 	if err != nil || !os.SameFile(pinfo, finfo) {
+		// Lines may have been written after we reached the end but before
+		// the file was rotated.
+		if !fm.readToEOF(fileName, fd, true) || !fm.flushRecord(fileName) {
+			return false
+		}
 		fd.Close()
 		delete(fm.fds, fileName)
 		delete(fm.seek, fileName)
+		delete(fm.journaled, fileName)
 		fm.discover[fileName] = true
 	}
 	return
 }
 
-func (fm *FileMonitor) Init(files []string, discoverInterval int,
-	statInterval int) (err error) {
+// Reads all of the complete lines from the file's current position and sends
+// them on. An incomplete last line is left to be read once it's finished,
+// unless the file is known to be finished. Returns false if the monitor was
+// stopped first, in which case the unsent lines will be read again next time.
+func (fm *FileMonitor) readToEOF(fileName string, fd *os.File,
+	finished bool) bool {
+
+	reader := bufio.NewReader(fd)
+	readLine, err := reader.ReadString('\n')
+	for err == nil {
+		if !fm.addLine(fileName, readLine) {
+			return false
+		}
+		fm.seek[fileName] += int64(len(readLine))
+		readLine, err = reader.ReadString('\n')
+	}
+	if len(readLine) == 0 {
+		return true
+	}
+	if !finished {
+		fd.Seek(fm.seek[fileName], 0)
+		return true
+	}
+	if !fm.addLine(fileName, readLine) {
+		return false
+	}
+	fm.seek[fileName] += int64(len(readLine))
+	return true
+}
+
+// A multi-line record being assembled from a log file's lines.
+type logRecord struct {
+	payload []byte
+	// When the last line was appended.
+	updated time.Time
+}
+
+// Returns true if the line belongs to the file's current multi-line record.
+func (fm *FileMonitor) continues(record *logRecord, line string) bool {
+	if len(record.payload)+len(line) > fm.maxRecordSize {
+		return false
+	}
+	if fm.recordStart != nil {
+		return !fm.recordStart.MatchString(line)
+	}
+	return fm.continuation.MatchString(line)
+}
+
+// Sends the line on, or appends it to the file's current record if lines
+// are being assembled into multi-line records, sending the record it
+// completes if any. Returns false if the monitor was stopped first.
+func (fm *FileMonitor) addLine(fileName, line string) bool {
+	if fm.recordStart == nil && fm.continuation == nil {
+		return fm.send(Logline{Path: fileName, Line: line})
+	}
+	record, ok := fm.records[fileName]
+	if ok && !fm.continues(record, line) {
+		if !fm.flushRecord(fileName) {
+			return false
+		}
+		ok = false
+	}
+	if !ok {
+		record = new(logRecord)
+		fm.records[fileName] = record
+	}
+	record.payload = append(record.payload, line...)
+	record.updated = time.Now()
+	return true
+}
+
+// Sends the file's current record on, if there is one. Returns false if the
+// monitor was stopped first.
+func (fm *FileMonitor) flushRecord(fileName string) bool {
+	record, ok := fm.records[fileName]
+	if !ok {
+		return true
+	}
+	if !fm.send(Logline{Path: fileName, Line: string(record.payload)}) {
+		return false
+	}
+	delete(fm.records, fileName)
+	return true
+}
+
+func (fm *FileMonitor) send(line Logline) bool {
+	select {
+	case fm.NewLines <- line:
+		return true
+	case <-fm.stopChan:
+		return false
+	}
+}
+
+// Returns the offset up to which the file's contents have been sent on,
+// which is before any record still being assembled.
+func (fm *FileMonitor) sentSeek(fileName string) int64 {
+	seek := fm.seek[fileName]
+	if record, ok := fm.records[fileName]; ok {
+		seek -= int64(len(record.payload))
+	}
+	return seek
+}
+
+// Returns true if the path contains any glob pattern metacharacters.
+func isPattern(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// Returns true if the path could be found by searching the glob patterns and
+// directories.
+func (fm *FileMonitor) searchesFor(path string) bool {
+	for _, pattern := range fm.patterns {
+		if matched, _ := filepath.Match(pattern, path); matched {
+			return true
+		}
+	}
+	for _, dir := range fm.directories {
+		if strings.HasPrefix(path, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds a file found by searching to the discover list, unless it was found
+// before or isn't included.
+func (fm *FileMonitor) addFound(fileName string) {
+	if fm.matched[fileName] || !fm.included(fileName) {
+		return
+	}
+	fm.matched[fileName] = true
+	if _, ok := fm.fds[fileName]; !ok {
+		fm.discover[fileName] = true
+	}
+}
+
+// Returns true if the include and exclude regexes allow reading the file.
+func (fm *FileMonitor) included(fileName string) bool {
+	if fm.include != nil && !fm.include.MatchString(fileName) {
+		return false
+	}
+	return fm.exclude == nil || !fm.exclude.MatchString(fileName)
+}
+
+// Searches the glob patterns and directories for files to read, adding new
+// ones to the discover list so they're read from the start. Files that have
+// gone away are forgotten once they've been read to the end.
+func (fm *FileMonitor) search() {
+	if len(fm.patterns) == 0 && len(fm.directories) == 0 {
+		return
+	}
+	found := make(map[string]bool)
+	for _, pattern := range fm.patterns {
+		if dir := filepath.Dir(pattern); !isPattern(dir) {
+			fm.watch(dir)
+		}
+		fileNames, _ := filepath.Glob(pattern)
+		for _, fileName := range fileNames {
+			if info, err := os.Stat(fileName); err == nil && info.Mode().IsRegular() {
+				fm.watch(filepath.Dir(fileName))
+				found[fileName] = true
+			}
+		}
+	}
+	for _, dir := range fm.directories {
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info.IsDir() {
+				fm.watch(path)
+			} else if info.Mode().IsRegular() {
+				found[path] = true
+			}
+			return nil
+		})
+	}
+
+	for fileName, _ := range found {
+		fm.addFound(fileName)
+	}
+	for fileName, _ := range fm.matched {
+		if found[fileName] {
+			continue
+		}
+		// Still open files will be read to the end and put on the discover
+		// list by ReadLines first.
+		if _, ok := fm.fds[fileName]; ok {
+			continue
+		}
+		delete(fm.matched, fileName)
+		delete(fm.discover, fileName)
+		delete(fm.seek, fileName)
+		delete(fm.journaled, fileName)
+		delete(fm.records, fileName)
+		if fm.seekJournal != "" {
+			os.Remove(fm.journalPath(fileName))
+		}
+	}
+}
 
+func (fm *FileMonitor) Init(conf *LogfileInputConfig) (err error) {
+	if conf.IncludeRegex != "" {
+		if fm.include, err = regexp.Compile(conf.IncludeRegex); err != nil {
+			return fmt.Errorf("invalid include_regex: %s", err)
+		}
+	}
+	if conf.ExcludeRegex != "" {
+		if fm.exclude, err = regexp.Compile(conf.ExcludeRegex); err != nil {
+			return fmt.Errorf("invalid exclude_regex: %s", err)
+		}
+	}
+	if conf.RecordStartRegex != "" && conf.ContinuationRegex != "" {
+		return errors.New(
+			"record_start_regex and continuation_regex are mutually exclusive")
+	}
+	if conf.RecordStartRegex != "" {
+		if fm.recordStart, err = regexp.Compile(conf.RecordStartRegex); err != nil {
+			return fmt.Errorf("invalid record_start_regex: %s", err)
+		}
+	}
+	if conf.ContinuationRegex != "" {
+		if fm.continuation, err = regexp.Compile(conf.ContinuationRegex); err != nil {
+			return fmt.Errorf("invalid continuation_regex: %s", err)
+		}
+	}
+	fm.catchUpRotated = conf.CatchUpRotated
+	fm.maxRecordSize = conf.MaxRecordSize
+	fm.flushTimeout = time.Millisecond * time.Duration(conf.FlushTimeout)
+	fm.records = make(map[string]*logRecord)
+	seekJournal := conf.SeekJournal
+	if seekJournal != "" && !filepath.IsAbs(seekJournal) {
+		seekJournal = filepath.Join(Globals().BaseDir, seekJournal)
+	}
+	if seekJournal != "" {
+		if err = os.MkdirAll(seekJournal, 0700); err != nil {
+			return fmt.Errorf("can't create seek journal directory: %s", err)
+		}
+	}
+	fm.seekJournal = seekJournal
 	fm.NewLines = make(chan Logline)
 	fm.stopChan = make(chan bool)
+	fm.done = make(chan bool)
 	fm.seek = make(map[string]int64)
+	fm.journaled = make(map[string]int64)
 	fm.fds = make(map[string]*os.File)
 	fm.discover = make(map[string]bool)
-	for _, fileName := range files {
-		fm.discover[fileName] = true
+	fm.matched = make(map[string]bool)
+	for _, fileName := range conf.LogFiles {
+		if isPattern(fileName) {
+			fm.patterns = append(fm.patterns, fileName)
+		} else {
+			fm.discover[fileName] = true
+		}
+	}
+	fm.directories = conf.LogDirectories
+	if !conf.PollOnly {
+		// Fall back to polling if notifications aren't available.
+		fm.notifier, _ = newFileNotifier()
 	}
-	fm.discoverInterval = time.Millisecond * time.Duration(discoverInterval)
-	fm.statInterval = time.Millisecond * time.Duration(statInterval)
+	fm.discoverInterval = time.Millisecond * time.Duration(conf.DiscoverInterval)
+	fm.statInterval = time.Millisecond * time.Duration(conf.StatInterval)
 	go fm.Watcher()
 	return
 }
+
+// A log file's read offset as stored in the seek journal, along w/ the
+// fingerprint of the file it applies to: its inode and a hash of its first
+// bytes, which catches inodes reused by a new file after a rotation.
+type seekJournalEntry struct {
+	Path       string `json:"path"`
+	Seek       int64  `json:"seek"`
+	Inode      uint64 `json:"inode"`
+	HashLength int64  `json:"hash_length"`
+	Hash       string `json:"hash"`
+}
+
+// Returns the path of the seek journal file for the specified log file.
+func (fm *FileMonitor) journalPath(fileName string) string {
+	hash := sha1.New()
+	hash.Write([]byte(fileName))
+	return filepath.Join(fm.seekJournal, hex.EncodeToString(hash.Sum(nil))+
+		".journal")
+}
+
+// Returns the inode of the open file and the hex encoded SHA1 hash of its
+// first `length` bytes. Returns an error if the file is shorter than that.
+func fingerprint(fd *os.File, length int64) (inode uint64, hash string,
+	err error) {
+
+	if inode, err = fileInode(fd); err != nil {
+		return
+	}
+	hash, err = hashPrefix(io.NewSectionReader(fd, 0, length), length)
+	return
+}
+
+// Returns the hex encoded SHA1 hash of the first `length` bytes read from the
+// reader. Returns an error if there are fewer.
+func hashPrefix(reader io.Reader, length int64) (hash string, err error) {
+	hasher := sha1.New()
+	if _, err = io.CopyN(hasher, reader, length); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// Returns true if the open file is the one the entry was saved for.
+func (entry *seekJournalEntry) matches(fd *os.File) bool {
+	inode, hash, err := fingerprint(fd, entry.HashLength)
+	return err == nil && inode == entry.Inode && hash == entry.Hash
+}
+
+// Returns the seek journal entry saved for the specified log file, or nil if
+// there isn't one.
+func (fm *FileMonitor) loadJournal(fileName string) *seekJournalEntry {
+	contents, err := ioutil.ReadFile(fm.journalPath(fileName))
+	if err != nil {
+		return nil
+	}
+	entry := new(seekJournalEntry)
+	if err = json.Unmarshal(contents, entry); err != nil || entry.Path != fileName {
+		return nil
+	}
+	return entry
+}
+
+// Writes the offsets that have changed since the last write to the seek
+// journal.
+func (fm *FileMonitor) saveJournals() {
+	for fileName, fd := range fm.fds {
+		// A restart must read any partially assembled record again.
+		seek := fm.sentSeek(fileName)
+		if saved, ok := fm.journaled[fileName]; ok && saved == seek {
+			continue
+		}
+		if err := fm.saveJournal(fileName, fd, seek); err != nil {
+			// Try again next time.
+			continue
+		}
+		fm.journaled[fileName] = seek
+	}
+}
+
+func (fm *FileMonitor) saveJournal(fileName string, fd *os.File,
+	seek int64) (err error) {
+
+	finfo, err := fd.Stat()
+	if err != nil {
+		return
+	}
+	entry := seekJournalEntry{Path: fileName, Seek: seek,
+		HashLength: fingerprintLength}
+	if finfo.Size() < entry.HashLength {
+		entry.HashLength = finfo.Size()
+	}
+	if entry.Inode, entry.Hash, err = fingerprint(fd, entry.HashLength); err != nil {
+		return
+	}
+	contents, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	path := fm.journalPath(fileName)
+	if err = ioutil.WriteFile(path+".tmp", contents, 0600); err != nil {
+		return
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Delivers the paths of files that were modified, created, moved, or deleted
+// in the watched directories, so the FileMonitor can read changes right away
+// instead of waiting to poll for them.
+type fileNotifier interface {
+	// Starts watching the files in the directory.
+	Watch(dir string) error
+	// Returns true if the files in the directory are being watched.
+	Watching(dir string) bool
+	// Returns the channel on which the paths of changed files are delivered.
+	// An empty path means changes were lost. The channel is closed if the
+	// notifier fails.
+	Events() <-chan string
+	Close()
+}
+
+// A log file rotated away from its original path, i.e. "app.log.2.gz" is
+// rotation 2 of "app.log".
+type rotatedFile struct {
+	path       string
+	rotation   int
+	compressed bool
+}
+
+type rotatedFiles []rotatedFile
+
+func (r rotatedFiles) Len() int           { return len(r) }
+func (r rotatedFiles) Less(i, j int) bool { return r[i].rotation > r[j].rotation }
+func (r rotatedFiles) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// Returns the rotated versions of the log file, oldest first.
+func findRotated(fileName string) (rotated rotatedFiles) {
+	paths, _ := filepath.Glob(fileName + ".*")
+	for _, path := range paths {
+		file := rotatedFile{path: path}
+		suffix := strings.TrimPrefix(path, fileName+".")
+		if strings.HasSuffix(suffix, ".gz") {
+			suffix = strings.TrimSuffix(suffix, ".gz")
+			file.compressed = true
+		}
+		var err error
+		if file.rotation, err = strconv.Atoi(suffix); err != nil {
+			continue
+		}
+		rotated = append(rotated, file)
+	}
+	sort.Sort(rotated)
+	return
+}
+
+// Opens the rotated file, decompressing it if needed.
+func (file rotatedFile) open() (reader io.ReadCloser, err error) {
+	fd, err := os.Open(file.path)
+	if err != nil || !file.compressed {
+		return fd, err
+	}
+	gzReader, err := gzip.NewReader(fd)
+	if err != nil {
+		fd.Close()
+		return
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gzReader, fd}, nil
+}
+
+// Returns true if the rotated file is the one the entry was saved for.
+// Compressing a file changes its inode, so only the content is compared for
+// compressed files.
+func (entry *seekJournalEntry) matchesRotated(file rotatedFile) bool {
+	if !file.compressed {
+		fd, err := os.Open(file.path)
+		if err != nil {
+			return false
+		}
+		defer fd.Close()
+		return entry.matches(fd)
+	}
+	reader, err := file.open()
+	if err != nil {
+		return false
+	}
+	defer reader.Close()
+	hash, err := hashPrefix(reader, entry.HashLength)
+	return err == nil && hash == entry.Hash
+}
+
+// Reads the rest of the rotated file the seek journal entry was saved for,
+// and all of the rotated files newer than it. Returns false if the monitor
+// was stopped first.
+func (fm *FileMonitor) catchUp(fileName string, entry *seekJournalEntry) bool {
+	rotated := findRotated(fileName)
+	for i, file := range rotated {
+		if !entry.matchesRotated(file) {
+			continue
+		}
+		if !fm.readRotated(fileName, file, entry.Seek) {
+			return false
+		}
+		for _, newer := range rotated[i+1:] {
+			if !fm.readRotated(fileName, newer, 0) {
+				return false
+			}
+		}
+		break
+	}
+	return true
+}
+
+// Sends on the lines of the rotated file from the offset to its end, as if
+// they were read from the log file itself.
+func (fm *FileMonitor) readRotated(fileName string, file rotatedFile,
+	offset int64) bool {
+
+	reader, err := file.open()
+	if err != nil {
+		return true // nothing we can do
+	}
+	defer reader.Close()
+	if _, err = io.CopyN(ioutil.Discard, reader, offset); err != nil {
+		return true
+	}
+	bufReader := bufio.NewReader(reader)
+	readLine, err := bufReader.ReadString('\n')
+	for len(readLine) > 0 {
+		if !fm.addLine(fileName, readLine) {
+			return false
+		}
+		if err != nil {
+			break
+		}
+		readLine, err = bufReader.ReadString('\n')
+	}
+	return fm.flushRecord(fileName)
+}
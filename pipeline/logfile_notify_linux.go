@@ -0,0 +1,132 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Changes to the files in a watched directory that we want to hear about.
+const inotifyMask = syscall.IN_MODIFY | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// Size of the buffer inotify events are read into, enough for 64 events w/
+// the longest possible file names.
+const inotifyBufferSize = 64 * (syscall.SizeofInotifyEvent + 256)
+
+// fileNotifier that uses inotify to watch directories.
+type inotifyNotifier struct {
+	fd   int
+	file *os.File
+	lock sync.Mutex
+	// Watched directories by watch descriptor, and vice versa.
+	dirs   map[int32]string
+	wds    map[string]int32
+	events chan string
+	closed chan bool
+}
+
+func newFileNotifier() (fileNotifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	notifier := &inotifyNotifier{
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		dirs:   make(map[int32]string),
+		wds:    make(map[string]int32),
+		events: make(chan string),
+		closed: make(chan bool),
+	}
+	go notifier.read()
+	return notifier, nil
+}
+
+func (self *inotifyNotifier) Watch(dir string) error {
+	dir = filepath.Clean(dir)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, ok := self.wds[dir]; ok {
+		return nil
+	}
+	wd, err := syscall.InotifyAddWatch(self.fd, dir, inotifyMask)
+	if err != nil {
+		return os.NewSyscallError("inotify_add_watch", err)
+	}
+	self.wds[dir] = int32(wd)
+	self.dirs[int32(wd)] = dir
+	return nil
+}
+
+func (self *inotifyNotifier) Watching(dir string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	_, ok := self.wds[filepath.Clean(dir)]
+	return ok
+}
+
+func (self *inotifyNotifier) Events() <-chan string {
+	return self.events
+}
+
+func (self *inotifyNotifier) Close() {
+	close(self.closed)
+	self.file.Close() // ends the read loop
+}
+
+// Reads inotify events and delivers the paths of the files they're for until
+// the notifier is closed.
+func (self *inotifyNotifier) read() {
+	defer close(self.events)
+	buf := make([]byte, inotifyBufferSize)
+	for {
+		n, err := self.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			offset = nameStart + int(event.Len)
+			var path string
+			if event.Mask&syscall.IN_Q_OVERFLOW == 0 {
+				name := strings.TrimRight(string(buf[nameStart:offset]), "\x00")
+				self.lock.Lock()
+				dir, ok := self.dirs[event.Wd]
+				if event.Mask&syscall.IN_IGNORED != 0 {
+					// The directory went away, it'll need a new watch.
+					delete(self.dirs, event.Wd)
+					delete(self.wds, dir)
+				}
+				self.lock.Unlock()
+				if !ok || name == "" {
+					continue
+				}
+				path = filepath.Join(dir, name)
+			}
+			select {
+			case self.events <- path:
+			case <-self.closed:
+				return
+			}
+		}
+	}
+}
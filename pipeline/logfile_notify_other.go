@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import "errors"
+
+// File change notifications are only supported on Linux, elsewhere the
+// FileMonitor polls.
+func newFileNotifier() (fileNotifier, error) {
+	return nil, errors.New("file change notifications aren't supported")
+}
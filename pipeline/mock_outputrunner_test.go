@@ -64,6 +64,16 @@ func (_mr *_MockOutputRunnerRecorder) LogMessage(arg0 interface{}) *gomock.Call
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "LogMessage", arg0)
 }
 
+func (_m *MockOutputRunner) MatchRunner() *MatchRunner {
+	ret := _m.ctrl.Call(_m, "MatchRunner")
+	ret0, _ := ret[0].(*MatchRunner)
+	return ret0
+}
+
+func (_mr *_MockOutputRunnerRecorder) MatchRunner() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MatchRunner")
+}
+
 func (_m *MockOutputRunner) Name() string {
 	ret := _m.ctrl.Call(_m, "Name")
 	ret0, _ := ret[0].(string)
@@ -112,6 +122,16 @@ func (_mr *_MockOutputRunnerRecorder) Start(arg0, arg1 interface{}) *gomock.Call
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Start", arg0, arg1)
 }
 
+func (_m *MockOutputRunner) StopChan() <-chan bool {
+	ret := _m.ctrl.Call(_m, "StopChan")
+	ret0, _ := ret[0].(<-chan bool)
+	return ret0
+}
+
+func (_mr *_MockOutputRunnerRecorder) StopChan() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "StopChan")
+}
+
 func (_m *MockOutputRunner) Ticker() <-chan time.Time {
 	ret := _m.ctrl.Call(_m, "Ticker")
 	ret0, _ := ret[0].(<-chan time.Time)
@@ -16,6 +16,8 @@
 package pipeline
 
 import (
+	"code.google.com/p/goprotobuf/proto"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"github.com/mozilla-services/heka/client"
@@ -47,6 +49,13 @@ type OutputRunner interface {
 	// Wraps provided PipelinePack in a PipelineCapture (with nil Capture
 	// value) and drops it on the Output's input channel.
 	Deliver(pack *PipelinePack)
+	// Returns the associated MatchRunner, if any.
+	MatchRunner() *MatchRunner
+	// Returns a channel that's closed when the Output is being stopped,
+	// either because it's been removed or because Heka is shutting down.
+	// Outputs that block outside of their input channel loop (e.g. while
+	// reconnecting) should give up when it closes.
+	StopChan() <-chan bool
 }
 
 // Heka Output plugin type.
@@ -300,14 +309,19 @@ func (o *FileOutput) committer(wg *sync.WaitGroup) {
 		}
 	}
 
+	// The output may be stopped by a config reload while Heka keeps running,
+	// so stop listening for reload events.
+	notify.Stop(RELOAD, hupChan)
 	o.file.Close()
 	wg.Done()
 }
 
 // Output plugin that sends messages via TCP using the Heka protocol.
 type TcpOutput struct {
-	address    string
-	connection net.Conn
+	address     string
+	connection  net.Conn
+	conf        *TcpOutputConfig
+	goTlsConfig *tls.Config
 }
 
 // ConfigStruct for TcpOutput plugin.
@@ -315,22 +329,138 @@ type TcpOutputConfig struct {
 	// String representation of the TCP address to which this output should be
 	// sending data.
 	Address string
+	// Set to true if the connection should be made using TLS.
+	UseTls bool `toml:"use_tls"`
+	// TLS settings, used only if UseTls is true.
+	Tls TlsConfig `toml:"tls"`
+	// Set to true to send messages in batches that must be acknowledged by
+	// the receiving TcpInput, retransmitting any unacked batches after a
+	// reconnect.
+	UseAcks bool `toml:"use_acks"`
+	// Maximum number of messages in a single batch, default 100.
+	BatchSize int `toml:"batch_size"`
+	// Maximum time a partial batch will wait before being sent, in
+	// milliseconds, default 100.
+	FlushInterval int `toml:"flush_interval"`
+	// Time to wait for a batch to be acked before the connection is
+	// considered broken, in milliseconds, default 10000.
+	AckTimeout int `toml:"ack_timeout"`
+	// Maximum number of batches awaiting acks; no more messages will be
+	// accepted until some are acked, default 50.
+	MaxUnackedBatches int `toml:"max_unacked_batches"`
+	// Initial delay between reconnect attempts, in milliseconds, default 100.
+	// Doubles w/ each failed attempt.
+	ReconnectDelay int `toml:"reconnect_delay"`
+	// Upper bound on the delay between reconnect attempts, in milliseconds,
+	// default 30000.
+	MaxReconnectDelay int `toml:"max_reconnect_delay"`
 }
 
 func (t *TcpOutput) ConfigStruct() interface{} {
-	return &TcpOutputConfig{Address: "localhost:9125"}
+	return &TcpOutputConfig{
+		Address:           "localhost:9125",
+		BatchSize:         100,
+		FlushInterval:     100,
+		AckTimeout:        10000,
+		MaxUnackedBatches: 50,
+		ReconnectDelay:    100,
+		MaxReconnectDelay: 30000,
+	}
 }
 
 func (t *TcpOutput) Init(config interface{}) (err error) {
-	conf := config.(*TcpOutputConfig)
-	t.address = conf.Address
-	t.connection, err = net.Dial("tcp", t.address)
+	t.conf = config.(*TcpOutputConfig)
+	t.address = t.conf.Address
+	for name, value := range map[string]int{
+		"batch_size":          t.conf.BatchSize,
+		"flush_interval":      t.conf.FlushInterval,
+		"ack_timeout":         t.conf.AckTimeout,
+		"max_unacked_batches": t.conf.MaxUnackedBatches,
+	} {
+		if value <= 0 {
+			return fmt.Errorf("%s must be greater than zero, got %d", name, value)
+		}
+	}
+	if t.conf.UseTls {
+		if t.goTlsConfig, err = t.conf.Tls.ClientConfig(); err != nil {
+			return fmt.Errorf("TLS init failed: %s", err)
+		}
+	}
+	return t.dial()
+}
+
+// Dials the configured address, only replacing the current connection if the
+// dial succeeds so there's always something to write to (and close).
+func (t *TcpOutput) dial() (err error) {
+	var conn net.Conn
+	if t.goTlsConfig != nil {
+		conn, err = tls.Dial("tcp", t.address, t.goTlsConfig)
+	} else {
+		conn, err = net.Dial("tcp", t.address)
+	}
+	if err == nil {
+		t.connection = conn
+	}
 	return
 }
 
+// Closes the current connection and dials again until a new connection is
+// made, backing off exponentially between attempts. Returns false w/o
+// connecting if the output is stopped in the meantime.
+func (t *TcpOutput) reconnect(or OutputRunner) bool {
+	t.connection.Close()
+	delay := time.Duration(t.conf.ReconnectDelay) * time.Millisecond
+	maxDelay := time.Duration(t.conf.MaxReconnectDelay) * time.Millisecond
+	stop := or.StopChan()
+	for {
+		select {
+		case <-stop:
+			return false
+		default:
+		}
+		err := t.dial()
+		if err == nil {
+			or.LogMessage(fmt.Sprintf("reconnected to %s", t.address))
+			return true
+		}
+		or.LogError(fmt.Errorf("reconnecting to %s: %s", t.address, err))
+		select {
+		case <-time.After(delay):
+		case <-stop:
+			return false
+		}
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// Writes the provided bytes to the connection, reconnecting and trying again
+// if the write fails. Returns false if the bytes couldn't be written because
+// the output is being stopped.
+func (t *TcpOutput) write(or OutputRunner, outBytes []byte) bool {
+	for {
+		n, e := t.connection.Write(outBytes)
+		if e == nil && n == len(outBytes) {
+			return true
+		}
+		if e != nil {
+			or.LogError(fmt.Errorf("writing to %s: %s", t.address, e))
+		} else {
+			or.LogError(fmt.Errorf("truncated output to: %s", t.address))
+		}
+		if !t.reconnect(or) {
+			return false
+		}
+	}
+}
+
 func (t *TcpOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	if t.conf != nil && t.conf.UseAcks {
+		return t.runAcked(or)
+	}
+
 	var e error
-	var n int
 	outBytes := make([]byte, 0, 2000)
 
 	for plc := range or.InChan() {
@@ -342,12 +472,11 @@ func (t *TcpOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 			continue
 		}
 
-		if n, e = t.connection.Write(outBytes); e != nil {
-			or.LogError(fmt.Errorf("writing to %s: %s", t.address, e))
-		} else if n != len(outBytes) {
-			or.LogError(fmt.Errorf("truncated output to: %s", t.address))
+		if !t.write(or, outBytes) {
+			or.LogError(fmt.Errorf("dropped message, no connection to: %s",
+				t.address))
 		}
-		
+
 		plc.Pack.Recycle()
 	}
 
@@ -355,3 +484,140 @@ func (t *TcpOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 
 	return
 }
+
+// Run loop used when acks are enabled. Messages are gathered into batches,
+// each batch is held until the TcpInput on the other end acks it, and every
+// unacked batch is resent whenever the connection has to be reestablished.
+func (t *TcpOutput) runAcked(or OutputRunner) (err error) {
+	var (
+		e        error
+		msgBytes []byte
+		batch    [][]byte
+		unacked  []*ackBatch
+		plc      *PipelineCapture
+		inChan   chan *PipelineCapture
+		conn     net.Conn
+		seq      uint64
+	)
+	nextSeq := uint64(1)
+	ok := true
+	acks := make(chan uint64, t.conf.MaxUnackedBatches)
+	broken := make(chan net.Conn, 1)
+	done := make(chan bool)
+	defer close(done)
+
+	flushTicker := time.NewTicker(time.Duration(t.conf.FlushInterval) * time.Millisecond)
+	defer flushTicker.Stop()
+	ackTimeout := time.Duration(t.conf.AckTimeout) * time.Millisecond
+	ackTicker := time.NewTicker(ackTimeout / 2)
+	defer ackTicker.Stop()
+
+	// Resends every unacked batch over a fresh connection.
+	retransmit := func() bool {
+		for {
+			if !t.reconnect(or) {
+				return false
+			}
+			go readAcks(t.connection, acks, broken, done)
+			sent := true
+			for _, b := range unacked {
+				b.sentAt = time.Now()
+				if _, e = t.connection.Write(b.data); e != nil {
+					or.LogError(fmt.Errorf("resending to %s: %s", t.address, e))
+					sent = false
+					break
+				}
+			}
+			if sent {
+				return true
+			}
+		}
+	}
+
+	// Forgets about a batch once it has been acked.
+	acked := func(seq uint64) {
+		for i, b := range unacked {
+			if b.seq == seq {
+				unacked = append(unacked[:i], unacked[i+1:]...)
+				return
+			}
+		}
+	}
+
+	// Encodes and sends the current batch, holding on to it until acked.
+	flush := func() bool {
+		data, e := encodeAckBatch(nextSeq, batch)
+		batch = batch[:0]
+		if e != nil {
+			or.LogError(e)
+			return true
+		}
+		b := &ackBatch{seq: nextSeq, data: data, sentAt: time.Now()}
+		nextSeq++
+		unacked = append(unacked, b)
+		if _, e = t.connection.Write(data); e != nil {
+			or.LogError(fmt.Errorf("writing to %s: %s", t.address, e))
+			return retransmit()
+		}
+		return true
+	}
+
+	go readAcks(t.connection, acks, broken, done)
+	for ok {
+		inChan = or.InChan()
+		if len(unacked) >= t.conf.MaxUnackedBatches {
+			inChan = nil // Stop accepting messages until we get some acks.
+		}
+		select {
+		case plc, ok = <-inChan:
+			if !ok {
+				break
+			}
+			msgBytes, e = proto.Marshal(plc.Pack.Message)
+			plc.Pack.Recycle()
+			if e != nil {
+				or.LogError(fmt.Errorf("can't encode message: %s", e))
+				continue
+			}
+			batch = append(batch, msgBytes)
+			if len(batch) >= t.conf.BatchSize {
+				ok = flush()
+			}
+		case <-flushTicker.C:
+			if len(batch) > 0 {
+				ok = flush()
+			}
+		case seq = <-acks:
+			acked(seq)
+		case conn = <-broken:
+			if conn == t.connection {
+				or.LogError(fmt.Errorf("lost connection to %s", t.address))
+				ok = retransmit()
+			}
+		case <-ackTicker.C:
+			if len(unacked) > 0 && time.Since(unacked[0].sentAt) > ackTimeout {
+				or.LogError(fmt.Errorf("timed out waiting for acks from %s",
+					t.address))
+				ok = retransmit()
+			}
+		}
+	}
+
+	// Send whatever is left and give the receiver a chance to ack it.
+	if len(batch) == 0 || flush() {
+		deadline := time.After(ackTimeout)
+		for len(unacked) > 0 {
+			select {
+			case seq = <-acks:
+				acked(seq)
+			case <-deadline:
+				or.LogError(fmt.Errorf("%d batches never acked by %s",
+					len(unacked), t.address))
+				unacked = nil
+			}
+		}
+	}
+
+	t.connection.Close()
+	return
+}
@@ -19,8 +19,11 @@ import (
 	"bytes"
 	"code.google.com/p/gomock/gomock"
 	"code.google.com/p/goprotobuf/proto"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/mozilla-services/heka/message"
 	ts "github.com/mozilla-services/heka/testsupport"
 	gs "github.com/rafrombrc/gospec/src/gospec"
 	"io/ioutil"
@@ -253,6 +256,20 @@ func OutputsSpec(c gs.Context) {
 			c.Expect(bytes.Equal(b, (outBytes)[:len(b)]), gs.IsTrue)
 		})
 
+		c.Specify("rejects non-positive batching settings", func() {
+			config.UseAcks = true
+			config.FlushInterval = 0
+			err := tcpOutput.Init(config)
+			c.Expect(err.Error(), gs.Equals,
+				"flush_interval must be greater than zero, got 0")
+
+			config.FlushInterval = 100
+			config.MaxUnackedBatches = -1
+			err = tcpOutput.Init(config)
+			c.Expect(err.Error(), gs.Equals,
+				"max_unacked_batches must be greater than zero, got -1")
+		})
+
 		c.Specify("writes out to the network", func() {
 			inChanCall := oth.MockOutputRunner.EXPECT().InChan()
 			inChanCall.Return(inChan)
@@ -297,6 +314,154 @@ func OutputsSpec(c gs.Context) {
 			result = <-ch
 			c.Expect(result, gs.Equals, string(matchBytes))
 		})
+
+		c.Specify("resends unacked batches after reconnecting", func() {
+			config.Address = "localhost:9126"
+			config.UseAcks = true
+			config.BatchSize = 2
+			config.ReconnectDelay = 10
+			inChanCall := oth.MockOutputRunner.EXPECT().InChan()
+			inChanCall.Return(inChan).AnyTimes()
+			oth.MockOutputRunner.EXPECT().LogError(gomock.Any()).AnyTimes()
+			oth.MockOutputRunner.EXPECT().LogMessage(gomock.Any()).AnyTimes()
+			var stopChan <-chan bool = make(chan bool)
+			oth.MockOutputRunner.EXPECT().StopChan().Return(stopChan).AnyTimes()
+
+			// Reads a single full batch from the connection.
+			readBatch := func(conn net.Conn) (seq uint64, payloads []string) {
+				buf := make([]byte, 0, 4096)
+				readBuf := make([]byte, 4096)
+				header := &message.Header{}
+				msgBytes := make([]byte, message.MAX_MESSAGE_SIZE)
+				for {
+					n, err := conn.Read(readBuf)
+					if err != nil {
+						return
+					}
+					buf = append(buf, readBuf[:n]...)
+					for {
+						pos, ok := findMessage(buf, header, &msgBytes)
+						if !ok {
+							break
+						}
+						buf = buf[pos:]
+						seq = header.GetBatchSequence()
+						msg := new(message.Message)
+						proto.Unmarshal(msgBytes, msg)
+						payloads = append(payloads, msg.GetPayload())
+						if uint32(len(payloads)) == header.GetBatchSize() {
+							return
+						}
+						header.Reset()
+					}
+				}
+			}
+
+			type batchResult struct {
+				seq      uint64
+				payloads []string
+			}
+			ch := make(chan batchResult, 2)
+			ln, err := net.Listen("tcp", config.Address)
+			c.Assume(err, gs.IsNil)
+			defer ln.Close()
+			go func() {
+				// Drop the first connection w/o acking.
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				seq, payloads := readBatch(conn)
+				ch <- batchResult{seq, payloads}
+				conn.Close()
+
+				conn, err = ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				seq, payloads = readBatch(conn)
+				ch <- batchResult{seq, payloads}
+				ackBytes := make([]byte, ACK_SIZE)
+				binary.BigEndian.PutUint64(ackBytes, seq)
+				conn.Write(ackBytes)
+				conn.Read(ackBytes) // wait for the output to hang up
+			}()
+
+			err = tcpOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+			pack.Message.SetPayload("first")
+			pack2 := NewPipelinePack(pConfig.inputRecycleChan)
+			pack2.Message = getTestMessage()
+			pack2.Message.SetPayload("second")
+			pack2.Decoded = true
+
+			runDone := make(chan bool)
+			go func() {
+				tcpOutput.Run(oth.MockOutputRunner, oth.MockHelper)
+				close(runDone)
+			}()
+			inChan <- plc
+			inChan <- &PipelineCapture{Pack: pack2}
+
+			first := <-ch
+			c.Expect(len(first.payloads), gs.Equals, 2)
+			second := <-ch
+			c.Expect(second.seq, gs.Equals, first.seq)
+			c.Expect(second.payloads[0], gs.Equals, "first")
+			c.Expect(second.payloads[1], gs.Equals, "second")
+
+			close(inChan)
+			select {
+			case <-runDone:
+			case <-time.After(time.Second):
+				c.Expect("Run returned", gs.Equals, "Run blocked")
+			}
+		})
+
+		c.Specify("stops reconnecting when the output is stopped", func() {
+			// Nothing listens here, and w/o the stop channel the output
+			// would wait a full minute before dialing again.
+			config.Address = "localhost:9127"
+			config.ReconnectDelay = 60000
+			tcpOutput.conf = config
+			tcpOutput.address = config.Address
+			mockConn := tcpOutput.connection.(*ts.MockConn)
+			mockConn.EXPECT().Write(gomock.Any()).Return(0,
+				errors.New("connection reset")).AnyTimes()
+			mockConn.EXPECT().Close().AnyTimes()
+
+			stopChan := make(chan bool)
+			var stop <-chan bool = stopChan
+			oth.MockOutputRunner.EXPECT().InChan().Return(inChan).AnyTimes()
+			oth.MockOutputRunner.EXPECT().StopChan().Return(stop).AnyTimes()
+			errChan := make(chan error, 10)
+			oth.MockOutputRunner.EXPECT().LogError(gomock.Any()).Do(
+				func(err error) {
+					select {
+					case errChan <- err:
+					default:
+					}
+				}).AnyTimes()
+
+			runDone := make(chan bool)
+			go func() {
+				tcpOutput.Run(oth.MockOutputRunner, oth.MockHelper)
+				close(runDone)
+			}()
+			inChan <- plc
+			// Wait for the failed write and the first reconnect attempt.
+			<-errChan
+			<-errChan
+
+			close(stopChan)
+			close(inChan)
+			select {
+			case <-runDone:
+			case <-time.After(time.Second):
+				c.Expect("Run returned", gs.Equals, "Run blocked")
+			}
+		})
 	})
 
 	c.Specify("Runner recovers from panic in output's `Run()` method", func() {
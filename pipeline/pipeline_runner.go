@@ -41,6 +41,8 @@ type GlobalConfigStruct struct {
 	PluginChanSize  int
 	MaxMsgLoops     uint
 	Stopping        bool
+	// Base directory under which plugins can store persistent data.
+	BaseDir string
 }
 
 // Creates a GlobalConfigStruct object populated w/ default values.
@@ -50,6 +52,7 @@ func DefaultGlobals() (globals *GlobalConfigStruct) {
 		DecoderPoolSize: 4,
 		PluginChanSize:  50,
 		MaxMsgLoops:     4,
+		BaseDir:         "/var/cache/hekad",
 	}
 }
 
@@ -91,6 +94,13 @@ type pRunnerBase struct {
 	name   string
 	plugin Plugin
 	h      PluginHelper
+	// Used to re-initialize or recreate the plugin when it's restarted.
+	wrapper *PluginWrapper
+	restart RestartPolicy
+	// Number of consecutive restarts.
+	retries    int
+	retryDelay time.Duration
+	lastStart  time.Time
 }
 
 func (pr *pRunnerBase) Name() string {
@@ -105,6 +115,107 @@ func (pr *pRunnerBase) Plugin() Plugin {
 	return pr.plugin
 }
 
+// Waits out the restart delay after the plugin's Run method exited, returning
+// false if the restart policy says the plugin shouldn't be restarted or Heka
+// started shutting down in the meantime.
+func (pr *pRunnerBase) waitToRestart(config *PipelineConfig,
+	runner PluginRunner) bool {
+
+	if !config.ifRegistered(runner, func() {}) {
+		return false
+	}
+	maxDelay := time.Duration(pr.restart.MaxDelay) * time.Millisecond
+	if time.Since(pr.lastStart) > maxDelay {
+		pr.retries = 0
+	}
+	if pr.retries == 0 {
+		pr.retryDelay = time.Duration(pr.restart.Delay) * time.Millisecond
+	}
+	if pr.restart.MaxRetries > 0 && pr.retries >= pr.restart.MaxRetries {
+		runner.LogError(fmt.Errorf("giving up after %d restarts", pr.retries))
+		return false
+	}
+	timer := time.NewTimer(pr.retryDelay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-config.stopChan:
+		return false
+	}
+	if Globals().Stopping {
+		return false
+	}
+	if pr.retryDelay *= 2; pr.retryDelay > maxDelay {
+		pr.retryDelay = maxDelay
+	}
+	pr.retries++
+	return true
+}
+
+// Calls Init on the plugin again, or creates a new instance if the restart
+// policy says so.
+func (pr *pRunnerBase) reinitPlugin() (plugin Plugin, err error) {
+	if pr.restart.Recreate {
+		var p interface{}
+		if p, err = pr.wrapper.CreateWithError(); err == nil {
+			plugin = p.(Plugin)
+		}
+		return
+	}
+
+	defer func() {
+		// Slight protection against Init call into plugin code.
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Init() panicked: %s", r)
+		}
+	}()
+	plugin = pr.plugin
+	err = plugin.Init(pr.wrapper.configCreator())
+	return
+}
+
+// Decides whether the plugin should be restarted after its Run method exited
+// w/ the provided error (or nil), and if so re-initializes it, passes it to
+// `setPlugin`, and emits a `heka.plugin-restarted` message. Returns false if
+// the plugin isn't to be restarted.
+func (pr *pRunnerBase) restartPlugin(h PluginHelper, runner PluginRunner,
+	cause error, setPlugin func(plugin Plugin)) bool {
+
+	if pr.wrapper == nil || pr.restart.MaxRetries == 0 {
+		return false
+	}
+	config := h.PipelineConfig()
+	for pr.waitToRestart(config, runner) {
+		plugin, err := pr.reinitPlugin()
+		if err != nil {
+			runner.LogError(fmt.Errorf("restart failed: %s", err))
+			continue
+		}
+		// Swap the plugin in w/ the runner's plugin set locked, so a
+		// concurrent removal or shutdown stops the right instance.
+		if !config.ifRegistered(runner, func() { setPlugin(plugin) }) {
+			if input, ok := plugin.(Input); ok {
+				input.Stop()
+			}
+			return false
+		}
+
+		pack := config.PipelinePack(0)
+		pack.Message.SetType("heka.plugin-restarted")
+		pack.Message.SetLogger(pr.name)
+		if cause != nil {
+			pack.Message.SetPayload(cause.Error())
+		} else {
+			pack.Message.SetPayload("exited unexpectedly")
+		}
+		newIntField(pack.Message, "Restarts", pr.retries)
+		config.router.InChan() <- pack
+		runner.LogMessage(fmt.Sprintf("restarted (%d)", pr.retries))
+		return true
+	}
+	return false
+}
+
 // This one struct provides the implementation of both FilterRunner and
 // OutputRunner interfaces.
 type foRunner struct {
@@ -114,6 +225,14 @@ type foRunner struct {
 	ticker     <-chan time.Time
 	inChan     chan *PipelineCapture
 	h          PluginHelper
+	queue      *diskQueue
+	// Closed to stop feeding queued records to the output, and by the
+	// replay goroutine once it's done.
+	replayStop chan bool
+	replayDone chan bool
+	replayOnce sync.Once
+	// Closed when the output is removed or Heka shuts down.
+	stopChan chan bool
 }
 
 // Creates and returns foRunner pointer for use as either a FilterRunner or an
@@ -121,6 +240,7 @@ type foRunner struct {
 func NewFORunner(name string, plugin Plugin) (runner *foRunner) {
 	runner = &foRunner{pRunnerBase: pRunnerBase{name: name, plugin: plugin}}
 	runner.inChan = make(chan *PipelineCapture, Globals().PluginChanSize)
+	runner.stopChan = make(chan bool)
 	return
 }
 
@@ -130,34 +250,58 @@ func (foRunner *foRunner) Start(h PluginHelper, wg *sync.WaitGroup) (err error)
 		foRunner.ticker = time.Tick(foRunner.tickLength)
 	}
 
+	if foRunner.matcher != nil {
+		if foRunner.queue != nil {
+			// Matched packs go to disk, the output is fed from there.
+			spoolChan := make(chan *PipelineCapture, Globals().PluginChanSize)
+			foRunner.matcher.StartClosing(spoolChan)
+			go foRunner.spool(spoolChan)
+			foRunner.startReplay()
+		} else {
+			foRunner.matcher.Start(foRunner.inChan)
+		}
+	}
+
 	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				// Only recovers from panics in the main `Run` method
-				// goroutine, but better than nothing.
-				foRunner.LogError(fmt.Errorf("PANIC: %s", r))
+		defer wg.Done()
+
+		var runErr error
+		setPlugin := func(plugin Plugin) { foRunner.plugin = plugin }
+		for {
+			foRunner.lastStart = time.Now()
+			if runErr = foRunner.run(h); runErr != nil {
+				foRunner.LogError(runErr)
+			} else {
+				foRunner.LogMessage("stopped")
+			}
+			if !foRunner.restartPlugin(h, foRunner, runErr, setPlugin) {
+				break
 			}
-			wg.Done()
-		}()
-
-		if foRunner.matcher != nil {
-			foRunner.matcher.Start(foRunner.inChan)
 		}
 
-		// `Run` method only returns if there's an error or we're shutting
-		// down.
-		if filter, ok := foRunner.plugin.(Filter); ok {
-			err = filter.Run(foRunner, h)
-			h.PipelineConfig().RemoveFilterRunner(foRunner.name)
-		} else if output, ok := foRunner.plugin.(Output); ok {
-			err = output.Run(foRunner, h)
+		if _, ok := foRunner.plugin.(Filter); ok {
+			h.PipelineConfig().removeFilterRunner(foRunner.name, foRunner)
+		} else if foRunner.queue != nil {
+			foRunner.stopReplay()
 		}
-		if err != nil {
-			err = fmt.Errorf("Plugin '%s' error: %s", foRunner.name, err)
-		} else {
-			foRunner.LogMessage("stopped")
+	}()
+	return
+}
+
+// Calls the plugin's `Run` method, which only returns if there's an error or
+// we're shutting down. Panics are returned as errors.
+func (foRunner *foRunner) run(h PluginHelper) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("PANIC: %s", r)
 		}
 	}()
+
+	if filter, ok := foRunner.plugin.(Filter); ok {
+		err = filter.Run(foRunner, h)
+	} else if output, ok := foRunner.plugin.(Output); ok {
+		err = output.Run(foRunner, h)
+	}
 	return
 }
 
@@ -199,6 +343,10 @@ func (foRunner *foRunner) InChan() (inChan chan *PipelineCapture) {
 	return foRunner.inChan
 }
 
+func (foRunner *foRunner) StopChan() <-chan bool {
+	return foRunner.stopChan
+}
+
 func (foRunner *foRunner) MatchRunner() *MatchRunner {
 	return foRunner.matcher
 }
@@ -230,6 +378,13 @@ type PipelinePack struct {
 	// String id of the verified signer of the accompanying Message object, if
 	// any.
 	Signer string
+	// Subject of the verified TLS client certificate presented by the
+	// connection on which the accompanying Message object arrived, if any.
+	CertSubject string
+	// Callback to be invoked once the pack has been handed off to the router
+	// (or dropped as undeliverable), used by inputs that acknowledge delivery
+	// back to the sender.
+	Ack func()
 	// Number of times the current message chain has generated new messages
 	// and inserted them into the pipeline.
 	MsgLoopCount uint
@@ -267,6 +422,8 @@ func (p *PipelinePack) Zero() {
 	p.RefCount = 1
 	p.MsgLoopCount = 0
 	p.Signer = ""
+	p.CertSubject = ""
+	p.Ack = nil
 
 	// TODO: Possibly zero the message instead depending on benchmark
 	// results of re-allocating a new message
@@ -290,15 +447,13 @@ func Run(config *PipelineConfig) {
         SIGUSR1 := syscall.Signal(0xa) // since it is not defined for Windows
 	log.Println("Starting hekad...")
 
-	var inputsWg sync.WaitGroup
-	var outputsWg sync.WaitGroup
 	var err error
 
 	for name, output := range config.OutputRunners {
-		outputsWg.Add(1)
-		if err = output.Start(config, &outputsWg); err != nil {
+		config.outputsWg.Add(1)
+		if err = output.Start(config, &config.outputsWg); err != nil {
 			log.Printf("Output '%s' failed to start: %s", name, err)
-			outputsWg.Done()
+			config.outputsWg.Done()
 			continue
 		}
 		log.Println("Output started: ", name)
@@ -323,10 +478,10 @@ func Run(config *PipelineConfig) {
 	config.router.Start()
 
 	for name, input := range config.InputRunners {
-		inputsWg.Add(1)
-		if err = input.Start(config, &inputsWg); err != nil {
+		config.inputsWg.Add(1)
+		if err = input.Start(config, &config.inputsWg); err != nil {
 			log.Printf("Input '%s' failed to start: %s", name, err)
-			inputsWg.Done()
+			config.inputsWg.Done()
 			continue
 		}
 		log.Printf("Input started: %s\n", name)
@@ -346,9 +501,13 @@ func Run(config *PipelineConfig) {
 				if err := notify.Post(RELOAD, nil); err != nil {
 					log.Println("Error sending reload event: ", err)
 				}
+				if err := config.Reload(); err != nil {
+					log.Println("Error reloading config: ", err)
+				}
 			case syscall.SIGINT:
 				log.Println("Shutdown initiated.")
 				globals.Stopping = true
+				close(config.stopChan)
 			case SIGUSR1:
 				log.Println("Queue report initiated.")
 				go config.allReportsMsg()
@@ -361,11 +520,13 @@ func Run(config *PipelineConfig) {
 			log.Printf("PANIC during shutdown: %s", r)
 		}
 	}()
+	config.inputsLock.Lock()
 	for _, input := range config.InputRunners {
 		input.Input().Stop()
 		log.Printf("Stop message sent to input '%s'", input.Name())
 	}
-	inputsWg.Wait()
+	config.inputsLock.Unlock()
+	config.inputsWg.Wait()
 
 	log.Println("Waiting for decoders shutdown")
 	config.decodersWg.Wait()
@@ -379,10 +540,19 @@ func Run(config *PipelineConfig) {
 	config.filtersLock.Unlock()
 	config.filtersWg.Wait()
 
+	config.outputsLock.Lock()
 	for _, output := range config.OutputRunners {
+		if runner, ok := output.(*foRunner); ok {
+			if runner.queue != nil {
+				// Queued records must stop flowing before the channel closes.
+				runner.stopReplay()
+			}
+			close(runner.stopChan)
+		}
 		close(output.InChan())
 		log.Printf("Stop message sent to output '%s'", output.Name())
 	}
-	outputsWg.Wait()
+	config.outputsLock.Unlock()
+	config.outputsWg.Wait()
 	log.Println("Shutdown complete.")
 }
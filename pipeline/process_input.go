@@ -0,0 +1,266 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bufio"
+	"code.google.com/p/go-uuid/uuid"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Input plugin implementation that runs a command, either once on every tick
+// of a ticker or as a single long-running process, and generates a message
+// for every line (or multi-line record) the command writes to stdout or
+// stderr. Each run ends w/ a message holding the command's exit status and
+// runtime. The command is started in its own process group so any children
+// it spawns are killed along w/ it.
+type ProcessInput struct {
+	// Command name used as the Logger of the generated messages.
+	name        string
+	recordStart *regexp.Regexp
+	stopChan    chan bool
+	ir          InputRunner
+	hostname    string
+	config      *ProcessInputConfig
+}
+
+// ConfigStruct for ProcessInput plugin.
+type ProcessInputConfig struct {
+	// Path of the program to run, looked up in the PATH if it has no slashes.
+	Command string `toml:"command"`
+	// Arguments passed to the program.
+	Args []string `toml:"args"`
+	// Additional "NAME=value" environment variables for the command, on top
+	// of hekad's own environment.
+	Env []string `toml:"env"`
+	// Working directory of the command, defaults to hekad's.
+	Directory string `toml:"directory"`
+	// Seconds between runs of the command. If 0 the command is expected to
+	// keep running, and its exit is treated as an error.
+	TickerInterval uint `toml:"ticker_interval"`
+	// Seconds a run may take before the command is killed, 0 for no limit.
+	Timeout uint `toml:"timeout"`
+	// Regex matching the first line of a multi-line record, if output lines
+	// are to be grouped into records.
+	RecordStartRegex string `toml:"record_start_regex"`
+}
+
+func (self *ProcessInput) ConfigStruct() interface{} {
+	return new(ProcessInputConfig)
+}
+
+func (self *ProcessInput) Init(config interface{}) (err error) {
+	self.config = config.(*ProcessInputConfig)
+	if self.config.Command == "" {
+		return fmt.Errorf("ProcessInput requires a `command`")
+	}
+	self.name = filepath.Base(self.config.Command)
+	self.recordStart = nil
+	if self.config.RecordStartRegex != "" {
+		if self.recordStart, err = regexp.Compile(self.config.RecordStartRegex); err != nil {
+			return fmt.Errorf("invalid record_start_regex: %s", err)
+		}
+	}
+	if self.hostname, err = os.Hostname(); err != nil {
+		return fmt.Errorf("can't get hostname: %s", err)
+	}
+	self.stopChan = make(chan bool)
+	return
+}
+
+func (self *ProcessInput) Run(ir InputRunner, h PluginHelper) (err error) {
+	self.ir = ir
+	if self.config.TickerInterval == 0 {
+		var exitStatus int
+		var stopped bool
+		if exitStatus, stopped, err = self.runCommand(); err == nil && !stopped {
+			err = fmt.Errorf("'%s' exited w/ status %d", self.name, exitStatus)
+		}
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(self.config.TickerInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		if _, stopped, err := self.runCommand(); stopped {
+			return nil
+		} else if err != nil {
+			ir.LogError(err)
+		}
+		select {
+		case <-ticker.C:
+		case <-self.stopChan:
+			return nil
+		}
+	}
+}
+
+func (self *ProcessInput) Stop() {
+	close(self.stopChan)
+}
+
+// Runs the command once, injecting its output as it's written and a final
+// message w/ its exit status. Returns an error only if the command couldn't
+// be run, or stopped == true if the input was stopped before the command
+// finished.
+func (self *ProcessInput) runCommand() (exitStatus int, stopped bool, err error) {
+	cmd := exec.Command(self.config.Command, self.config.Args...)
+	cmd.Dir = self.config.Directory
+	if len(self.config.Env) > 0 {
+		cmd.Env = append(os.Environ(), self.config.Env...)
+	}
+	setProcessGroup(cmd)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, false, fmt.Errorf("can't read stdout of '%s': %s", self.name, err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return 0, false, fmt.Errorf("can't read stderr of '%s': %s", self.name, err)
+	}
+
+	start := time.Now()
+	if err = cmd.Start(); err != nil {
+		return 0, false, fmt.Errorf("can't start '%s': %s", self.name, err)
+	}
+	pid := cmd.Process.Pid
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go self.readOutput(stdout, "stdout", pid, &wg)
+	go self.readOutput(stderr, "stderr", pid, &wg)
+	// The output has to be read in full before waiting on the command.
+	exited := make(chan error, 1)
+	go func() {
+		wg.Wait()
+		exited <- cmd.Wait()
+	}()
+
+	var timeout <-chan time.Time
+	if self.config.Timeout > 0 {
+		timer := time.NewTimer(time.Duration(self.config.Timeout) * time.Second)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var timedOut bool
+	select {
+	case err = <-exited:
+	case <-timeout:
+		timedOut = true
+		killProcessGroup(cmd)
+		err = <-exited
+	case <-self.stopChan:
+		killProcessGroup(cmd)
+		<-exited
+		return 0, true, nil
+	}
+	runtime := time.Since(start)
+
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return 0, false, fmt.Errorf("error running '%s': %s", self.name, err)
+		}
+		exitStatus = -1 // killed by a signal
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			exitStatus = status.ExitStatus()
+		}
+	}
+	self.sendExit(pid, exitStatus, runtime, timedOut)
+	return exitStatus, false, nil
+}
+
+// Injects a message for every line, or every record if we have a
+// recordStart regex, read from the command's stdout or stderr.
+func (self *ProcessInput) readOutput(reader io.Reader, stream string, pid int,
+	wg *sync.WaitGroup) {
+
+	defer wg.Done()
+	buffered := bufio.NewReader(reader)
+	var record string
+	for {
+		line, err := buffered.ReadString('\n')
+		if line != "" {
+			if self.recordStart == nil {
+				self.sendOutput(line, stream, pid)
+			} else {
+				if record != "" && self.recordStart.MatchString(line) {
+					self.sendOutput(record, stream, pid)
+					record = ""
+				}
+				record += line
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if record != "" {
+		self.sendOutput(record, stream, pid)
+	}
+}
+
+// Returns a pack populated w/ the fields common to all of our messages.
+func (self *ProcessInput) newPack(msgType string, pid int) *PipelinePack {
+	pack := <-self.ir.InChan()
+	msg := pack.Message
+	msg.SetUuid(uuid.NewRandom())
+	msg.SetTimestamp(time.Now().UnixNano())
+	msg.SetType(msgType)
+	msg.SetLogger(self.name)
+	msg.SetHostname(self.hostname)
+	msg.SetPid(int32(pid))
+	pack.Decoded = true
+	return pack
+}
+
+func (self *ProcessInput) sendOutput(payload, stream string, pid int) {
+	pack := self.newPack("process", pid)
+	pack.Message.SetPayload(payload)
+	if field, err := message.NewField("stream", stream, message.Field_RAW); err == nil {
+		pack.Message.AddField(field)
+	}
+	self.ir.Inject(pack)
+}
+
+func (self *ProcessInput) sendExit(pid, exitStatus int, runtime time.Duration,
+	timedOut bool) {
+
+	pack := self.newPack("process_exit", pid)
+	pack.Message.SetPayload(fmt.Sprintf("'%s' exited w/ status %d after %s",
+		self.name, exitStatus, runtime))
+	fields := []struct {
+		name  string
+		value interface{}
+	}{
+		{"exit_status", exitStatus},
+		{"runtime", runtime.Seconds()},
+		{"timed_out", timedOut},
+	}
+	for _, f := range fields {
+		if field, err := message.NewField(f.name, f.value, message.Field_RAW); err == nil {
+			pack.Message.AddField(field)
+		}
+	}
+	self.ir.Inject(pack)
+}
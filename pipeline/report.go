@@ -71,6 +71,11 @@ func PopulateReportMsg(pr PluginRunner, msg *message.Message) (err error) {
 		newIntField(msg, "InChanLength", len(fRunner.InChan()))
 		newIntField(msg, "MatchChanCapacity", cap(fRunner.MatchRunner().inChan))
 		newIntField(msg, "MatchChanLength", len(fRunner.MatchRunner().inChan))
+		newIntField(msg, "MatchDropped", int(fRunner.MatchRunner().Dropped()))
+		if runner, ok := fRunner.(*foRunner); ok && runner.queue != nil {
+			newIntField(msg, "QueueSize", int(runner.queue.Size()))
+			newIntField(msg, "QueueDropped", int(runner.queue.Dropped()))
+		}
 	} else if dRunner, ok := pr.(DecoderRunner); ok {
 		newIntField(msg, "InChanCapacity", cap(dRunner.InChan()))
 		newIntField(msg, "InChanLength", len(dRunner.InChan()))
@@ -79,6 +84,23 @@ func PopulateReportMsg(pr PluginRunner, msg *message.Message) (err error) {
 	return
 }
 
+// Returns a plugin's report data as generated by `PopulateReportMsg`, i.e. the
+// report message's field values (and payload, if any) keyed by name.
+func pluginReportData(pr PluginRunner) (data map[string]interface{}) {
+	msg := new(message.Message)
+	data = make(map[string]interface{})
+	if err := PopulateReportMsg(pr, msg); err != nil {
+		data["Error"] = err.Error()
+	}
+	for _, field := range msg.Fields {
+		data[field.GetName()] = field.GetValue()
+	}
+	if payload := msg.GetPayload(); payload != "" {
+		data["Payload"] = payload
+	}
+	return
+}
+
 // Generate recycle channel and plugin report messages and put them on the
 // provided channel as they're ready.
 func (pc *PipelineConfig) reports(reportChan chan *PipelinePack) {
@@ -88,6 +110,9 @@ func (pc *PipelineConfig) reports(reportChan chan *PipelinePack) {
 		msg    *message.Message
 		err, e error
 	)
+	// Work from copies, the running plugins can change while we report and
+	// the locks can't be held while waiting on reportChan.
+	inputs, filters, outputs := pc.runners()
 
 	pack = pc.PipelinePack(0)
 	msg = pack.Message
@@ -126,7 +151,7 @@ func (pc *PipelineConfig) reports(reportChan chan *PipelinePack) {
 		return
 	}
 
-	for name, runner := range pc.InputRunners {
+	for name, runner := range inputs {
 		pack = getReport(runner)
 		if len(pack.Message.Fields) > 0 || pack.Message.GetPayload() != "" {
 			setNameField(pack.Message, name)
@@ -142,12 +167,12 @@ func (pc *PipelineConfig) reports(reportChan chan *PipelinePack) {
 			reportChan <- pack
 		}
 	}
-	for name, runner := range pc.FilterRunners {
+	for name, runner := range filters {
 		pack = getReport(runner)
 		setNameField(pack.Message, name)
 		reportChan <- pack
 	}
-	for name, runner := range pc.OutputRunners {
+	for name, runner := range outputs {
 		pack = getReport(runner)
 		setNameField(pack.Message, name)
 		reportChan <- pack
@@ -16,6 +16,7 @@ package pipeline
 
 import (
 	"code.google.com/p/gomock/gomock"
+	"fmt"
 	"github.com/mozilla-services/heka/message"
 	ts "github.com/mozilla-services/heka/testsupport"
 	gs "github.com/rafrombrc/gospec/src/gospec"
@@ -173,5 +174,23 @@ func ReportSpec(c gs.Context) {
 			c.Expect(routerReport, gs.Not(gs.IsNil))
 			c.Expect(hasChannelData(routerReport.Message), gs.IsTrue)
 		})
+
+		c.Specify("reports while plugins are being added", func() {
+			reportChan := make(chan *PipelinePack)
+			go pc.reports(reportChan)
+			var count int
+			for _ = range reportChan {
+				// Stands in for an input added by a reload or the admin API.
+				pc.inputsLock.Lock()
+				pc.InputRunners[fmt.Sprintf("added%d", count)] = iRunner
+				pc.inputsLock.Unlock()
+				pc.filtersLock.Lock()
+				pc.FilterRunners[fmt.Sprintf("added%d", count)] = fRunner
+				pc.filtersLock.Unlock()
+				count++
+			}
+			// Only the plugins running when the reports started are included.
+			c.Expect(count, gs.Equals, 5)
+		})
 	})
 }
@@ -16,11 +16,13 @@
 package pipeline
 
 import (
+	"fmt"
 	"github.com/mozilla-services/heka/message"
 	"log"
 	"runtime"
 	"strings"
 	"sync/atomic"
+	"time"
 )
 
 // Public interface exposed by the Heka message router. The message router
@@ -32,16 +34,69 @@ type MessageRouter interface {
 	// Input channel from which the router gets messages to test against the
 	// registered plugin message_matchers.
 	InChan() chan *PipelinePack
-	// Channel holding a reference to all running message_matchers for easy
-	// access to the entire set.
+	// Channel to which filter MatchRunners are sent to be added to, or if
+	// already present removed from, the router.
 	MrChan() chan *MatchRunner
+	// Channel to which output MatchRunners are sent to be added to, or if
+	// already present removed from, the router.
+	OMrChan() chan *MatchRunner
 }
 
 type messageRouter struct {
 	inChan    chan *PipelinePack
 	mrChan    chan *MatchRunner
+	omrChan   chan *MatchRunner
 	fMatchers []*MatchRunner
 	oMatchers []*MatchRunner
+	index     *routeIndex
+}
+
+// Lookup tables that let the router skip matchers whose message_matcher
+// requires a Type or Logger value that a message doesn't have.
+type routeIndex struct {
+	// Matchers that require one of a set of Type values, keyed by Type.
+	byType map[string][]*MatchRunner
+	// Matchers w/o a Type requirement that require one of a set of Logger
+	// values, keyed by Logger.
+	byLogger map[string][]*MatchRunner
+	// Matchers that have to be tested against every message.
+	always []*MatchRunner
+}
+
+// Builds a routeIndex from the provided sets of matchers. Each matcher ends
+// up in exactly one of the index's groups so it's never sent a message more
+// than once.
+func newRouteIndex(matcherSets ...[]*MatchRunner) (index *routeIndex) {
+	index = &routeIndex{
+		byType:   make(map[string][]*MatchRunner),
+		byLogger: make(map[string][]*MatchRunner),
+	}
+	for _, matchers := range matcherSets {
+		for _, matcher := range matchers {
+			if matcher == nil {
+				continue
+			}
+			if matcher.types != nil {
+				for _, t := range matcher.types {
+					index.byType[t] = append(index.byType[t], matcher)
+				}
+			} else if matcher.loggers != nil {
+				for _, l := range matcher.loggers {
+					index.byLogger[l] = append(index.byLogger[l], matcher)
+				}
+			} else {
+				index.always = append(index.always, matcher)
+			}
+		}
+	}
+	return
+}
+
+// Returns the groups of matchers that could possibly match the message.
+func (self *routeIndex) candidates(msg *message.Message) (always, byType,
+	byLogger []*MatchRunner) {
+
+	return self.always, self.byType[msg.GetType()], self.byLogger[msg.GetLogger()]
 }
 
 // Creates and returns a (not yet started) Heka message router.
@@ -49,8 +104,10 @@ func NewMessageRouter() (router *messageRouter) {
 	router = new(messageRouter)
 	router.inChan = make(chan *PipelinePack, Globals().PluginChanSize)
 	router.mrChan = make(chan *MatchRunner, 0)
+	router.omrChan = make(chan *MatchRunner, 0)
 	router.fMatchers = make([]*MatchRunner, 0, 10)
 	router.oMatchers = make([]*MatchRunner, 0, 10)
+	router.index = newRouteIndex()
 	return router
 }
 
@@ -62,6 +119,32 @@ func (self *messageRouter) MrChan() chan *MatchRunner {
 	return self.mrChan
 }
 
+func (self *messageRouter) OMrChan() chan *MatchRunner {
+	return self.omrChan
+}
+
+// Adds the matcher to the provided set of matchers, or removes (and closes)
+// it if it's already a member. Returns the updated set.
+func toggleMatcher(matchers []*MatchRunner, matcher *MatchRunner) []*MatchRunner {
+	available := -1
+	for i, m := range matchers {
+		if m == nil {
+			available = i
+		}
+		if matcher == m {
+			close(m.inChan)
+			matchers[i] = nil
+			return matchers
+		}
+	}
+	if available != -1 {
+		matchers[available] = matcher
+	} else {
+		matchers = append(matchers, matcher)
+	}
+	return matchers
+}
+
 // Spawns a goroutine within which the router listens for messages on the
 // input channel and performs its routing magic. Spawned goroutine continues
 // until the router is shut down, triggered by closing the router's input
@@ -71,46 +154,32 @@ func (self *messageRouter) Start() {
 		var matcher *MatchRunner
 		var ok = true
 		var pack *PipelinePack
+		var groups [3][]*MatchRunner
+		self.index = newRouteIndex(self.fMatchers, self.oMatchers)
 		for ok {
 			runtime.Gosched()
 			select {
 			case matcher = <-self.mrChan:
 				if matcher != nil {
-					removed := false
-					available := -1
-					for i, m := range self.fMatchers {
-						if m == nil {
-							available = i
-						}
-						if matcher == m {
-							close(m.inChan)
-							self.fMatchers[i] = nil
-							removed = true
-							break
-						}
-					}
-					if !removed {
-						if available != -1 {
-							self.fMatchers[available] = matcher
-						} else {
-							self.fMatchers = append(self.fMatchers, matcher)
-						}
-					}
+					self.fMatchers = toggleMatcher(self.fMatchers, matcher)
+					self.index = newRouteIndex(self.fMatchers, self.oMatchers)
+				}
+			case matcher = <-self.omrChan:
+				if matcher != nil {
+					self.oMatchers = toggleMatcher(self.oMatchers, matcher)
+					self.index = newRouteIndex(self.fMatchers, self.oMatchers)
 				}
 			case pack, ok = <-self.inChan:
 				if !ok {
 					break
 				}
-				for _, matcher = range self.fMatchers {
-					if matcher != nil {
+				groups[0], groups[1], groups[2] = self.index.candidates(pack.Message)
+				for _, matchers := range groups {
+					for _, matcher = range matchers {
 						atomic.AddInt32(&pack.RefCount, 1)
-						matcher.inChan <- pack
+						matcher.deliver(pack)
 					}
 				}
-				for _, matcher = range self.oMatchers {
-					atomic.AddInt32(&pack.RefCount, 1)
-					matcher.inChan <- pack
-				}
 				pack.Recycle()
 			}
 		}
@@ -120,19 +189,44 @@ func (self *messageRouter) Start() {
 			}
 		}
 		for _, matcher = range self.oMatchers {
-			close(matcher.inChan)
+			if matcher != nil {
+				close(matcher.inChan)
+			}
 		}
 		log.Println("MessageRouter stopped.")
 	}()
 	log.Println("MessageRouter started.")
 }
 
+// Overload policies, determining what the router does w/ a message when a
+// plugin's MatchRunner input channel is full.
+const (
+	// Wait until there's room, backing up the router (the default).
+	OVERLOAD_BLOCK = "block"
+	// Discard the message that doesn't fit.
+	OVERLOAD_DROP_NEWEST = "drop_newest"
+	// Discard the oldest message waiting in the channel to make room.
+	OVERLOAD_DROP_OLDEST = "drop_oldest"
+)
+
 // Encapsulates the mechanics of testing messages against a specific plugin's
 // message_matcher value.
 type MatchRunner struct {
-	spec   *message.MatcherSpecification
-	signer string
-	inChan chan *PipelinePack
+	spec        *message.MatcherSpecification
+	signer      string
+	certSubject string
+	inChan      chan *PipelinePack
+	// Type and Logger values the spec requires a message to have, nil if
+	// there's no such requirement; used by the router's index.
+	types   []string
+	loggers []string
+	// What to do when inChan is full, one of the OVERLOAD_* values.
+	overloadPolicy string
+	// How long to wait for room in inChan before dropping a message.
+	overloadTimeout time.Duration
+	// Number of messages dropped due to the overload policy, accessed
+	// atomically.
+	dropped int64
 }
 
 // Creates and returns a new MatchRunner if possible, or a relevant error if
@@ -147,9 +241,74 @@ func NewMatchRunner(filter, signer string) (matcher *MatchRunner, err error) {
 		signer: signer,
 		inChan: make(chan *PipelinePack, Globals().PluginChanSize),
 	}
+	matcher.types, matcher.loggers = spec.IndexKeys()
 	return
 }
 
+// Sets the runner's overload policy and the timeout after which the policy
+// kicks in, returning an error for an unknown policy.
+func (mr *MatchRunner) SetOverloadPolicy(policy string,
+	timeout time.Duration) error {
+
+	switch policy {
+	case "":
+		policy = OVERLOAD_BLOCK
+	case OVERLOAD_BLOCK, OVERLOAD_DROP_NEWEST, OVERLOAD_DROP_OLDEST:
+	default:
+		return fmt.Errorf("invalid overload policy: %s", policy)
+	}
+	mr.overloadPolicy = policy
+	mr.overloadTimeout = timeout
+	return nil
+}
+
+// Returns the number of messages the router has dropped rather than
+// delivering them to the runner.
+func (mr *MatchRunner) Dropped() int64 {
+	return atomic.LoadInt64(&mr.dropped)
+}
+
+// Hands a pack off to the runner's input channel, applying the overload
+// policy if the channel is full. The pack's RefCount must already account
+// for this delivery.
+func (mr *MatchRunner) deliver(pack *PipelinePack) {
+	if mr.overloadPolicy == "" || mr.overloadPolicy == OVERLOAD_BLOCK {
+		mr.inChan <- pack
+		return
+	}
+
+	select {
+	case mr.inChan <- pack:
+		return
+	default:
+	}
+	if mr.overloadTimeout > 0 {
+		timer := time.NewTimer(mr.overloadTimeout)
+		select {
+		case mr.inChan <- pack:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+
+	if mr.overloadPolicy == OVERLOAD_DROP_OLDEST {
+		select {
+		case oldest := <-mr.inChan:
+			oldest.Recycle()
+			atomic.AddInt64(&mr.dropped, 1)
+		default:
+		}
+		select {
+		case mr.inChan <- pack:
+			return
+		default:
+		}
+	}
+	pack.Recycle()
+	atomic.AddInt64(&mr.dropped, 1)
+}
+
 // Returns the runner's MatcherSpecification object.
 func (mr *MatchRunner) MatcherSpecification() *message.MatcherSpecification {
 	return mr.spec
@@ -161,7 +320,20 @@ func (mr *MatchRunner) MatcherSpecification() *message.MatcherSpecification {
 // Output plugin). Any messages that are not a match will be immediately
 // recycled.
 func (mr *MatchRunner) Start(matchChan chan *PipelineCapture) {
+	mr.start(matchChan, false)
+}
+
+// Like Start, but closes matchChan once the runner has been removed from the
+// router, letting the consumer know no more matches are coming.
+func (mr *MatchRunner) StartClosing(matchChan chan *PipelineCapture) {
+	mr.start(matchChan, true)
+}
+
+func (mr *MatchRunner) start(matchChan chan *PipelineCapture, closeMatchChan bool) {
 	go func() {
+		if closeMatchChan {
+			defer close(matchChan)
+		}
 		defer func() {
 			if r := recover(); r != nil {
 				var err error
@@ -180,6 +352,10 @@ func (mr *MatchRunner) Start(matchChan chan *PipelineCapture) {
 				pack.Recycle()
 				continue
 			}
+			if len(mr.certSubject) != 0 && mr.certSubject != pack.CertSubject {
+				pack.Recycle()
+				continue
+			}
 			match, captures := mr.spec.Match(pack.Message)
 			if match {
 				plc := &PipelineCapture{Pack: pack, Captures: captures}
@@ -0,0 +1,119 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"sync/atomic"
+	"time"
+)
+
+// Temporarily attaches a message matcher to a running router so the messages
+// it matches can be inspected, i.e. streamed to a debugging client. A tap
+// never slows the router down: messages that arrive while the tap's channel
+// is full, or faster than its rate limit, are dropped.
+type RouterTap struct {
+	router  MessageRouter
+	matcher *MatchRunner
+	// Maximum number of messages handed over per second, 0 for no limit.
+	rate uint
+	// Numbers of messages handed over and dropped, accessed atomically.
+	sent    int64
+	dropped int64
+}
+
+// Creates a new tap for the router that matches messages w/ the provided
+// message_matcher spec, returning an error if the spec is invalid.
+func NewRouterTap(router MessageRouter, spec string, rate uint) (tap *RouterTap,
+	err error) {
+
+	tap = &RouterTap{router: router, rate: rate}
+	if tap.matcher, err = NewMatchRunner(spec, ""); err != nil {
+		return nil, err
+	}
+	tap.matcher.SetOverloadPolicy(OVERLOAD_DROP_NEWEST, 0)
+	return
+}
+
+// Attaches the tap to the router and calls `send` w/ each matching message
+// until `send` returns an error or the `done` channel is closed, then detaches
+// the tap. Returns the error returned by `send`, if any.
+func (self *RouterTap) Run(send func(msg *message.Message) error,
+	done <-chan bool) (err error) {
+
+	inChan := self.matcher.inChan
+	self.router.MrChan() <- self.matcher
+	defer func() {
+		// Detaching closes inChan, as does the router when it shuts down.
+		// Until then it may still be delivering packs, which we recycle.
+		detach := self.router.MrChan()
+		for {
+			select {
+			case detach <- self.matcher:
+				detach = nil
+			case pack, ok := <-inChan:
+				if !ok {
+					return
+				}
+				pack.Recycle()
+			}
+		}
+	}()
+
+	var windowStart time.Time
+	var windowCount uint
+	for {
+		select {
+		case <-done:
+			return
+		case pack, ok := <-inChan:
+			if !ok {
+				return // router shut down
+			}
+			if match, _ := self.matcher.spec.Match(pack.Message); !match {
+				pack.Recycle()
+				continue
+			}
+			if self.rate > 0 {
+				if now := time.Now(); now.Sub(windowStart) >= time.Second {
+					windowStart, windowCount = now, 0
+				}
+				if windowCount >= self.rate {
+					atomic.AddInt64(&self.dropped, 1)
+					pack.Recycle()
+					continue
+				}
+				windowCount++
+			}
+			err = send(pack.Message)
+			pack.Recycle()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&self.sent, 1)
+		}
+	}
+}
+
+// Returns the number of messages handed to the tap's consumer.
+func (self *RouterTap) Sent() int64 {
+	return atomic.LoadInt64(&self.sent)
+}
+
+// Returns the number of matching messages dropped, either by the rate limit
+// or because the tap's consumer wasn't keeping up.
+func (self *RouterTap) Dropped() int64 {
+	return atomic.LoadInt64(&self.dropped) + self.matcher.Dropped()
+}
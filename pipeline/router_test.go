@@ -0,0 +1,293 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"sync/atomic"
+	"time"
+)
+
+func RouterSpec(c gs.Context) {
+	NewPipelineConfig(nil) // initializes Globals()
+	recycleChan := make(chan *PipelinePack, 2)
+
+	// Returns a pack whose RefCount accounts for a router delivery.
+	routedPack := func() (pack *PipelinePack) {
+		pack = NewPipelinePack(recycleChan)
+		pack.Message = getTestMessage()
+		atomic.AddInt32(&pack.RefCount, 1)
+		return
+	}
+
+	c.Specify("A MatchRunner's overload policy", func() {
+		matcher, err := NewMatchRunner("TRUE", "")
+		c.Assume(err, gs.IsNil)
+		matcher.inChan = make(chan *PipelinePack, 1)
+		first := routedPack()
+		matcher.deliver(first)
+
+		c.Specify("rejects unknown policies", func() {
+			err := matcher.SetOverloadPolicy("drop_everything", 0)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("drops the newest message when full", func() {
+			err := matcher.SetOverloadPolicy(OVERLOAD_DROP_NEWEST, 0)
+			c.Assume(err, gs.IsNil)
+			second := routedPack()
+			matcher.deliver(second)
+			c.Expect(<-matcher.inChan, gs.Equals, first)
+			c.Expect(matcher.Dropped(), gs.Equals, int64(1))
+			c.Expect(atomic.LoadInt32(&second.RefCount), gs.Equals, int32(1))
+		})
+
+		c.Specify("drops the oldest message when full", func() {
+			err := matcher.SetOverloadPolicy(OVERLOAD_DROP_OLDEST, 0)
+			c.Assume(err, gs.IsNil)
+			second := routedPack()
+			matcher.deliver(second)
+			c.Expect(<-matcher.inChan, gs.Equals, second)
+			c.Expect(matcher.Dropped(), gs.Equals, int64(1))
+			c.Expect(atomic.LoadInt32(&first.RefCount), gs.Equals, int32(1))
+		})
+
+		c.Specify("waits for the timeout before dropping", func() {
+			err := matcher.SetOverloadPolicy(OVERLOAD_DROP_NEWEST, time.Second)
+			c.Assume(err, gs.IsNil)
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				<-matcher.inChan
+			}()
+			second := routedPack()
+			matcher.deliver(second)
+			c.Expect(<-matcher.inChan, gs.Equals, second)
+			c.Expect(matcher.Dropped(), gs.Equals, int64(0))
+		})
+	})
+
+	c.Specify("A router's matcher index", func() {
+		newMatcher := func(spec string) *MatchRunner {
+			matcher, err := NewMatchRunner(spec, "")
+			c.Assume(err, gs.IsNil)
+			return matcher
+		}
+		byType := newMatcher("Type == 'TEST' && Severity == 6")
+		otherType := newMatcher("Type == 'OTHER'")
+		byLogger := newMatcher("Logger == 'GoSpec' || Logger == 'other'")
+		otherLogger := newMatcher("Type != 'OTHER' && Logger == 'other'")
+		unindexed := newMatcher("Type == 'OTHER' || Severity == 6")
+		index := newRouteIndex([]*MatchRunner{byType, otherType, nil},
+			[]*MatchRunner{byLogger, otherLogger, unindexed})
+
+		c.Specify("only returns the matchers a message can match", func() {
+			candidates := make(map[*MatchRunner]int)
+			always, types, loggers := index.candidates(getTestMessage())
+			for _, group := range [][]*MatchRunner{always, types, loggers} {
+				for _, matcher := range group {
+					candidates[matcher]++
+				}
+			}
+			c.Expect(len(candidates), gs.Equals, 3)
+			c.Expect(candidates[byType], gs.Equals, 1)
+			c.Expect(candidates[byLogger], gs.Equals, 1)
+			c.Expect(candidates[unindexed], gs.Equals, 1)
+		})
+
+		c.Specify("doesn't change the RefCount of skipped matchers' packs", func() {
+			router := NewMessageRouter()
+			router.fMatchers = append(router.fMatchers, byType, otherType)
+			router.Start()
+			pack := NewPipelinePack(recycleChan)
+			pack.Message = getTestMessage()
+			router.InChan() <- pack
+			other := NewPipelinePack(recycleChan)
+			other.Message = getTestMessage()
+			other.Message.SetType("OTHER")
+			router.InChan() <- other
+			close(router.InChan())
+
+			// The router closes the matchers' channels once it's done w/ the
+			// packs, leaving only the reference held by byType.
+			delivered := func(matcher *MatchRunner) (packs []*PipelinePack) {
+				for pack := range matcher.inChan {
+					packs = append(packs, pack)
+				}
+				return
+			}
+			otherPacks := delivered(otherType)
+			byTypePacks := delivered(byType)
+			c.Expect(len(otherPacks), gs.Equals, 1)
+			c.Expect(len(byTypePacks), gs.Equals, 1)
+			if len(otherPacks) == 1 && len(byTypePacks) == 1 {
+				c.Expect(otherPacks[0], gs.Equals, other)
+				c.Expect(byTypePacks[0], gs.Equals, pack)
+			}
+			c.Expect(atomic.LoadInt32(&pack.RefCount), gs.Equals, int32(1))
+		})
+	})
+
+	c.Specify("A router tap", func() {
+		router := NewMessageRouter()
+		router.Start()
+		defer close(router.InChan())
+		packSupply := make(chan *PipelinePack, 100)
+		inject := func(msgType string) {
+			pack := NewPipelinePack(packSupply)
+			pack.Message = getTestMessage()
+			pack.Message.SetType(msgType)
+			router.InChan() <- pack
+		}
+
+		received := make(chan *message.Message, 100)
+		send := func(msg *message.Message) error {
+			received <- msg
+			return nil
+		}
+		done := make(chan bool)
+		finished := make(chan bool)
+
+		// Injects messages until the tap is attached and has sent one.
+		attached := func(tap *RouterTap) bool {
+			for i := 0; i < 100 && tap.Sent() == 0; i++ {
+				inject("TEST")
+				time.Sleep(5 * time.Millisecond)
+			}
+			return tap.Sent() > 0
+		}
+
+		c.Specify("sends matching messages until it's done", func() {
+			tap, err := NewRouterTap(router, "Type == 'TEST'", 0)
+			c.Assume(err, gs.IsNil)
+			go func() {
+				tap.Run(send, done)
+				close(finished)
+			}()
+			c.Assume(attached(tap), gs.IsTrue)
+			time.Sleep(10 * time.Millisecond) // let stray probes arrive
+			sent := tap.Sent()
+			inject("OTHER")
+			inject("TEST")
+			for i := 0; i < 100 && tap.Sent() == sent; i++ {
+				time.Sleep(5 * time.Millisecond)
+			}
+			c.Expect(tap.Sent(), gs.Equals, sent+1)
+			for len(received) > 0 {
+				msg := <-received
+				c.Expect(msg.GetType(), gs.Equals, "TEST")
+			}
+
+			close(done)
+			<-finished
+			inject("TEST")
+			time.Sleep(10 * time.Millisecond)
+			c.Expect(len(received), gs.Equals, 0)
+		})
+
+		c.Specify("drops messages over its rate limit", func() {
+			tap, err := NewRouterTap(router, "Type == 'TEST'", 1)
+			c.Assume(err, gs.IsNil)
+			go func() {
+				tap.Run(send, done)
+				close(finished)
+			}()
+			c.Assume(attached(tap), gs.IsTrue)
+			dropped := tap.Dropped()
+			for i := 0; i < 3; i++ {
+				inject("TEST")
+			}
+			for i := 0; i < 100 && tap.Dropped() < dropped+3; i++ {
+				time.Sleep(5 * time.Millisecond)
+			}
+			c.Expect(tap.Dropped(), gs.Equals, dropped+3)
+			c.Expect(tap.Sent(), gs.Equals, int64(1))
+			close(done)
+			<-finished
+		})
+
+		c.Specify("detaches when sending fails", func() {
+			tap, err := NewRouterTap(router, "TRUE", 0)
+			c.Assume(err, gs.IsNil)
+			go func() {
+				err = tap.Run(func(msg *message.Message) error {
+					return errors.New("client went away")
+				}, done)
+				close(finished)
+			}()
+			detached := false
+			for i := 0; i < 100 && !detached; i++ {
+				inject("TEST")
+				select {
+				case <-finished:
+					detached = true
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+			c.Expect(detached, gs.IsTrue)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("detaches when Heka is stopping", func() {
+			tap, err := NewRouterTap(router, "Type == 'TEST'", 0)
+			c.Assume(err, gs.IsNil)
+			go func() {
+				tap.Run(send, done)
+				close(finished)
+			}()
+			c.Assume(attached(tap), gs.IsTrue)
+			Globals().Stopping = true
+			defer func() {
+				Globals().Stopping = false
+			}()
+			close(done)
+			select {
+			case <-finished:
+			case <-time.After(time.Second):
+				c.Expect("tap", gs.Equals, "detached")
+			}
+		})
+
+		c.Specify("ends when the router shuts down", func() {
+			other := NewMessageRouter()
+			other.Start()
+			tap, err := NewRouterTap(other, "Type == 'TEST'", 0)
+			c.Assume(err, gs.IsNil)
+			go func() {
+				tap.Run(send, done)
+				close(finished)
+			}()
+			for i := 0; i < 100 && tap.Sent() == 0; i++ {
+				pack := NewPipelinePack(packSupply)
+				pack.Message = getTestMessage()
+				other.InChan() <- pack
+				time.Sleep(5 * time.Millisecond)
+			}
+			c.Assume(tap.Sent() > 0, gs.IsTrue)
+			close(other.InChan())
+			select {
+			case <-finished:
+			case <-time.After(time.Second):
+				c.Expect("tap", gs.Equals, "ended")
+			}
+		})
+
+		c.Specify("rejects an invalid matcher", func() {
+			_, err := NewRouterTap(router, "Type = 'TEST'", 0)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
@@ -130,6 +130,11 @@ func createRunner(dir, name string, configSection toml.Primitive) (FilterRunner,
 			return nil, fmt.Errorf("Can't create message matcher for '%s': %s",
 				wrapper.name, err)
 		}
+		matcher.certSubject = pluginGlobals.CertSubject
+		if err = matcher.SetOverloadPolicy(pluginGlobals.OverloadPolicy,
+			time.Duration(pluginGlobals.OverloadTimeout)*time.Millisecond); err != nil {
+			return nil, fmt.Errorf("'%s': %s", wrapper.name, err)
+		}
 		runner.matcher = matcher
 	}
 
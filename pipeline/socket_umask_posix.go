@@ -0,0 +1,37 @@
+//go:build !windows
+// +build !windows
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"sync"
+	"syscall"
+)
+
+// The umask is process wide, so only one socket is created under it at a time.
+var umaskLock sync.Mutex
+
+// Calls `create` w/ a umask that leaves new files accessible only by their
+// owner, so a socket can't be connected to before its configured permissions
+// are applied.
+func withPrivateUmask(create func() error) error {
+	umaskLock.Lock()
+	defer umaskLock.Unlock()
+	oldMask := syscall.Umask(0177)
+	defer syscall.Umask(oldMask)
+	return create()
+}
@@ -79,7 +79,7 @@ func (s *StatFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
 	)
 
 	// Pull the statsd input out
-	ir, ok = h.PipelineConfig().InputRunners[s.inputName]
+	ir, ok = h.PipelineConfig().Input(s.inputName)
 	if !ok {
 		return fmt.Errorf("Unable to locate StatsdInput '%s', was it configured?",
 			s.inputName)
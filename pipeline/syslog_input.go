@@ -0,0 +1,469 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"code.google.com/p/go-uuid/uuid"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Priority of syslog messages that don't specify one, user.notice.
+const syslogDefaultPri = 13
+
+// UTF-8 byte order mark that may start an RFC5424 message.
+const syslogBom = "\xef\xbb\xbf"
+
+// Input plugin implementation that listens for syslog messages in either
+// the RFC5424 or the BSD (RFC3164) format, over UDP, TCP, or unix sockets,
+// and generates fully decoded messages from them. Stream connections may use
+// either octet counted or newline terminated framing (RFC6587).
+type SyslogInput struct {
+	// Set for stream (tcp and unix) sockets.
+	listener net.Listener
+	// Set for datagram (udp and unixgram) sockets.
+	conn     net.PacketConn
+	wg       sync.WaitGroup
+	stopChan chan bool
+	ir       InputRunner
+	hostname string
+	config   *SyslogInputConfig
+}
+
+// ConfigStruct for SyslogInput plugin.
+type SyslogInputConfig struct {
+	// Type of socket to listen on: "udp" (the default), "tcp", "unix" for a
+	// stream unix socket, or "unixgram" for a datagram unix socket (i.e. in
+	// place of /dev/log).
+	Net string `toml:"net"`
+	// Address on which to listen, i.e. "127.0.0.1:514" for udp and tcp or
+	// the socket's path for unix and unixgram.
+	Address string `toml:"address"`
+	// File mode (in octal), owner, and group of a unix socket.
+	SocketMode  string `toml:"socket_mode"`
+	SocketOwner string `toml:"socket_owner"`
+	SocketGroup string `toml:"socket_group"`
+}
+
+func (self *SyslogInput) ConfigStruct() interface{} {
+	return &SyslogInputConfig{
+		Net:     "udp",
+		Address: "127.0.0.1:514",
+	}
+}
+
+func (self *SyslogInput) Init(config interface{}) (err error) {
+	self.config = config.(*SyslogInputConfig)
+	switch self.config.Net {
+	case "udp":
+		self.conn, err = net.ListenPacket(self.config.Net, self.config.Address)
+	case "tcp":
+		self.listener, err = net.Listen(self.config.Net, self.config.Address)
+	case "unix", "unixgram":
+		var listener io.Closer
+		if listener, err = listenUnix(self.config.Net, self.config.Address,
+			self.config.SocketMode, self.config.SocketOwner,
+			self.config.SocketGroup); err != nil {
+			return
+		}
+		if self.config.Net == "unix" {
+			self.listener = listener.(net.Listener)
+		} else {
+			self.conn = listener.(net.PacketConn)
+		}
+	default:
+		return fmt.Errorf("unsupported net: %s", self.config.Net)
+	}
+	if err != nil {
+		return fmt.Errorf("listen failed: %s", err)
+	}
+	self.stopChan = make(chan bool)
+	self.hostname, _ = os.Hostname()
+	return
+}
+
+func (self *SyslogInput) Run(ir InputRunner, h PluginHelper) (err error) {
+	self.ir = ir
+	if self.conn != nil {
+		self.readPackets()
+		return
+	}
+
+	var conn net.Conn
+	var e error
+	for {
+		if conn, e = self.listener.Accept(); e != nil {
+			if netErr, ok := e.(net.Error); ok && netErr.Temporary() {
+				ir.LogError(fmt.Errorf("accept failed: %s", e))
+				continue
+			}
+			break
+		}
+		self.wg.Add(1)
+		go self.handleConnection(conn)
+	}
+	self.wg.Wait()
+	return
+}
+
+func (self *SyslogInput) Stop() {
+	close(self.stopChan)
+	if self.conn != nil {
+		self.conn.Close()
+		if self.config.Net == "unixgram" {
+			// Unlike stream sockets' listeners, closing doesn't remove it.
+			os.Remove(self.config.Address)
+		}
+	} else {
+		self.listener.Close()
+	}
+}
+
+// Returns true if the input has been stopped.
+func (self *SyslogInput) stopping() bool {
+	select {
+	case <-self.stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// Generates a message from each datagram received until the input is
+// stopped.
+func (self *SyslogInput) readPackets() {
+	buf := make([]byte, message.MAX_MESSAGE_SIZE)
+	for {
+		n, addr, err := self.conn.ReadFrom(buf)
+		if err != nil {
+			if self.stopping() {
+				return
+			}
+			self.ir.LogError(fmt.Errorf("read error: %s", err))
+			continue
+		}
+		self.inject(buf[:n], addr)
+	}
+}
+
+// Generates a message from each syslog message read from the connection
+// until it's closed or the input is stopped.
+func (self *SyslogInput) handleConnection(conn net.Conn) {
+	defer self.wg.Done()
+	finished := make(chan bool)
+	defer close(finished)
+	go func() {
+		select {
+		case <-self.stopChan:
+			conn.Close()
+		case <-finished:
+		}
+	}()
+	defer conn.Close()
+
+	reader := bufio.NewReaderSize(conn, message.MAX_MESSAGE_SIZE)
+	for {
+		frame, err := readSyslogFrame(reader)
+		if err != nil {
+			if err != io.EOF && !self.stopping() {
+				self.ir.LogError(fmt.Errorf("connection from %s: %s",
+					conn.RemoteAddr(), err))
+			}
+			return
+		}
+		self.inject(frame, conn.RemoteAddr())
+	}
+}
+
+// Reads the next syslog message from a stream connection. Messages are
+// either octet counted, i.e. "8 <13>Hi!\n", or terminated by a newline. The
+// returned slice is only valid until the next read.
+func readSyslogFrame(reader *bufio.Reader) (frame []byte, err error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+	if first[0] < '1' || first[0] > '9' {
+		frame, err = reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return nil, errors.New("message exceeds the maximum length")
+		}
+		if err == io.EOF && len(frame) > 0 {
+			err = nil // last message w/o a trailing newline
+		}
+		return
+	}
+
+	var lengthBytes []byte
+	if lengthBytes, err = reader.ReadSlice(' '); err != nil {
+		if err == bufio.ErrBufferFull {
+			err = errors.New("invalid message length")
+		}
+		return
+	}
+	length, err := strconv.Atoi(string(lengthBytes[:len(lengthBytes)-1]))
+	if err != nil || length > message.MAX_MESSAGE_SIZE {
+		return nil, fmt.Errorf("invalid message length: %q",
+			lengthBytes[:len(lengthBytes)-1])
+	}
+	frame = make([]byte, length)
+	if _, err = io.ReadFull(reader, frame); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// Generates a message from a syslog message received from the address.
+func (self *SyslogInput) inject(record []byte, addr net.Addr) {
+	record = bytes.TrimRight(record, "\r\n\x00")
+	if len(record) == 0 {
+		return
+	}
+	pack := <-self.ir.InChan()
+	msg := pack.Message
+	msg.SetUuid(uuid.NewRandom())
+	msg.SetType("syslog")
+	parseSyslog(string(record), msg, time.Now())
+	if msg.GetHostname() == "" {
+		// Use the sender's address, or our own name for local senders.
+		hostname := self.hostname
+		if addr != nil {
+			if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+				hostname = host
+			}
+		}
+		msg.SetHostname(hostname)
+	}
+	pack.Decoded = true
+	self.ir.Inject(pack)
+}
+
+// Populates the message from a syslog message in either the RFC5424 or the
+// BSD (RFC3164) format. As RFC3164 recommends, whatever can't be parsed is
+// left in the payload. The PRI sets the Severity and the `facility` field,
+// the APP-NAME or TAG the Logger, and a numeric PROCID the Pid. RFC5424
+// structured data params become fields named "<SD-ID>.<PARAM-NAME>".
+func parseSyslog(line string, msg *message.Message, now time.Time) {
+	pri := syslogDefaultPri
+	if strings.HasPrefix(line, "<") {
+		// Atoi would also take signs, the PRI is only ever digits.
+		end := strings.Index(line, ">")
+		if end > 1 && end < 5 && strings.Trim(line[1:end], "0123456789") == "" {
+			if p, err := strconv.Atoi(line[1:end]); err == nil && p >= 0 && p < 192 {
+				pri = p
+				line = line[end+1:]
+			}
+		}
+	}
+	msg.SetSeverity(int32(pri % 8))
+	if field, err := message.NewField("facility", pri/8, message.Field_RAW); err == nil {
+		msg.AddField(field)
+	}
+
+	if !parseRfc5424(line, msg, now) {
+		parseRfc3164(line, msg, now)
+	}
+}
+
+// Returns the value of an RFC5424 header field, or "" for the NILVALUE.
+func syslogValue(value string) string {
+	if value == "-" {
+		return ""
+	}
+	return value
+}
+
+// Populates the message from the part of an RFC5424 syslog message after the
+// PRI, i.e. "1 2013-05-01T12:00:00Z host app 123 ID47 [id a="b"] Hi!".
+// Returns false, leaving the message unchanged, if it isn't in the RFC5424
+// format.
+func parseRfc5424(line string, msg *message.Message, now time.Time) bool {
+	if !strings.HasPrefix(line, "1 ") {
+		return false
+	}
+	// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+	parts := strings.SplitN(line[2:], " ", 6)
+	if len(parts) < 6 {
+		return false
+	}
+	var timestamp time.Time
+	if parts[0] != "-" {
+		var err error
+		if timestamp, err = message.ForgivingTimeParse(time.RFC3339Nano,
+			parts[0]); err != nil {
+			return false
+		}
+	}
+	params, payload, ok := parseStructuredData(parts[5])
+	if !ok {
+		return false
+	}
+
+	if timestamp.IsZero() {
+		timestamp = now
+	}
+	msg.SetTimestamp(timestamp.UnixNano())
+	msg.SetHostname(syslogValue(parts[1]))
+	msg.SetLogger(syslogValue(parts[2]))
+	if pid, err := strconv.ParseInt(parts[3], 10, 32); err == nil {
+		msg.SetPid(int32(pid))
+	}
+	if msgId := syslogValue(parts[4]); msgId != "" {
+		if field, err := message.NewField("msgid", msgId, message.Field_RAW); err == nil {
+			msg.AddField(field)
+		}
+	}
+	for _, param := range params {
+		if field := msg.FindFirstField(param[0]); field != nil {
+			field.AddValue(param[1])
+		} else if field, err := message.NewField(param[0], param[1],
+			message.Field_RAW); err == nil {
+			msg.AddField(field)
+		}
+	}
+	msg.SetPayload(strings.TrimPrefix(payload, syslogBom))
+	return true
+}
+
+// Parses RFC5424 structured data, either the NILVALUE or a list of elements
+// like `[id a="b" c="d"]`, followed by the optional MSG. Returns the params
+// as name, value pairs and the MSG, or false if the structured data is
+// malformed.
+func parseStructuredData(data string) (params [][2]string, msg string,
+	ok bool) {
+
+	if strings.HasPrefix(data, "-") {
+		data = data[1:]
+	} else if !strings.HasPrefix(data, "[") {
+		return
+	}
+	for strings.HasPrefix(data, "[") {
+		end := strings.IndexAny(data, " ]")
+		if end < 2 {
+			return
+		}
+		id := data[1:end]
+		data = data[end:]
+		for strings.HasPrefix(data, " ") {
+			data = data[1:]
+			eq := strings.Index(data, "=\"")
+			if eq < 1 {
+				return
+			}
+			name := data[:eq]
+			data = data[eq+2:]
+			// Values escape '"', '\', and ']' w/ a backslash.
+			var value []byte
+			i := 0
+			for ; i < len(data) && data[i] != '"'; i++ {
+				if data[i] == '\\' && i+1 < len(data) &&
+					strings.IndexByte("\"\\]", data[i+1]) != -1 {
+					i++
+				}
+				value = append(value, data[i])
+			}
+			if i == len(data) {
+				return
+			}
+			params = append(params, [2]string{id + "." + name, string(value)})
+			data = data[i+1:]
+		}
+		if !strings.HasPrefix(data, "]") {
+			return
+		}
+		data = data[1:]
+	}
+	if data != "" {
+		if data[0] != ' ' {
+			return
+		}
+		msg = data[1:]
+	}
+	return params, msg, true
+}
+
+// Populates the message from the part of a BSD syslog message after the PRI,
+// i.e. "May  1 12:00:00 host app[123]: Hi!". The timestamp may also be in
+// the RFC3339 format, as some syslog daemons send, and the hostname is often
+// left out by local senders.
+func parseRfc3164(line string, msg *message.Message, now time.Time) {
+	var timestamp time.Time
+	if len(line) > len(time.Stamp) && line[len(time.Stamp)] == ' ' {
+		if t, err := message.ForgivingTimeParse(time.Stamp,
+			line[:len(time.Stamp)]); err == nil {
+			// No year or time zone, assume our local time zone and the most
+			// recent year that doesn't put it in the future.
+			timestamp = time.Date(now.Year(), t.Month(), t.Day(), t.Hour(),
+				t.Minute(), t.Second(), 0, time.Local)
+			if timestamp.Sub(now) > 24*time.Hour {
+				timestamp = timestamp.AddDate(-1, 0, 0)
+			}
+			line = line[len(time.Stamp)+1:]
+		}
+	}
+	if timestamp.IsZero() {
+		if space := strings.Index(line, " "); space > 0 {
+			if t, err := message.ForgivingTimeParse(time.RFC3339Nano,
+				line[:space]); err == nil {
+				timestamp = t
+				line = line[space+1:]
+			}
+		}
+	}
+	if timestamp.IsZero() {
+		// Not a syslog header, it's all payload.
+		msg.SetTimestamp(now.UnixNano())
+		msg.SetPayload(line)
+		return
+	}
+	msg.SetTimestamp(timestamp.UnixNano())
+
+	// The hostname is followed by the TAG, unless it *is* the TAG.
+	if space := strings.Index(line, " "); space > 0 {
+		if word := line[:space]; !strings.HasSuffix(word, ":") &&
+			!strings.Contains(word, "[") {
+			msg.SetHostname(word)
+			line = line[space+1:]
+		}
+	}
+	// TAG, i.e. "app[123]: " or "app: ".
+	if end := strings.IndexAny(line, "[: "); end > 0 {
+		tag, rest := line[:end], line[end:]
+		var pid string
+		if strings.HasPrefix(rest, "[") {
+			if bracket := strings.Index(rest, "]"); bracket > 0 {
+				pid, rest = rest[1:bracket], rest[bracket+1:]
+			}
+		}
+		if strings.HasPrefix(rest, ":") {
+			msg.SetLogger(tag)
+			if n, err := strconv.ParseInt(pid, 10, 32); err == nil {
+				msg.SetPid(int32(n))
+			}
+			line = strings.TrimPrefix(rest[1:], " ")
+		}
+	}
+	msg.SetPayload(line)
+}
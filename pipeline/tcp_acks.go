@@ -0,0 +1,152 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"encoding/binary"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Acknowledged delivery between TcpOutput and TcpInput works on batches of
+// records. Every record in a batch carries the batch's sequence number and
+// record count in its header. Once all of a batch's records have been handed
+// off to the router the TcpInput writes the batch sequence number back over
+// the same connection, as an ACK_SIZE byte big endian unsigned integer.
+const ACK_SIZE = 8
+
+// How long a TcpInput will wait on a stalled sender while writing an ack.
+const ackWriteTimeout = 5 * time.Second
+
+// Tracks the acknowledged delivery batches received on a single TcpInput
+// connection, writing a batch's sequence number back to the sender once every
+// one of its records has been handed off to the router.
+type batchAcker struct {
+	conn    net.Conn
+	lock    sync.Mutex
+	counts  map[uint64]uint32
+	acks    chan uint64
+	stopped bool
+}
+
+func newBatchAcker(conn net.Conn) (acker *batchAcker) {
+	acker = &batchAcker{
+		conn:   conn,
+		counts: make(map[uint64]uint32),
+		acks:   make(chan uint64, Globals().PluginChanSize),
+	}
+	go acker.writeAcks()
+	return
+}
+
+// Returns a callback to be invoked when a single record from the specified
+// batch has been delivered.
+func (self *batchAcker) AckFunc(seq uint64, size uint32) func() {
+	return func() {
+		self.lock.Lock()
+		defer self.lock.Unlock()
+		if self.stopped {
+			return
+		}
+		self.counts[seq]++
+		if self.counts[seq] < size {
+			return
+		}
+		delete(self.counts, seq)
+		select {
+		case self.acks <- seq:
+		default:
+			// Never block delivery on a slow sender. A dropped ack means the
+			// batch will be retransmitted, which is safe for at-least-once
+			// delivery.
+		}
+	}
+}
+
+// Writes acks out to the connection until Stop is called.
+func (self *batchAcker) writeAcks() {
+	ackBytes := make([]byte, ACK_SIZE)
+	for seq := range self.acks {
+		binary.BigEndian.PutUint64(ackBytes, seq)
+		self.conn.SetWriteDeadline(time.Now().Add(ackWriteTimeout))
+		self.conn.Write(ackBytes)
+	}
+}
+
+// Stops the acker, any records delivered after this will not be acked.
+func (self *batchAcker) Stop() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.stopped {
+		self.stopped = true
+		close(self.acks)
+	}
+}
+
+// A batch of framed records sent by a TcpOutput that has not yet been acked.
+type ackBatch struct {
+	seq    uint64
+	data   []byte
+	sentAt time.Time
+}
+
+// Frames each of the provided encoded messages as a Heka protocol record
+// belonging to the batch with the given sequence number, concatenating all of
+// the records into a single byte slice.
+func encodeAckBatch(seq uint64, msgs [][]byte) (data []byte, err error) {
+	var headerBytes []byte
+	header := &message.Header{}
+	header.SetBatchSequence(seq)
+	header.SetBatchSize(uint32(len(msgs)))
+	for _, msgBytes := range msgs {
+		header.SetMessageLength(uint32(len(msgBytes)))
+		if headerBytes, err = proto.Marshal(header); err != nil {
+			return nil, fmt.Errorf("can't encode record header: %s", err)
+		}
+		data = append(data, message.RECORD_SEPARATOR, uint8(len(headerBytes)))
+		data = append(data, headerBytes...)
+		data = append(data, message.UNIT_SEPARATOR)
+		data = append(data, msgBytes...)
+	}
+	return
+}
+
+// Reads acks from a TcpOutput connection, passing the sequence numbers along
+// on the acks channel. When the connection fails it is sent on the broken
+// channel. Exits when the done channel is closed.
+func readAcks(conn net.Conn, acks chan<- uint64, broken chan<- net.Conn,
+	done <-chan bool) {
+
+	ackBytes := make([]byte, ACK_SIZE)
+	for {
+		if _, err := io.ReadFull(conn, ackBytes); err != nil {
+			select {
+			case broken <- conn:
+			case <-done:
+			}
+			return
+		}
+		select {
+		case acks <- binary.BigEndian.Uint64(ackBytes):
+		case <-done:
+			return
+		}
+	}
+}
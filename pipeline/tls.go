@@ -0,0 +1,145 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// How long a client gets to complete the TLS handshake before the connection
+// is dropped.
+var tlsHandshakeTimeout = 10 * time.Second
+
+// Maps the accepted `min_version` config values to TLS protocol versions.
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// TOML config subsection for the plugins that support TLS encrypted
+// connections.
+type TlsConfig struct {
+	// Path to the PEM encoded certificate this end of the connection will
+	// present to its peer.
+	CertFile string `toml:"cert_file"`
+	// Path to the PEM encoded private key matching CertFile.
+	KeyFile string `toml:"key_file"`
+	// Path to a PEM encoded CA bundle. Listeners use it to verify client
+	// certificates, dialers use it to verify the server certificate instead
+	// of the host's root CAs.
+	CaFile string `toml:"ca_file"`
+	// Listeners only, reject clients that don't present a certificate that
+	// can be verified against CaFile.
+	RequireClientCert bool `toml:"require_client_cert"`
+	// Minimum accepted protocol version, one of "TLS10", "TLS11", "TLS12", or
+	// "TLS13". If empty Go's crypto/tls default minimum is used.
+	MinVersion string `toml:"min_version"`
+}
+
+// Builds the settings shared by listener and dialer side TLS configs.
+func (self *TlsConfig) baseConfig() (goConf *tls.Config, pool *x509.CertPool,
+	err error) {
+
+	goConf = new(tls.Config)
+	if self.MinVersion != "" {
+		var ok bool
+		if goConf.MinVersion, ok = tlsVersions[self.MinVersion]; !ok {
+			return nil, nil, fmt.Errorf("Invalid TLS min_version: %s",
+				self.MinVersion)
+		}
+	}
+	if self.CertFile != "" || self.KeyFile != "" {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(self.CertFile, self.KeyFile); err != nil {
+			return nil, nil, fmt.Errorf("Can't load TLS key pair: %s", err)
+		}
+		goConf.Certificates = []tls.Certificate{cert}
+	}
+	if self.CaFile != "" {
+		var pem []byte
+		if pem, err = ioutil.ReadFile(self.CaFile); err != nil {
+			return nil, nil, fmt.Errorf("Can't read TLS CA file: %s", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("No certificates found in TLS CA file: %s",
+				self.CaFile)
+		}
+	}
+	return
+}
+
+// Returns a Go TLS config suitable for wrapping a listener.
+func (self *TlsConfig) ServerConfig() (goConf *tls.Config, err error) {
+	var pool *x509.CertPool
+	if goConf, pool, err = self.baseConfig(); err != nil {
+		return
+	}
+	if len(goConf.Certificates) == 0 {
+		return nil, fmt.Errorf("TLS listener requires cert_file and key_file")
+	}
+	goConf.ClientCAs = pool
+	if self.RequireClientCert {
+		if pool == nil {
+			return nil, fmt.Errorf("TLS require_client_cert requires ca_file")
+		}
+		goConf.ClientAuth = tls.RequireAndVerifyClientCert
+	} else if pool != nil {
+		goConf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return
+}
+
+// Returns a Go TLS config suitable for dialing out to a TLS listener.
+func (self *TlsConfig) ClientConfig() (goConf *tls.Config, err error) {
+	var pool *x509.CertPool
+	if goConf, pool, err = self.baseConfig(); err != nil {
+		return
+	}
+	goConf.RootCAs = pool
+	return
+}
+
+// Completes the handshake on a TLS connection and returns the subject of the
+// client certificate, or an empty string if the connection isn't using TLS or
+// the client didn't present a verified certificate. Clients that don't
+// complete the handshake within tlsHandshakeTimeout get an error.
+func tlsCertSubject(conn net.Conn) (subject string, err error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return
+	}
+	if err = tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout)); err != nil {
+		return
+	}
+	if err = tlsConn.Handshake(); err != nil {
+		return
+	}
+	if err = tlsConn.SetDeadline(time.Time{}); err != nil {
+		return
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) > 0 && len(state.PeerCertificates) > 0 {
+		subject = state.PeerCertificates[0].Subject.String()
+	}
+	return
+}